@@ -12,21 +12,110 @@ const (
 	RequestIdHeader = "X-Request-ID"
 	ResCode         = "resCode"
 	ResDesc         = "ResDesc"
+	PendingToken    = "pending"
+	TotpCode        = "totp"
+	TotpSecret      = "totpsecret"
+	TotpURI         = "totpuri"
+	RecoveryCodes   = "recoverycodes"
+	NewPw           = "newpw"
+	UserAgent       = "ua"
+	ClientIP        = "ip"
+	CreatedAt       = "created"
+	LastSeen        = "lastseen"
+	PublicSessId    = "psid" // session.PublicId of a session, safe to show to clients
+	Current         = "current"
+	KeySet          = "jwks" // JSON Web Key Set of the session token keys
+	Remember        = "remember"
+	RememberToken   = "remembertoken"
+	Impersonator    = "impersonator"
+	TotpEnabled     = "totpenabled"
+	AuthMethods     = "authmethods" // comma separated, see AUTH_METHOD_*
+	RecordKind      = "kind"        // what a record in Response.List is, see RECORD_*
+	Version         = "version"     // of a user's profile, see User.Version
+	Email           = "email"
+	Bio             = "bio"
+	Timezone        = "timezone"
+	LastLogin       = "lastlogin"
+	EventId         = "eventid"
+	EventType       = "event"  // see EVENT_*
+	EventTime       = "at"     // RFC 3339
+	Actor           = "actor"  // who made a request, the user unless an admin is impersonating them
+	Reason          = "reason" // see REASON_*
+	Detail          = "detail"
+	Since           = "since"  // RFC 3339, bounds the time of the records listed
+	Until           = "until"  // RFC 3339, bounds the time of the records listed
+	Before          = "before" // id of a record, only older records are listed
+	Limit           = "limit"  // most records listed at once
+)
+
+// Types of security events
+const (
+	EVENT_LOGIN_SUCCESS  = "login_success"
+	EVENT_LOGIN_FAILURE  = "login_failure"
+	EVENT_LOGOUT         = "logout"
+	EVENT_REGISTER       = "register"
+	EVENT_PROFILE_EDIT   = "profile_edit"
+	EVENT_SESSION_REVOKE = "session_revoke"
+)
+
+// Why a login failed
+const (
+	REASON_UNKNOWN_USER   = "unknown_user"
+	REASON_WRONG_PASSWORD = "wrong_password"
+	REASON_WRONG_TOTP     = "wrong_totp"
+	REASON_SESSION_LIMIT  = "session_limit"
+	REASON_INVALID_TOKEN  = "invalid_token" // unknown, expired or used up pending login or remember-me token
+	REASON_TOKEN_THEFT    = "token_theft"   // a remember-me token was reused or forged, its family was revoked
+	REASON_ERROR          = "error"
+)
+
+// Kinds of records in an account export
+const (
+	RECORD_LOGIN   = "login"
+	RECORD_SESSION = "session"
 )
 
 // Login constants
 const (
-	LOGIN_SUCCESS    = 10
-	LOGIN_FAILED     = 11
-	EDIT_SUCCESS     = 20
-	EDIT_FAILED      = 21
-	LOGOUT_SUCCESS   = 30
-	INSERT_SUCCESS   = 40
-	INSERT_FAILED    = 41
-	HOME_SUCCESS     = 50
-	HOME_FAILED      = 51
-	GET_SESS_SUCCESS = 60
-	GET_SESS_FAILED  = 61
+	LOGIN_SUCCESS        = 10
+	LOGIN_FAILED         = 11
+	LOGIN_TOTP_REQUIRED  = 12 // password ok, second factor required
+	LOGIN_LIMITED        = 13 // credentials ok, but the user is at their session limit
+	EDIT_SUCCESS         = 20
+	EDIT_FAILED          = 21
+	EDIT_CONFLICT        = 22 // the profile was edited since the form was loaded, current values in Data
+	EDIT_INVALID         = 23 // field errors in Data, keyed by request data key
+	LOGOUT_SUCCESS       = 30
+	INSERT_SUCCESS       = 40
+	INSERT_FAILED        = 41
+	INSERT_INVALID       = 42 // field errors in Data, keyed by request data key
+	HOME_SUCCESS         = 50
+	HOME_FAILED          = 51
+	GET_SESS_SUCCESS     = 60
+	GET_SESS_FAILED      = 61
+	GET_SESS_TIMEOUT     = 62 // session passed its idle or absolute timeout
+	GET_SESS_EVICTED     = 63 // session was signed out to make room for a newer one
+	TOTP_ENROLL_SUCCESS  = 70
+	TOTP_ENROLL_FAILED   = 71
+	TOTP_CONFIRM_SUCCESS = 80
+	TOTP_CONFIRM_FAILED  = 81
+	CHANGE_PW_SUCCESS    = 90
+	CHANGE_PW_FAILED     = 91
+	CHANGE_PW_INVALID    = 92 // field errors in Data, keyed by request data key
+	LIST_SESS_SUCCESS    = 100
+	LIST_SESS_FAILED     = 101
+	REVOKE_SUCCESS       = 110
+	REVOKE_FAILED        = 111
+	KEYS_SUCCESS         = 120
+	KEYS_FAILED          = 121
+	IMPERSONATE_SUCCESS  = 130
+	IMPERSONATE_FAILED   = 131
+	DELETE_ACCT_SUCCESS  = 140
+	DELETE_ACCT_FAILED   = 141
+	EXPORT_ACCT_SUCCESS  = 150
+	EXPORT_ACCT_FAILED   = 151
+	AUDIT_SUCCESS        = 160 // events in List, newest first
+	AUDIT_FAILED         = 161
 )
 
 type Request struct {
@@ -40,4 +129,5 @@ type Response struct {
 	Code        int
 	Description string
 	Data        map[string]string
+	List        []map[string]string // records, for responses returning many
 }
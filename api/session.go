@@ -1,34 +1,120 @@
 package api
 
+import "time"
+
+// Version of the Claims layout written by this build. Sessions stored with an older
+// layout are upgraded when they are read.
+const CLAIMS_VERSION = 1
+
+// Authentication methods a session's user proved, as in RFC 8176
+const (
+	AUTH_METHOD_PASSWORD    = "pwd"
+	AUTH_METHOD_TOTP        = "otp"
+	AUTH_METHOD_RECOVERY    = "recovery"
+	AUTH_METHOD_REMEMBER    = "remember"    // resumed with a remember-me token, no credentials entered
+	AUTH_METHOD_IMPERSONATE = "impersonate" // opened by an admin, see Claims.Impersonator
+)
+
 type Session interface {
 	GetSessID() string
+	GetClaims() Claims
 	GetUsername() string
 	GetNickname() string
-	GetPwHash() string
 	GetProfilePic() string
+	GetDevice() Device
+	GetCreatedAt() time.Time
+	GetLastSeen() time.Time
+}
+
+// What a session asserts about its user. Never holds credentials.
+type Claims struct {
+	Version      int
+	UserId       string // users are keyed by username
+	Username     string
+	Nickname     string
+	ProfilePic   string
+	AuthTime     time.Time
+	AuthMethods  []string
+	Impersonator string // username of the admin acting as the user, "" for the user themselves
+}
+
+// Returns the claims for a user who just authenticated with the given methods
+func NewClaims(user *User, authTime time.Time, authMethods ...string) Claims {
+	return Claims{
+		Version:     CLAIMS_VERSION,
+		UserId:      user.Username,
+		Username:    user.Username,
+		Nickname:    user.Nickname,
+		ProfilePic:  user.ProfilePic,
+		AuthTime:    authTime,
+		AuthMethods: authMethods,
+	}
+}
+
+// The client a session was created from
+type Device struct {
+	UserAgent string
+	IP        string
 }
 
 type SessionStruct struct {
-	SessID string
-	User   *User
+	SessID    string
+	Claims    Claims
+	User      *User `msgpack:",omitempty"` // Deprecated: sessions stored before Claims, see Migrate
+	Device    Device
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// Upgrades a session stored before Claims, dropping the user record and its password hash.
+// Sessions stored before timeouts have no timestamps, and are taken to start now, or they
+// would all time out at once. Returns whether anything changed, in which case the session
+// should be stored again.
+func (s *SessionStruct) Migrate(now time.Time) bool {
+	if s.User == nil {
+		return false
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	if s.LastSeen.IsZero() {
+		s.LastSeen = now
+	}
+	if s.Claims.Version == 0 {
+		s.Claims = NewClaims(s.User, s.CreatedAt, AUTH_METHOD_PASSWORD)
+	}
+	s.User = nil
+	return true
 }
 
 func (s *SessionStruct) GetSessID() string {
 	return s.SessID
 }
 
+func (s *SessionStruct) GetClaims() Claims {
+	return s.Claims
+}
+
 func (s *SessionStruct) GetUsername() string {
-	return s.User.Username
+	return s.Claims.Username
 }
 
 func (s *SessionStruct) GetNickname() string {
-	return s.User.Nickname
+	return s.Claims.Nickname
 }
 
-func (s *SessionStruct) GetPwHash() string {
-	return s.User.PwHash
+func (s *SessionStruct) GetProfilePic() string {
+	return s.Claims.ProfilePic
 }
 
-func (s *SessionStruct) GetProfilePic() string {
-	return s.User.ProfilePic
+func (s *SessionStruct) GetDevice() Device {
+	return s.Device
+}
+
+func (s *SessionStruct) GetCreatedAt() time.Time {
+	return s.CreatedAt
+}
+
+func (s *SessionStruct) GetLastSeen() time.Time {
+	return s.LastSeen
 }
@@ -1,8 +1,16 @@
 package api
 
+import "time"
+
 type User struct {
-	Username   string
-	Nickname   string
-	PwHash     string
-	ProfilePic string
+	Username    string
+	Nickname    string
+	PwHash      string
+	ProfilePic  string
+	Version     int64 // of the profile, bumped by every edit
+	Email       string
+	Bio         string
+	Timezone    string    // IANA name, empty if the user hasn't picked one
+	CreatedAt   time.Time // zero if unknown
+	LastLoginAt time.Time // zero if never logged in
 }
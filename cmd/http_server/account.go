@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Data rendered by account.html
+type accountPage struct {
+	Desc string
+}
+
+// *********************************
+// *********** ACCOUNT *************
+// *********************************
+func (srv *HTTPServer) accountHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	if impersonatorFromContext(r.Context()) != "" {
+		w.WriteHeader(http.StatusForbidden)
+		renderTemplate(w, r, "account", accountPage{Desc: IMPERSONATING_DESC})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		desc := r.URL.Query().Get("desc")
+		renderTemplate(w, r, "account", accountPage{Desc: desc})
+	case http.MethodPost:
+		if r.FormValue("action") == "delete" {
+			srv.deleteAccount(w, r)
+		} else {
+			srv.exportAccount(w, r)
+		}
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+func (srv *HTTPServer) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	data[api.PwPlain] = r.FormValue("password")
+	req := api.Request{
+		Id:   rid,
+		Type: "DELETE_ACCOUNT",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Delete failed, please try again in a while")
+		http.Redirect(w, r, "/account"+qs, http.StatusSeeOther)
+		return
+	}
+	log.Info("Receive delete account response", res.Id, res.Code)
+	if res.Code != api.DELETE_ACCT_SUCCESS {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/account"+qs, http.StatusSeeOther)
+		return
+	}
+	srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+	srv.Cookies.Delete(w, REMEMBER_COOKIE)
+	qs := utils.CreateQueryString("Account deleted")
+	http.Redirect(w, r, "/login"+qs, http.StatusSeeOther)
+}
+
+// Sends everything stored about the user as a zip archive
+func (srv *HTTPServer) exportAccount(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "EXPORT_ACCOUNT",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Export failed, please try again in a while")
+		http.Redirect(w, r, "/account"+qs, http.StatusSeeOther)
+		return
+	}
+	log.Info("Receive export account response", res.Id, res.Code)
+	if res.Code != api.EXPORT_ACCT_SUCCESS {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/account"+qs, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+res.Data[api.Username]+`.zip"`)
+	if err := writeExport(w, res); err != nil {
+		// the headers are out, all that's left is to cut the archive short
+		log.Error(err)
+	}
+}
+
+// Writes the profile, the logins and the sessions as JSON files, with the profile picture
+func writeExport(w io.Writer, res api.Response) error {
+	logins := make([]map[string]string, 0)
+	sessions := make([]map[string]string, 0)
+	for _, row := range res.List {
+		kind := row[api.RecordKind]
+		delete(row, api.RecordKind)
+		switch kind {
+		case api.RECORD_LOGIN:
+			logins = append(logins, row)
+		case api.RECORD_SESSION:
+			sessions = append(sessions, row)
+		}
+	}
+
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", res.Data},
+		{"logins.json", logins},
+		{"sessions.json", sessions},
+	}
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.content); err != nil {
+			return err
+		}
+	}
+	if pic := res.Data[api.ProfilePic]; pic != "" {
+		if err := addFile(archive, filepath.Join("images", filepath.Base(pic))); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func addFile(archive *zip.Writer, path string) error {
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := archive.Create(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
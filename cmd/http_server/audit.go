@@ -0,0 +1,129 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// security events shown per page of /audit
+const AUDIT_PAGE_SIZE = 50
+
+// how /audit's date filters are written
+const AUDIT_DATE_FORMAT = "2006-01-02"
+
+// Data rendered by audit.html: the filter, as given, and a page of events. Older is the
+// query string of the next page, "" on the last one.
+type auditPage struct {
+	Desc     string
+	Username string
+	Type     string
+	Since    string
+	Until    string
+	Types    []string
+	Events   []auditRow
+	Older    string
+}
+
+type auditRow struct {
+	At        string
+	Type      string
+	Username  string
+	Actor     string
+	Reason    string
+	Detail    string
+	RequestId string
+	IP        string
+	UserAgent string
+}
+
+var eventTypes = []string{
+	api.EVENT_LOGIN_SUCCESS,
+	api.EVENT_LOGIN_FAILURE,
+	api.EVENT_LOGOUT,
+	api.EVENT_REGISTER,
+	api.EVENT_PROFILE_EDIT,
+	api.EVENT_SESSION_REVOKE,
+}
+
+// *******************************
+// *********** AUDIT *************
+// *******************************
+
+// Lets admins look through the security events, newest first
+func (srv *HTTPServer) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	page := auditPage{
+		Username: query.Get("username"),
+		Type:     query.Get("event"),
+		Since:    query.Get("since"),
+		Until:    query.Get("until"),
+		Types:    eventTypes,
+	}
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	data[api.Username] = page.Username
+	data[api.EventType] = page.Type
+	data[api.Before] = query.Get("before")
+	data[api.Limit] = strconv.Itoa(AUDIT_PAGE_SIZE)
+	// whole days in UTC, until the end of the last one
+	if since, err := time.Parse(AUDIT_DATE_FORMAT, page.Since); err == nil {
+		data[api.Since] = since.Format(time.RFC3339)
+	}
+	if until, err := time.Parse(AUDIT_DATE_FORMAT, page.Until); err == nil {
+		data[api.Until] = until.AddDate(0, 0, 1).Format(time.RFC3339)
+	}
+	req := api.Request{
+		Id:   r.Header.Get(api.RequestIdHeader),
+		Type: "AUDIT_EVENTS",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		page.Desc = "Could not load the security events, please try again in a while"
+		renderTemplate(w, r, "audit", page)
+		return
+	}
+	log.Info("Receive audit response ", res.Id, " ", res.Code)
+	if res.Code != api.AUDIT_SUCCESS {
+		page.Desc = res.Description
+		renderTemplate(w, r, "audit", page)
+		return
+	}
+	for _, row := range res.List {
+		page.Events = append(page.Events, auditRow{
+			At:        row[api.EventTime],
+			Type:      row[api.EventType],
+			Username:  row[api.Username],
+			Actor:     row[api.Actor],
+			Reason:    row[api.Reason],
+			Detail:    row[api.Detail],
+			RequestId: row[api.RequestId],
+			IP:        row[api.ClientIP],
+			UserAgent: row[api.UserAgent],
+		})
+	}
+	if len(res.List) == AUDIT_PAGE_SIZE {
+		older := url.Values{}
+		for _, key := range []string{"username", "event", "since", "until"} {
+			if value := query.Get(key); value != "" {
+				older.Set(key, value)
+			}
+		}
+		older.Set("before", res.List[len(res.List)-1][api.EventId])
+		page.Older = "?" + older.Encode()
+	}
+	renderTemplate(w, r, "audit", page)
+}
@@ -3,13 +3,29 @@ package main
 import (
 	"errors"
 	"example.com/kendrick/api"
-	"example.com/kendrick/internal/tcp_server/auth"
 	"example.com/kendrick/internal/utils"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
 )
 
+// Data rendered by edit.html: the profile as it is now, and its version, which the form
+// sends back so that the edit can't overwrite a newer one. Errors holds the message of
+// each invalid field, keyed like the request.
+type editPage struct {
+	Desc       string
+	Nickname   string
+	ProfilePic string
+	Email      string
+	Bio        string
+	Timezone   string
+	Version    string
+	Errors     map[string]string
+}
+
+// Form fields sent as they are, if the form has them
+var editFields = []string{api.Nickname, api.Email, api.Bio, api.Timezone}
+
 // ******************************
 // *********** EDIT *************
 // ******************************
@@ -18,8 +34,7 @@ func (srv *HTTPServer) editHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		// ensure logged in
 		if _, ok := fromContext(r.Context()); ok {
-			desc := r.URL.Query().Get("desc")
-			renderTemplate(w, "edit", desc)
+			srv.showProfile(w, r)
 			return
 		}
 		http.Redirect(w, r, "/login", http.StatusUnauthorized)
@@ -30,8 +45,34 @@ func (srv *HTTPServer) editHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Renders the edit form filled in with the current profile, which the session may not have
+func (srv *HTTPServer) showProfile(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "HOME",
+		Data: data,
+	}
+	page := editPage{Desc: r.URL.Query().Get("desc")}
+	res, err := srv.sendRequest(req)
+	if err != nil || res.Code != api.HOME_SUCCESS {
+		page.Desc = "Could not load your profile, please try again in a while"
+		renderTemplate(w, r, "edit", page)
+		return
+	}
+	page.Nickname = res.Data[api.Nickname]
+	page.ProfilePic = res.Data[api.ProfilePic]
+	page.Email = res.Data[api.Email]
+	page.Bio = res.Data[api.Bio]
+	page.Timezone = res.Data[api.Timezone]
+	page.Version = res.Data[api.Version]
+	renderTemplate(w, r, "edit", page)
+}
+
 func (srv *HTTPServer) edit(w http.ResponseWriter, r *http.Request) {
-	req, err := createEditReq(r)
+	req, err := createEditReq(r, srv.getSid(r))
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, "/edit"+utils.CreateQueryString(err.Error()), http.StatusSeeOther)
@@ -73,44 +114,50 @@ func (srv *HTTPServer) edit(w http.ResponseWriter, r *http.Request) {
 	log.Info("Receive edit response", res)
 
 	// PROCESS RESPONSE
-	processEditRes(w, r, res)
+	srv.processEditRes(w, r, req, res)
 	log.WithField(api.RequestId, req.Id).Info("Connection closed")
 }
 
-func createEditReq(r *http.Request) (api.Request, error) {
-	// retrieve form values
-	nickname := r.FormValue("nickname")
-	file, header, err := r.FormFile("pic")
-	if err != nil {
-		log.Error(err)
-	}
-	// enforce max size
-	if header.Size > IMG_MAXSIZE {
-		err := errors.New("Image too large: maximum " + strconv.Itoa(IMG_MAXSIZE) + " bytes.")
-		return api.Request{}, err
-	}
-	defer file.Close()
-
-	// store image persistently
+// Only the fields the form sent are edited, and the picture only if one was chosen
+func createEditReq(r *http.Request, sid string) (api.Request, error) {
 	user, ok := fromContext(r.Context())
 	if !ok {
 		return api.Request{}, errors.New("CreateEditReq: No username")
 	}
-	imgPath := utils.ImageUpload(file, user.Username)
-	sidCookie, err := r.Cookie(auth.SESS_COOKIE_NAME)
-	if err != nil {
+	// also parses the rest of the form
+	file, header, err := r.FormFile("pic")
+	if err != nil && err != http.ErrMissingFile {
 		log.Error(err)
-		return api.Request{}, err
+		return api.Request{}, errors.New("Could not read the form, please try again")
 	}
 
 	// create return data
 	rid := r.Header.Get(api.RequestIdHeader)
 	ret := make(map[string]string)
-	ret[api.Nickname] = nickname
-	ret[api.ProfilePic] = imgPath
-	ret[api.SessionId] = sidCookie.Value
-	ret[api.Username] = user.Username
-	ret[api.PwHash] = user.PwHash
+	for _, key := range editFields {
+		if values, ok := r.PostForm[key]; ok {
+			ret[key] = values[0]
+		}
+	}
+	if file != nil {
+		defer file.Close()
+		// enforce max size
+		if header.Size > IMG_MAXSIZE {
+			err := errors.New("Image too large: maximum " + strconv.Itoa(IMG_MAXSIZE) + " bytes.")
+			return api.Request{}, err
+		}
+		// store image persistently
+		pic, err := utils.ImageUpload(file, user.Username)
+		if err != nil {
+			log.Error(err)
+			return api.Request{}, errors.New("Could not save the picture.")
+		}
+		ret[api.ProfilePic] = pic
+	}
+	ret[api.SessionId] = sid
+	ret[api.Version] = r.FormValue("version")
+	ret[api.UserAgent] = r.UserAgent()
+	ret[api.ClientIP] = clientIP(r)
 	req := api.Request{
 		Id:   rid,
 		Type: "EDIT",
@@ -119,11 +166,31 @@ func createEditReq(r *http.Request) (api.Request, error) {
 	return req, nil
 }
 
-func processEditRes(w http.ResponseWriter, r *http.Request, res api.Response) {
+func (srv *HTTPServer) processEditRes(w http.ResponseWriter, r *http.Request, req api.Request, res api.Response) {
 	switch res.Code {
 	case api.EDIT_SUCCESS:
+		// token sessions get a new id whenever their claims change
+		if sid := res.Data[api.SessionId]; sid != "" {
+			srv.setSessionCookie(w, sid)
+		}
 		qs := utils.CreateQueryString("Edit Success!")
 		http.Redirect(w, r, "/edit"+qs, http.StatusSeeOther)
+	case api.EDIT_CONFLICT:
+		// the form is shown again with the profile as it is now
+		qs := utils.CreateQueryString("Your profile was changed elsewhere, here it is now. Edit again?")
+		http.Redirect(w, r, "/edit"+qs, http.StatusSeeOther)
+	case api.EDIT_INVALID:
+		// the form is shown again as it was sent, so that nothing typed is lost
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		renderTemplate(w, r, "edit", editPage{
+			Desc:     res.Description,
+			Nickname: req.Data[api.Nickname],
+			Email:    req.Data[api.Email],
+			Bio:      req.Data[api.Bio],
+			Timezone: req.Data[api.Timezone],
+			Version:  req.Data[api.Version],
+			Errors:   res.Data,
+		})
 	case api.EDIT_FAILED:
 		qs := utils.CreateQueryString("Edit Failed...")
 		http.Redirect(w, r, "/edit"+qs, http.StatusSeeOther)
@@ -1,11 +1,64 @@
 package main
 
-import "net/http"
+import (
+	"example.com/kendrick/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// how home.html shows a time
+const HOME_TIME_FORMAT = "2 Jan 2006 15:04 MST"
+
+// Data rendered by home.html. Times are shown in the user's time zone if they set one.
+type homePage struct {
+	Username    string
+	Nickname    string
+	ProfilePic  string
+	Email       string
+	Bio         string
+	Timezone    string
+	MemberSince string
+	LastLogin   string
+}
 
 func (srv *HTTPServer) homeHandler(w http.ResponseWriter, r *http.Request) {
-	if user, ok := fromContext(r.Context()); ok {
-		renderTemplate(w, "home", user)
+	user, ok := fromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	// the session only has the nickname and picture, the rest is read from the database
+	page := homePage{Username: user.Username, Nickname: user.Nickname, ProfilePic: user.ProfilePic}
+	res, err := srv.sendRequest(api.Request{
+		Id:   r.Header.Get(api.RequestIdHeader),
+		Type: "HOME",
+		Data: map[string]string{api.SessionId: srv.getSid(r)},
+	})
+	if err != nil || res.Code != api.HOME_SUCCESS {
+		log.WithField(api.RequestId, r.Header.Get(api.RequestIdHeader)).Error("Could not load profile, showing the session's")
+		renderTemplate(w, r, "home", page)
 		return
 	}
-	http.Redirect(w, r, "/login", http.StatusUnauthorized)
+	page.Nickname = res.Data[api.Nickname]
+	page.ProfilePic = res.Data[api.ProfilePic]
+	page.Email = res.Data[api.Email]
+	page.Bio = res.Data[api.Bio]
+	page.Timezone = res.Data[api.Timezone]
+	loc, err := time.LoadLocation(page.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	page.MemberSince = localTime(res.Data[api.CreatedAt], loc)
+	page.LastLogin = localTime(res.Data[api.LastLogin], loc)
+	renderTemplate(w, r, "home", page)
+}
+
+// Formats an RFC 3339 time in loc, or returns "" if there is none
+func localTime(rfc3339 string, loc *time.Location) string {
+	t, err := time.Parse(time.RFC3339, rfc3339)
+	if err != nil {
+		return ""
+	}
+	return t.In(loc).Format(HOME_TIME_FORMAT)
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Holds the admin's own session while they are logged in as another user
+const ADMIN_SESSION_COOKIE = "admin_session"
+
+const IMPERSONATING_DESC = "Not available while logged in as another user"
+
+// *************************************
+// *********** IMPERSONATE *************
+// *************************************
+func (srv *HTTPServer) impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		desc := r.URL.Query().Get("desc")
+		renderTemplate(w, r, "impersonate", desc)
+	case http.MethodPost:
+		srv.impersonate(w, r)
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+func (srv *HTTPServer) impersonate(w http.ResponseWriter, r *http.Request) {
+	sid := srv.getSid(r)
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = sid
+	data[api.Username] = r.FormValue("username")
+	data[api.UserAgent] = r.UserAgent()
+	data[api.ClientIP] = clientIP(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "IMPERSONATE",
+		Data: data,
+	}
+	log.Info("Create impersonate request ", rid)
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Logging in as user failed, please try again in a while")
+		http.Redirect(w, r, "/impersonate"+qs, http.StatusSeeOther)
+		return
+	}
+	if res.Code != api.IMPERSONATE_SUCCESS {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/impersonate"+qs, http.StatusSeeOther)
+		return
+	}
+	srv.Cookies.Set(w, ADMIN_SESSION_COOKIE, sid, COOKIE_TIMEOUT)
+	srv.setSessionCookie(w, res.Data[api.SessionId])
+	http.Redirect(w, r, "/home", http.StatusSeeOther)
+}
+
+func (srv *HTTPServer) stopImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !srv.stopImpersonation(w, r) {
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+	}
+}
+
+// Ends the impersonated session and puts the admin's own session back, then sends the
+// client home. Returns false, doing nothing, if the client isn't impersonating anyone.
+func (srv *HTTPServer) stopImpersonation(w http.ResponseWriter, r *http.Request) bool {
+	adminSid, err := srv.Cookies.Get(r, ADMIN_SESSION_COOKIE)
+	if err != nil {
+		return false
+	}
+	if sid := srv.getSid(r); sid != "" {
+		// without the remember-me token, which is the admin's
+		if _, err := srv.sendRequest(createLogoutReq(r, sid, "")); err != nil {
+			log.Error(err)
+		}
+	}
+	srv.Cookies.Delete(w, ADMIN_SESSION_COOKIE)
+	srv.setSessionCookie(w, adminSid)
+	http.Redirect(w, r, "/home", http.StatusSeeOther)
+	return true
+}
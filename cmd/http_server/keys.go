@@ -0,0 +1,39 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// how long clients may cache the key set; rotated-in keys must be published at least this long before use
+const JWKS_MAX_AGE = "300"
+
+// ******************************
+// *********** KEYS *************
+// ******************************
+func (srv *HTTPServer) keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := api.Request{
+		Id:   r.Header.Get(api.RequestIdHeader),
+		Type: "GET_KEYS",
+		Data: nil,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		http.Error(w, "Key set unavailable, please try again in a while", http.StatusServiceUnavailable)
+		return
+	}
+	if res.Code != api.KEYS_SUCCESS {
+		log.Debug("No published keys: ", res.Description)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+JWKS_MAX_AGE)
+	w.Write([]byte(res.Data[api.KeySet]))
+}
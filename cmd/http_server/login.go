@@ -6,7 +6,6 @@ import (
 	"example.com/kendrick/internal/utils"
 	log "github.com/sirupsen/logrus"
 	"net/http"
-	"time"
 )
 
 // *******************************
@@ -18,7 +17,7 @@ func (srv *HTTPServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 		srv.MetricMgr.IncGetLoginCount()
 		log.Info("monitoring: increase GET login count")
 		desc := r.URL.Query().Get("desc")
-		renderTemplate(w, "login", desc)
+		renderTemplate(w, r, "login", desc)
 	case http.MethodPost:
 		srv.MetricMgr.IncPostLoginCount()
 		log.Info("monitoring: increase POST login count")
@@ -31,6 +30,7 @@ func (srv *HTTPServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 // Main handler called when logging in
 func (srv *HTTPServer) login(w http.ResponseWriter, r *http.Request) {
 	req := createLoginReq(r)
+	req.Data[api.SessionId] = srv.getSid(r) // dropped by the TCP server, see createSessionRes
 	log.Info("Create login request", req)
 	conn, err := srv.getTcpConnPooled()
 	if err != nil {
@@ -67,7 +67,7 @@ func (srv *HTTPServer) login(w http.ResponseWriter, r *http.Request) {
 	log.Info("Receive login response", res)
 
 	// PROCESS RESPONSE
-	processLoginRes(w, r, res)
+	srv.processLoginRes(w, r, res)
 	log.WithField(api.RequestId, req.Id).Info("Connection closed")
 }
 
@@ -79,6 +79,9 @@ func createLoginReq(r *http.Request) api.Request {
 	ret := make(map[string]string)
 	ret[api.Username] = username
 	ret[api.PwPlain] = password
+	ret[api.Remember] = r.FormValue("remember")
+	ret[api.UserAgent] = r.UserAgent()
+	ret[api.ClientIP] = clientIP(r)
 	req := api.Request{
 		Id:   rid,
 		Type: "LOGIN",
@@ -92,7 +95,7 @@ func createLoginReq(r *http.Request) api.Request {
 	return req
 }
 
-func processLoginRes(w http.ResponseWriter, r *http.Request, res api.Response) {
+func (srv *HTTPServer) processLoginRes(w http.ResponseWriter, r *http.Request, res api.Response) {
 	logger := log.WithFields(log.Fields{
 		api.RequestId: res.Id,
 		api.ResCode:   res.Code,
@@ -104,18 +107,19 @@ func processLoginRes(w http.ResponseWriter, r *http.Request, res api.Response) {
 		http.Redirect(w, r, "/register"+qs, http.StatusSeeOther)
 		return
 	}
-	sid := res.Data[api.SessionId]
-	username := res.Data[api.Username]
-	http.SetCookie(w, &http.Cookie{
-		Name:    auth.SESS_COOKIE_NAME,
-		Value:   sid,
-		Expires: time.Now().Add(COOKIE_TIMEOUT),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:    auth.USERNAME_COOKIE_NAME,
-		Value:   username,
-		Expires: time.Now().Add(COOKIE_TIMEOUT),
-	})
+	if res.Code == api.LOGIN_LIMITED {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/login"+qs, http.StatusSeeOther)
+		return
+	}
+	if res.Code == api.LOGIN_TOTP_REQUIRED {
+		srv.Cookies.Set(w, PENDING_COOKIE, res.Data[api.PendingToken], auth.PENDING_LOGIN_TTL)
+		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+		logger.Debug("Second factor required")
+		return
+	}
+	srv.setSessionCookie(w, res.Data[api.SessionId])
+	srv.setRememberCookie(w, res)
 	http.Redirect(w, r, "/home", http.StatusSeeOther)
 	logger.Debug("Processed login response")
 	return
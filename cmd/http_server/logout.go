@@ -12,15 +12,25 @@ import (
 // *********** LOGOUT *************
 // ********************************
 func (srv *HTTPServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	if !isLoggedIn(getSid(r)) {
+	// logging out changes state, so it must not be reachable by a plain link
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isLoggedIn(srv.getSid(r)) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	// logging out of an impersonated session leaves the admin logged in as themselves
+	if srv.stopImpersonation(w, r) {
+		return
+	}
 	srv.logout(w, r)
 }
 
 func (srv *HTTPServer) logout(w http.ResponseWriter, r *http.Request) {
-	req := createLogoutReq(r)
+	req := createLogoutReq(r, srv.getSid(r), srv.getRememberToken(r))
 	log.Info("Create logout request", req)
 	conn, err := srv.getTcpConnPooled()
 	if err != nil {
@@ -57,15 +67,17 @@ func (srv *HTTPServer) logout(w http.ResponseWriter, r *http.Request) {
 	log.Info("Receive logout response", res)
 
 	// PROCESS RESPONSE
-	processLogoutRes(w, r, res)
+	srv.processLogoutRes(w, r, res)
 	log.WithField(api.RequestId, req.Id).Info("Connection closed")
 }
 
-func createLogoutReq(r *http.Request) api.Request {
-	c, _ := r.Cookie(auth.SESS_COOKIE_NAME)
+func createLogoutReq(r *http.Request, sid string, rememberToken string) api.Request {
 	rid := r.Header.Get(api.RequestIdHeader)
 	ret := make(map[string]string)
-	ret[api.SessionId] = c.Value
+	ret[api.SessionId] = sid
+	ret[api.RememberToken] = rememberToken
+	ret[api.UserAgent] = r.UserAgent()
+	ret[api.ClientIP] = clientIP(r)
 	req := api.Request{
 		Id:   rid,
 		Type: "LOGOUT",
@@ -74,17 +86,12 @@ func createLogoutReq(r *http.Request) api.Request {
 	return req
 }
 
-func processLogoutRes(w http.ResponseWriter, r *http.Request, res api.Response) {
+func (srv *HTTPServer) processLogoutRes(w http.ResponseWriter, r *http.Request, res api.Response) {
 	switch res.Code {
 	case api.LOGOUT_SUCCESS:
 		// delete cookie
-		c, _ := r.Cookie(auth.SESS_COOKIE_NAME)
-		c = &http.Cookie{
-			Name:   auth.SESS_COOKIE_NAME,
-			Value:  "",
-			MaxAge: -1,
-		}
-		http.SetCookie(w, c)
+		srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+		srv.Cookies.Delete(w, REMEMBER_COOKIE)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -20,9 +21,12 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"example.com/kendrick/api"
+	"example.com/kendrick/internal/http_server/cookie"
+	"example.com/kendrick/internal/http_server/csrf"
 	"example.com/kendrick/internal/http_server/metrics"
 	"example.com/kendrick/internal/http_server/pool"
 	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/utils"
 )
 
 var (
@@ -31,25 +35,47 @@ var (
 		"",
 		"Logrus log output, NONE/FILE/STDERR/ALL, default: STDERR",
 	)
-	logLevel    = flag.String("logLevel", "", "Logrus log level, DEBUG/ERROR/INFO, default: INFO")
-	CONTEXT_KEY = uuid.NewV4()
+	logLevel   = flag.String("logLevel", "", "Logrus log level, DEBUG/ERROR/INFO, default: INFO")
+	env        = flag.String("env", cookie.ENV_DEV, "Deployment environment, dev/prod. prod only sends cookies over HTTPS")
+	cookieKeys = flag.String(
+		"cookieKeys",
+		filepath.Join(utils.RootDir(), "../../configs/cookieKeys.txt"),
+		"File of id:secret cookie signing keys, active key first",
+	)
+	CONTEXT_KEY              = uuid.NewV4()
+	IMPERSONATOR_CONTEXT_KEY = uuid.NewV4()
 )
 
 const (
 	COOKIE_TIMEOUT = time.Hour * 24
+	PENDING_COOKIE = "pending_login"
 	IMG_MAXSIZE    = 1 << 12 // 2^12
 )
 
+// No longer set, but still cleared from browsers that have it
+const LEGACY_USERNAME_COOKIE = "username"
+
 type HTTPServer struct {
 	Server    http.Server
 	TcpPool   pool.Pool
 	MetricMgr metrics.MetricManager
+	Cookies   *cookie.Codec
 	Hostname  string
 	Port      string
 }
 
 var templates *template.Template
 
+var ERR_SESSION_EXPIRED = errors.New("Session has expired")
+var ERR_SESSION_EVICTED = errors.New("Session was signed out by a newer login")
+
+// Wraps the data of every rendered template
+type page struct {
+	CSRF         string // token for hidden csrf_token form fields
+	Impersonator string // admin logged in as the user, if any
+	Data         interface{}
+}
+
 // ********************************
 // *********** COMMON *************
 // ********************************
@@ -57,18 +83,40 @@ func isLoggedIn(sid string) bool {
 	return sid != ""
 }
 
-// Gets the value of the session cookie. Returns "" if not present.
-func getSid(req *http.Request) string {
-	cookie, err := req.Cookie(auth.SESS_COOKIE_NAME)
-	if err != nil && errors.Is(err, http.ErrNoCookie) {
+// Gets the verified value of the session cookie. Returns "" if not present or forged.
+func (srv *HTTPServer) getSid(req *http.Request) string {
+	sid, err := srv.Cookies.Get(req, auth.SESS_COOKIE_NAME)
+	if err != nil {
+		if !errors.Is(err, http.ErrNoCookie) {
+			log.WithField(api.RequestId, req.Header.Get(api.RequestIdHeader)).Warn("Rejected session cookie: ", err)
+		}
 		return ""
 	}
-	return cookie.Value
+	return sid
+}
+
+// Returns the IP address of the client, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
+// Points the client at a (new) session
+func (srv *HTTPServer) setSessionCookie(w http.ResponseWriter, sid string) {
+	srv.Cookies.Set(w, auth.SESS_COOKIE_NAME, sid, COOKIE_TIMEOUT)
+	srv.Cookies.Delete(w, LEGACY_USERNAME_COOKIE)
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data interface{}) {
 	file := fmt.Sprintf("%s.html", tmpl)
-	err := templates.ExecuteTemplate(w, file, data)
+	err := templates.ExecuteTemplate(w, file, page{
+		CSRF:         csrf.Token(r.Context()),
+		Impersonator: impersonatorFromContext(r.Context()),
+		Data:         data,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -109,7 +157,8 @@ func (srv *HTTPServer) getTcpConn() (net.Conn, error) {
 	return conn, err
 }
 
-func (srv *HTTPServer) getSession(sid string, rid string) (*api.User, error) {
+// Returns the user of a session, and the admin logged in as them if it is impersonated
+func (srv *HTTPServer) getSession(sid string, rid string) (*api.User, string, error) {
 	// construct request
 	data := make(map[string]string)
 	data[api.SessionId] = sid
@@ -122,7 +171,7 @@ func (srv *HTTPServer) getSession(sid string, rid string) (*api.User, error) {
 	conn, err := srv.getTcpConnPooled()
 	if err != nil {
 		log.Error(err)
-		return nil, err
+		return nil, "", err
 	}
 	defer srv.TcpPool.Put(&conn)
 
@@ -130,7 +179,7 @@ func (srv *HTTPServer) getSession(sid string, rid string) (*api.User, error) {
 	err = conn.Enc.Encode(req)
 	if err != nil {
 		srv.handleError(req.Id, &conn, err)
-		return nil, err
+		return nil, "", err
 	}
 
 	// receive response
@@ -138,16 +187,50 @@ func (srv *HTTPServer) getSession(sid string, rid string) (*api.User, error) {
 	err = conn.Dec.Decode(&res)
 	if err != nil {
 		srv.handleError(req.Id, &conn, err)
-		return nil, err
+		return nil, "", err
 	}
 
 	// process response
+	switch res.Code {
+	case api.GET_SESS_SUCCESS:
+	case api.GET_SESS_TIMEOUT:
+		return nil, "", ERR_SESSION_EXPIRED
+	case api.GET_SESS_EVICTED:
+		return nil, "", ERR_SESSION_EVICTED
+	default:
+		return nil, "", errors.New(res.Description)
+	}
 	return &api.User{
 		Username:   res.Data[api.Username],
 		Nickname:   res.Data[api.Nickname],
-		PwHash:     res.Data[api.PwHash],
 		ProfilePic: res.Data[api.ProfilePic],
-	}, nil
+	}, res.Data[api.Impersonator], nil
+}
+
+// Sends a request over a pooled TCP connection and waits for its response
+func (srv *HTTPServer) sendRequest(req api.Request) (api.Response, error) {
+	conn, err := srv.getTcpConnPooled()
+	if err != nil {
+		srv.handleError(req.Id, &conn, err)
+		return api.Response{}, err
+	}
+	defer srv.TcpPool.Put(&conn)
+
+	log.Debug("Sending request", req)
+	err = conn.Enc.Encode(req)
+	if err != nil {
+		srv.handleError(req.Id, &conn, err)
+		return api.Response{}, err
+	}
+
+	var res api.Response
+	err = conn.Dec.Decode(&res)
+	if err != nil {
+		srv.handleError(req.Id, &conn, err)
+		return api.Response{}, err
+	}
+	log.Debug("Received response", res)
+	return res, nil
 }
 
 func initLogger(logLevel string, logOutput string) {
@@ -217,28 +300,78 @@ func (srv *HTTPServer) withRequestId(handler http.HandlerFunc) http.HandlerFunc
 	}
 }
 
+// Rejects state-changing requests without a valid CSRF token, and hands every request a token
+// for the forms it renders
+func (srv *HTTPServer) withCSRF(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = csrf.EnsureToken(w, r)
+		if csrf.IsStateChanging(r.Method) {
+			if err := csrf.Verify(r); err != nil {
+				log.WithFields(log.Fields{
+					api.RequestId: r.Header.Get(api.RequestIdHeader),
+					"method":      r.Method,
+					"path":        r.URL.Path,
+					"remote":      r.RemoteAddr,
+					"origin":      r.Header.Get("Origin"),
+				}).Warn("CSRF check rejected request: ", err)
+				http.Error(w, "Forbidden: invalid CSRF token, please reload the page", http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
 func (srv *HTTPServer) withSessValidation(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		rid := r.Header.Get(api.RequestIdHeader)
 		logger := log.WithFields(log.Fields{api.RequestId: rid})
 		logger.Info("Start session validation")
-		c, err := r.Cookie(auth.SESS_COOKIE_NAME)
+		sid, err := srv.Cookies.Get(r, auth.SESS_COOKIE_NAME)
 		if err != nil {
+			if err != http.ErrNoCookie {
+				logger.Warn("Rejected session cookie: ", err)
+				srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+			}
+			if srv.resumeSession(w, r) {
+				return
+			}
 			if err == http.ErrNoCookie {
 				w.WriteHeader(http.StatusUnauthorized)
-				renderTemplate(w, "login", "Unauthorised, please login")
+				renderTemplate(w, r, "login", "Unauthorised, please login")
 				return
 			}
-			log.Error(err)
 			w.WriteHeader(http.StatusBadRequest)
-			renderTemplate(w, "login", nil)
+			renderTemplate(w, r, "login", nil)
 			return
 		}
 
-		sid := c.Value
 		logger.Debug("Getting user of session ", sid)
-		user, err := srv.getSession(sid, rid)
-
+		user, impersonator, err := srv.getSession(sid, rid)
+
+		// an evicted session is not resumed, that would just sign out the
+		// newer login in turn
+		if err == ERR_SESSION_EVICTED {
+			logger.Info("Session evicted")
+			srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+			w.WriteHeader(http.StatusUnauthorized)
+			renderTemplate(w, r, "login", "You were signed out because you logged in elsewhere")
+			return
+		}
+		// an impersonation that ran out hands the admin their own session back
+		if err == ERR_SESSION_EXPIRED && srv.stopImpersonation(w, r) {
+			return
+		}
+		if err != nil && srv.resumeSession(w, r) {
+			return
+		}
+		if err == ERR_SESSION_EXPIRED {
+			logger.Info("Session expired")
+			srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+			w.WriteHeader(http.StatusUnauthorized)
+			renderTemplate(w, r, "login", "Your session has expired, please login again")
+			return
+		}
 		if err != nil {
 			// no such session, serve as usual
 			log.Error(err)
@@ -247,7 +380,11 @@ func (srv *HTTPServer) withSessValidation(handler http.HandlerFunc) http.Handler
 		} else {
 			// server with user
 			logger.Info("Serving with session", user)
-			handler.ServeHTTP(w, r.WithContext(newContext(r.Context(), user)))
+			ctx := newContext(r.Context(), user)
+			if impersonator != "" {
+				ctx = context.WithValue(ctx, IMPERSONATOR_CONTEXT_KEY, impersonator)
+			}
+			handler.ServeHTTP(w, r.WithContext(ctx))
 		}
 	}
 }
@@ -263,6 +400,12 @@ func fromContext(ctx context.Context) (*api.User, bool) {
 	return u, ok
 }
 
+// returns the admin logged in as the user of ctx, or "" if the user is themselves
+func impersonatorFromContext(ctx context.Context) string {
+	impersonator, _ := ctx.Value(IMPERSONATOR_CONTEXT_KEY).(string)
+	return impersonator
+}
+
 func (srv *HTTPServer) Start() {
 	templates = template.Must(template.ParseGlob("templates/*.html"))
 	initLogger(*logLevel, *logOutput)
@@ -274,11 +417,20 @@ func (srv *HTTPServer) Start() {
 
 	// have the server listen on required routes
 	http.HandleFunc("/", srv.withRequestId(srv.rootHandler))
-	http.HandleFunc("/login", srv.withRequestId(srv.loginHandler))
-	http.HandleFunc("/logout", srv.withRequestId(srv.logoutHandler))
-	http.HandleFunc("/home", srv.withSessValidation(srv.withRequestId(srv.homeHandler)))
-	http.HandleFunc("/edit", srv.withSessValidation(srv.withRequestId(srv.editHandler)))
-	http.HandleFunc("/register", srv.withRequestId(srv.registerHandler))
+	http.HandleFunc("/login", srv.withRequestId(srv.withCSRF(srv.loginHandler)))
+	http.HandleFunc("/logout", srv.withRequestId(srv.withCSRF(srv.logoutHandler)))
+	http.HandleFunc("/login/totp", srv.withRequestId(srv.withCSRF(srv.totpLoginHandler)))
+	http.HandleFunc("/home", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.homeHandler))))
+	http.HandleFunc("/edit", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.editHandler))))
+	http.HandleFunc("/totp", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.totpHandler))))
+	http.HandleFunc("/password", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.passwordHandler))))
+	http.HandleFunc("/sessions", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.sessionsHandler))))
+	http.HandleFunc("/account", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.accountHandler))))
+	http.HandleFunc("/impersonate", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.impersonateHandler))))
+	http.HandleFunc("/audit", srv.withRequestId(srv.withCSRF(srv.withSessValidation(srv.auditHandler))))
+	http.HandleFunc("/impersonate/stop", srv.withRequestId(srv.withCSRF(srv.stopImpersonationHandler)))
+	http.HandleFunc("/register", srv.withRequestId(srv.withCSRF(srv.registerHandler)))
+	http.HandleFunc("/.well-known/jwks.json", srv.withRequestId(srv.keysHandler))
 	http.Handle("/images/", http.StripPrefix("/images", http.FileServer(http.Dir("./images"))))
 	server := &http.Server{
 		Addr:         ":" + srv.Port,
@@ -295,16 +447,40 @@ func (srv *HTTPServer) Stop() {
 	log.Info("HTTP server stopped.")
 }
 
+// Builds the cookie signer from the key file, falling back to a throwaway key in development
+func initCookies(env string, keyFile string) *cookie.Codec {
+	options, err := cookie.OptionsFor(env)
+	if err != nil {
+		log.Fatalln(err, env)
+	}
+	keys, err := cookie.LoadKeys(keyFile)
+	if err != nil {
+		if env != cookie.ENV_DEV {
+			log.Fatalln(err)
+		}
+		log.Warn("No cookie keys, sessions will not survive a restart: ", err)
+		keys = []cookie.Key{cookie.RandomKey()}
+	}
+	codec, err := cookie.NewCodec(keys, options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	codec.Harden(&csrf.CookieTemplate)
+	return codec
+}
+
 func main() {
 	flag.Parse()
 	log.Info("LOGLEVEL: " + *logLevel)
 	log.Info("LOGOUTPUT: " + *logOutput)
+	log.Info("ENV: " + *env)
 
 	server := HTTPServer{
 		Hostname:  "127.0.0.1",
 		Port:      "8080",
 		TcpPool:   initPool(),
 		MetricMgr: metrics.NewMetricManager(),
+		Cookies:   initCookies(*env, *cookieKeys),
 	}
 
 	defer server.Stop()
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Data rendered by password.html. Errors are keyed by form field.
+type passwordPage struct {
+	Desc   string
+	Errors map[string]string
+}
+
+// *****************************************
+// *********** CHANGE PASSWORD *************
+// *****************************************
+func (srv *HTTPServer) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	if impersonatorFromContext(r.Context()) != "" {
+		w.WriteHeader(http.StatusForbidden)
+		renderTemplate(w, r, "password", passwordPage{Desc: IMPERSONATING_DESC})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		desc := r.URL.Query().Get("desc")
+		renderTemplate(w, r, "password", passwordPage{Desc: desc})
+	case http.MethodPost:
+		srv.changePassword(w, r)
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+func (srv *HTTPServer) changePassword(w http.ResponseWriter, r *http.Request) {
+	req := createPwChangeReq(r, srv.getSid(r))
+	log.Info("Create change password request ", req.Id)
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Change password failed, please try again in a while")
+		http.Redirect(w, r, "/password"+qs, http.StatusSeeOther)
+		return
+	}
+	log.Info("Receive change password response", res.Id, res.Code)
+	srv.processPwChangeRes(w, r, res)
+}
+
+func createPwChangeReq(r *http.Request, sid string) api.Request {
+	rid := r.Header.Get(api.RequestIdHeader)
+	ret := make(map[string]string)
+	ret[api.SessionId] = sid
+	ret[api.PwPlain] = r.FormValue("password")
+	ret[api.NewPw] = r.FormValue("newpassword")
+	return api.Request{
+		Id:   rid,
+		Type: "CHANGE_PASSWORD",
+		Data: ret,
+	}
+}
+
+func (srv *HTTPServer) processPwChangeRes(w http.ResponseWriter, r *http.Request, res api.Response) {
+	switch res.Code {
+	case api.CHANGE_PW_SUCCESS:
+		// the TCP server rotates the session id after a password change
+		if sid := res.Data[api.SessionId]; sid != "" {
+			srv.setSessionCookie(w, sid)
+		}
+		qs := utils.CreateQueryString("Password changed!")
+		http.Redirect(w, r, "/password"+qs, http.StatusSeeOther)
+	case api.CHANGE_PW_INVALID:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		renderTemplate(w, r, "password", passwordPage{Desc: res.Description, Errors: res.Data})
+	default:
+		qs := utils.CreateQueryString("Change password failed...")
+		http.Redirect(w, r, "/password"+qs, http.StatusSeeOther)
+	}
+}
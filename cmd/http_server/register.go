@@ -2,12 +2,19 @@ package main
 
 import (
 	"example.com/kendrick/api"
-	"example.com/kendrick/internal/tcp_server/security"
 	"example.com/kendrick/internal/utils"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 )
 
+// Data rendered by register.html. Errors are keyed by form field.
+type registerPage struct {
+	Desc     string
+	Errors   map[string]string
+	Username string
+	Nickname string
+}
+
 // **********************************
 // *********** REGISTER *************
 // **********************************
@@ -15,7 +22,7 @@ func (srv *HTTPServer) registerHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		desc := r.URL.Query().Get("desc")
-		renderTemplate(w, "register", desc)
+		renderTemplate(w, r, "register", registerPage{Desc: desc})
 	case http.MethodPost:
 		srv.registerUser(w, r)
 	default:
@@ -73,8 +80,10 @@ func createRegisterReq(r *http.Request) api.Request {
 	rid := r.Header.Get(api.RequestIdHeader)
 	ret := make(map[string]string)
 	ret[api.Username] = username
-	ret[api.PwHash] = security.Hash(password)
+	ret[api.PwPlain] = password
 	ret[api.Nickname] = nickname
+	ret[api.UserAgent] = r.UserAgent()
+	ret[api.ClientIP] = clientIP(r)
 	req := api.Request{
 		Id:   rid,
 		Type: "REGISTER",
@@ -91,5 +100,14 @@ func processRegisterRes(w http.ResponseWriter, r *http.Request, res api.Response
 	case api.INSERT_FAILED:
 		qs := utils.CreateQueryString("Account creation failed, please try again!")
 		http.Redirect(w, r, "/register"+qs, http.StatusSeeOther)
+	case api.INSERT_INVALID:
+		// re-render rather than redirect so the form keeps its values
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		renderTemplate(w, r, "register", registerPage{
+			Desc:     res.Description,
+			Errors:   res.Data,
+			Username: r.FormValue("username"),
+			Nickname: r.FormValue("nickname"),
+		})
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const REMEMBER_COOKIE = "remember_me"
+
+// *************************************
+// *********** REMEMBER ME *************
+// *************************************
+
+// Stores the remember-me token of a login response, if the TCP server issued one
+func (srv *HTTPServer) setRememberCookie(w http.ResponseWriter, res api.Response) {
+	if token := res.Data[api.RememberToken]; token != "" {
+		srv.Cookies.Set(w, REMEMBER_COOKIE, token, auth.REMEMBER_TTL)
+	}
+}
+
+// Silently logs a client with no valid session back in using its remember-me cookie.
+// On success the client is sent back to the same page with its new session and true is
+// returned; the request itself is not served, since its handler would see the old cookie.
+func (srv *HTTPServer) resumeSession(w http.ResponseWriter, r *http.Request) bool {
+	token, err := srv.Cookies.Get(r, REMEMBER_COOKIE)
+	if err != nil {
+		if err != http.ErrNoCookie {
+			srv.Cookies.Delete(w, REMEMBER_COOKIE)
+		}
+		return false
+	}
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.RememberToken] = token
+	data[api.SessionId] = srv.getSid(r)
+	data[api.UserAgent] = r.UserAgent()
+	data[api.ClientIP] = clientIP(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "RESUME_SESSION",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		return false
+	}
+	if res.Code != api.LOGIN_SUCCESS {
+		log.WithField(api.RequestId, rid).Info("Remember-me token rejected: ", res.Description)
+		srv.Cookies.Delete(w, REMEMBER_COOKIE)
+		return false
+	}
+	log.WithField(api.RequestId, rid).Info("Session resumed with remember-me token")
+	srv.setSessionCookie(w, res.Data[api.SessionId])
+	srv.setRememberCookie(w, res)
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	return true
+}
+
+// Returns the client's remember-me token, if it has a valid one
+func (srv *HTTPServer) getRememberToken(r *http.Request) string {
+	token, err := srv.Cookies.Get(r, REMEMBER_COOKIE)
+	if err != nil {
+		return ""
+	}
+	return token
+}
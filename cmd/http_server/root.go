@@ -5,7 +5,7 @@ import (
 )
 
 func (srv *HTTPServer) rootHandler(w http.ResponseWriter, r *http.Request) {
-	if isLoggedIn(getSid(r)) {
+	if isLoggedIn(srv.getSid(r)) {
 		http.Redirect(w, r, "/home", http.StatusSeeOther)
 		return
 	}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Data rendered by sessions.html
+type sessionsPage struct {
+	Desc     string
+	Sessions []sessionRow
+}
+
+type sessionRow struct {
+	PublicId  string
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Current   bool
+}
+
+// **********************************
+// *********** SESSIONS *************
+// **********************************
+func (srv *HTTPServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		srv.listSessions(w, r)
+	case http.MethodPost:
+		srv.revokeSessions(w, r)
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+func (srv *HTTPServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "LIST_SESSIONS",
+		Data: data,
+	}
+	page := sessionsPage{Desc: r.URL.Query().Get("desc")}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		page.Desc = "Could not load sessions, please try again in a while"
+		renderTemplate(w, r, "sessions", page)
+		return
+	}
+	if res.Code != api.LIST_SESS_SUCCESS {
+		page.Desc = res.Description
+		renderTemplate(w, r, "sessions", page)
+		return
+	}
+	for _, row := range res.List {
+		created, _ := time.Parse(time.RFC3339, row[api.CreatedAt])
+		lastSeen, _ := time.Parse(time.RFC3339, row[api.LastSeen])
+		page.Sessions = append(page.Sessions, sessionRow{
+			PublicId:  row[api.PublicSessId],
+			UserAgent: row[api.UserAgent],
+			IP:        row[api.ClientIP],
+			CreatedAt: created,
+			LastSeen:  lastSeen,
+			Current:   row[api.Current] == "true",
+		})
+	}
+	renderTemplate(w, r, "sessions", page)
+}
+
+// Revokes one session, or all of them when the form's action is "all"
+func (srv *HTTPServer) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	data[api.UserAgent] = r.UserAgent()
+	data[api.ClientIP] = clientIP(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "REVOKE_SESSION",
+		Data: data,
+	}
+	revokeAll := r.FormValue("action") == "all"
+	if revokeAll {
+		req.Type = "REVOKE_ALL_SESSIONS"
+	} else {
+		data[api.PublicSessId] = r.FormValue("psid")
+	}
+
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Revoke failed, please try again in a while")
+		http.Redirect(w, r, "/sessions"+qs, http.StatusSeeOther)
+		return
+	}
+	log.Info("Receive revoke response", res)
+	if res.Code != api.REVOKE_SUCCESS {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/sessions"+qs, http.StatusSeeOther)
+		return
+	}
+	if revokeAll {
+		srv.Cookies.Delete(w, auth.SESS_COOKIE_NAME)
+		srv.Cookies.Delete(w, REMEMBER_COOKIE)
+		qs := utils.CreateQueryString("Logged out everywhere")
+		http.Redirect(w, r, "/login"+qs, http.StatusSeeOther)
+		return
+	}
+	qs := utils.CreateQueryString(res.Description)
+	http.Redirect(w, r, "/sessions"+qs, http.StatusSeeOther)
+}
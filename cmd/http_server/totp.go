@@ -0,0 +1,169 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// Form action of the button that starts enrollment
+const TOTP_ENROLL_ACTION = "enroll"
+
+// Data rendered by totp.html
+type totpPage struct {
+	Desc          string
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+// ************************************
+// *********** LOGIN TOTP *************
+// ************************************
+func (srv *HTTPServer) totpLoginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := srv.Cookies.Get(r, PENDING_COOKIE); err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		desc := r.URL.Query().Get("desc")
+		renderTemplate(w, r, "login_totp", desc)
+	case http.MethodPost:
+		srv.totpLogin(w, r)
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+func (srv *HTTPServer) totpLogin(w http.ResponseWriter, r *http.Request) {
+	pending, err := srv.Cookies.Get(r, PENDING_COOKIE)
+	if err != nil {
+		qs := utils.CreateQueryString("Login expired, please login again")
+		http.Redirect(w, r, "/login"+qs, http.StatusSeeOther)
+		return
+	}
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.PendingToken] = pending
+	data[api.SessionId] = srv.getSid(r)
+	data[api.TotpCode] = r.FormValue("code")
+	data[api.UserAgent] = r.UserAgent()
+	data[api.ClientIP] = clientIP(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "LOGIN_TOTP",
+		Data: data,
+	}
+	log.Info("Create totp login request ", rid)
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Login failed, please try again in a while")
+		http.Redirect(w, r, "/login/totp"+qs, http.StatusSeeOther)
+		return
+	}
+	log.Info("Receive totp login response", res)
+
+	if res.Code != api.LOGIN_SUCCESS {
+		qs := utils.CreateQueryString(res.Description)
+		http.Redirect(w, r, "/login/totp"+qs, http.StatusSeeOther)
+		return
+	}
+	srv.Cookies.Delete(w, PENDING_COOKIE)
+	srv.setSessionCookie(w, res.Data[api.SessionId])
+	srv.setRememberCookie(w, res)
+	http.Redirect(w, r, "/home", http.StatusSeeOther)
+}
+
+// ******************************
+// *********** TOTP *************
+// ******************************
+func (srv *HTTPServer) totpHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := fromContext(r.Context()); !ok {
+		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		return
+	}
+	if impersonatorFromContext(r.Context()) != "" {
+		w.WriteHeader(http.StatusForbidden)
+		renderTemplate(w, r, "totp", totpPage{Desc: IMPERSONATING_DESC})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		renderTemplate(w, r, "totp", totpPage{Desc: r.URL.Query().Get("desc")})
+	case http.MethodPost:
+		// enrolling replaces the secret, so it is a form post behind the CSRF check
+		if r.FormValue("action") == TOTP_ENROLL_ACTION {
+			srv.totpEnroll(w, r)
+			return
+		}
+		srv.totpConfirm(w, r)
+	default:
+		log.Fatalln("Unused method " + r.Method)
+	}
+}
+
+// Shows a new secret to be added to an authenticator app
+func (srv *HTTPServer) totpEnroll(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	req := api.Request{
+		Id:   rid,
+		Type: "TOTP_ENROLL",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		renderTemplate(w, r, "totp", totpPage{Desc: "Please try again in a while"})
+		return
+	}
+	page := totpPage{}
+	if res.Code != api.TOTP_ENROLL_SUCCESS {
+		page.Desc = res.Description
+	} else {
+		page.Secret = res.Data[api.TotpSecret]
+		page.URI = res.Data[api.TotpURI]
+	}
+	renderTemplate(w, r, "totp", page)
+}
+
+// Enables TOTP once the user submits a code from their authenticator app
+func (srv *HTTPServer) totpConfirm(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(api.RequestIdHeader)
+	data := make(map[string]string)
+	data[api.SessionId] = srv.getSid(r)
+	data[api.TotpCode] = r.FormValue("code")
+	req := api.Request{
+		Id:   rid,
+		Type: "TOTP_CONFIRM",
+		Data: data,
+	}
+	res, err := srv.sendRequest(req)
+	if err != nil {
+		qs := utils.CreateQueryString("Please try again in a while")
+		http.Redirect(w, r, "/totp"+qs, http.StatusSeeOther)
+		return
+	}
+	if res.Code != api.TOTP_CONFIRM_SUCCESS {
+		// shown again with the secret being confirmed, which the form echoes, as enrolling
+		// again would replace it
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		renderTemplate(w, r, "totp", totpPage{
+			Desc:   res.Description,
+			Secret: r.FormValue("secret"),
+			URI:    r.FormValue("uri"),
+		})
+		return
+	}
+	// the TCP server rotates the session id after enabling a second factor
+	if sid := res.Data[api.SessionId]; sid != "" {
+		srv.setSessionCookie(w, sid)
+	}
+	renderTemplate(w, r, "totp", totpPage{
+		Desc:          res.Description,
+		RecoveryCodes: strings.Split(res.Data[api.RecoveryCodes], ","),
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/session"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ERR_WRONG_PASSWORD = errors.New("Password is incorrect")
+
+// ******************************************
+// *********** ACCOUNT **********************
+// ******************************************
+
+// Deletes the requesting session's user, who must confirm with their password. The account
+// is gone at once, but its data is only purged after the grace period, see purgeAccounts.
+func (srv *TCPServer) handleDeleteAcctReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling delete account request")
+
+	user, err := srv.accountUser(ctx, sid)
+	if err == nil && !auth.IsValidPassword(user, req.Data[api.PwPlain]) {
+		err = ERR_WRONG_PASSWORD
+	}
+	if err == nil && srv.DB.DeleteUser(ctx, user.Username, srv.Now()) != 1 {
+		err = database.ERR_USER_NOT_FOUND
+	}
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.DELETE_ACCT_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	// the user cache was dropped with the user; sessions, devices and the cached password
+	// must not outlive them
+	auth.ForgetPassword(user.Username)
+	if err := srv.SessMgr.DeleteUserSessions(user.Username); err != nil {
+		log.Error(err)
+	}
+	srv.DB.DeleteUserRememberTokens(ctx, user.Username)
+	log.Info("Account of " + user.Username + " deleted")
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.DELETE_ACCT_SUCCESS,
+		Description: "Account deleted",
+		Data:        nil,
+	}
+}
+
+// Returns everything stored about the requesting session's user: the profile in Data, and
+// their logins and sessions in List, told apart by api.RecordKind
+func (srv *TCPServer) handleExportAcctReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling export account request")
+
+	res, err := srv.exportAccount(ctx, sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.EXPORT_ACCT_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	res.Id = req.Id
+	return res
+}
+
+func (srv *TCPServer) exportAccount(ctx context.Context, sid string) (api.Response, error) {
+	user, err := srv.accountUser(ctx, sid)
+	if err != nil {
+		return api.Response{}, err
+	}
+	totp, err := srv.DB.GetTotp(ctx, user.Username)
+	if err != nil && err != database.ERR_TOTP_NOT_FOUND {
+		return api.Response{}, err
+	}
+	logins, err := srv.DB.GetLogins(ctx, user.Username)
+	if err != nil {
+		return api.Response{}, err
+	}
+	// token sessions aren't stored, so there are none to export
+	sessions, err := srv.SessMgr.ListSessions(user.Username)
+	if err != nil && err != session.ERR_UNSUPPORTED {
+		return api.Response{}, err
+	}
+
+	ret := profileData(user)
+	ret[api.TotpEnabled] = strconv.FormatBool(totp != nil && totp.Enabled)
+	list := make([]map[string]string, 0, len(logins)+len(sessions))
+	for _, login := range logins {
+		row := make(map[string]string)
+		row[api.RecordKind] = api.RECORD_LOGIN
+		row[api.CreatedAt] = login.At.Format(time.RFC3339)
+		row[api.ClientIP] = login.IP
+		row[api.UserAgent] = login.UserAgent
+		row[api.AuthMethods] = strings.Join(login.AuthMethods, ",")
+		list = append(list, row)
+	}
+	for _, s := range sessions {
+		row := make(map[string]string)
+		row[api.RecordKind] = api.RECORD_SESSION
+		row[api.PublicSessId] = session.PublicId(s.GetSessID())
+		row[api.CreatedAt] = s.GetCreatedAt().Format(time.RFC3339)
+		row[api.LastSeen] = s.GetLastSeen().Format(time.RFC3339)
+		row[api.ClientIP] = s.GetDevice().IP
+		row[api.UserAgent] = s.GetDevice().UserAgent
+		row[api.AuthMethods] = strings.Join(s.GetClaims().AuthMethods, ",")
+		list = append(list, row)
+	}
+	return api.Response{
+		Code:        api.EXPORT_ACCT_SUCCESS,
+		Description: "Exported " + user.Username,
+		Data:        ret,
+		List:        list,
+	}, nil
+}
+
+// Returns the user of a session, who must be acting themselves
+func (srv *TCPServer) accountUser(ctx context.Context, sid string) (*api.User, error) {
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	if isImpersonated(sess) {
+		return nil, ERR_IMPERSONATING
+	}
+	return srv.DB.GetUser(ctx, sess.GetUsername())
+}
+
+// Erases the accounts deleted more than the grace period ago, with their profile pictures
+func (srv *TCPServer) purgeAccounts(ctx context.Context) {
+	usernames, err := srv.DB.GetDeletedUsers(ctx, srv.Now().Add(-srv.DeletionGrace))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, username := range usernames {
+		if srv.DB.PurgeUser(ctx, username) != 1 {
+			continue
+		}
+		// or the old password would still log in to whoever takes the username next
+		auth.ForgetPassword(username)
+		if err := utils.DeleteImage(username); err != nil {
+			log.Error(err)
+		}
+		log.Info("Account of " + username + " purged")
+	}
+}
+
+// Purges deleted accounts and expired security events every interval, until stop is closed
+func (srv *TCPServer) runPurges(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			srv.purgeAccounts(context.Background())
+			srv.purgeEvents(context.Background())
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/security"
+	"example.com/kendrick/internal/tcp_server/session"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	srv.DeletionGrace = 24 * time.Hour
+	srv.DB.InsertUser(context.Background(), "oscar", security.Hash("password"), "oscar")
+	sid, token := loginRemembered(t, srv, "oscar")
+	other := login(t, srv, "oscar", "phone")
+
+	res := srv.handleData(request("DELETE_ACCOUNT", map[string]string{api.SessionId: sid, api.PwPlain: "wrong"}))
+	if res.Code != api.DELETE_ACCT_FAILED {
+		t.Fatal("deleting an account needs its password")
+	}
+	res = srv.handleData(request("DELETE_ACCOUNT", map[string]string{api.SessionId: sid, api.PwPlain: "password"}))
+	if res.Code != api.DELETE_ACCT_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+	if _, err := srv.SessMgr.GetSession(other); err == nil {
+		t.Fatal("the account's sessions should be gone")
+	}
+	if res := resume(srv, token); res.Code != api.LOGIN_FAILED {
+		t.Fatal("the account's remember-me tokens should be gone")
+	}
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "oscar", api.PwPlain: "password"}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatal("a deleted account must not log in")
+	}
+	if srv.DB.InsertUser(context.Background(), "oscar", security.Hash("password"), "oscar") == 1 {
+		t.Fatal("the username is taken until the account is purged")
+	}
+
+	srv.purgeAccounts(context.Background())
+	if srv.DB.InsertUser(context.Background(), "oscar", security.Hash("password"), "oscar") == 1 {
+		t.Fatal("purged within the grace period")
+	}
+	clock.Advance(24 * time.Hour)
+	srv.purgeAccounts(context.Background())
+	if srv.DB.InsertUser(context.Background(), "oscar", security.Hash("new password"), "new oscar") != 1 {
+		t.Fatal("the username should be free once purged")
+	}
+	if logins, _ := srv.DB.GetLogins(context.Background(), "oscar"); len(logins) != 0 {
+		t.Fatalf("the old account's logins should be purged, got %v", logins)
+	}
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "oscar", api.PwPlain: "password"}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatal("the old account's password must not log in to the new one")
+	}
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "oscar", api.PwPlain: "new password"}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+}
+
+func TestExportAccount(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	srv.DB.InsertUser(context.Background(), "judy", security.Hash("password"), "judy")
+	email, bio, timezone := "judy@example.com", "hi", "Asia/Singapore"
+	patch := &database.ProfilePatch{Email: &email, Bio: &bio, Timezone: &timezone}
+	if srv.DB.UpdateUser(context.Background(), "judy", patch, 1) != 1 {
+		t.Fatal("could not set the profile")
+	}
+	srv.handleData(request("LOGIN", map[string]string{
+		api.Username:  "judy",
+		api.PwPlain:   "password",
+		api.ClientIP:  "10.0.0.1",
+		api.UserAgent: "old browser",
+	}))
+	clock.Advance(time.Hour)
+	sid := login(t, srv, "judy", "new browser")
+
+	res := srv.handleData(request("EXPORT_ACCOUNT", map[string]string{api.SessionId: sid}))
+	if res.Code != api.EXPORT_ACCT_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+	if res.Data[api.Username] != "judy" || res.Data[api.Nickname] != "judy" || res.Data[api.TotpEnabled] != "false" {
+		t.Fatalf("got %v", res.Data)
+	}
+	if res.Data[api.Email] != email || res.Data[api.Bio] != bio || res.Data[api.Timezone] != timezone ||
+		res.Data[api.CreatedAt] == "" || res.Data[api.LastLogin] == "" {
+		t.Fatalf("the whole profile should be exported, got %v", res.Data)
+	}
+	kinds := make(map[string]int)
+	for _, row := range res.List {
+		kinds[row[api.RecordKind]]++
+	}
+	if kinds[api.RECORD_LOGIN] != 2 || kinds[api.RECORD_SESSION] != 2 {
+		t.Fatalf("got %v", res.List)
+	}
+	first := res.List[1]
+	if first[api.ClientIP] != "10.0.0.1" || first[api.UserAgent] != "old browser" ||
+		first[api.AuthMethods] != api.AUTH_METHOD_PASSWORD || first[api.CreatedAt] != time.Unix(1600000000, 0).Format(time.RFC3339) {
+		t.Fatalf("logins should be newest first, got %v", first)
+	}
+}
+
+func TestExportAccountWithTokens(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	sessMgr, err := session.NewTokenManager([]session.TokenKey{session.RandomTokenKey()}, session.NewMemDenyList(time.Now), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SessMgr = sessMgr
+	srv.DB.InsertUser(context.Background(), "peggy", security.Hash("password"), "peggy")
+	sid := login(t, srv, "peggy", "browser")
+
+	res := srv.handleData(request("EXPORT_ACCOUNT", map[string]string{api.SessionId: sid}))
+	if res.Code != api.EXPORT_ACCT_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+	if len(res.List) != 1 || res.List[0][api.RecordKind] != api.RECORD_LOGIN {
+		t.Fatalf("token sessions aren't listed, got %v", res.List)
+	}
+}
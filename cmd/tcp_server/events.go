@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+var ERR_NOT_AUDITOR = errors.New("Only admins can read the security events")
+
+// ******************************************
+// *********** SECURITY EVENTS **************
+// ******************************************
+
+// Records a security event of the request, with when and where it came from. Failing to
+// record it is logged, and doesn't fail the request.
+func (srv *TCPServer) recordEvent(ctx context.Context, req *api.Request, event database.SecurityEvent) {
+	event.At = srv.Now()
+	event.RequestId = req.Id
+	event.IP = req.Data[api.ClientIP]
+	event.UserAgent = req.Data[api.UserAgent]
+	if event.Actor == "" {
+		event.Actor = event.Username
+	}
+	if srv.DB.InsertSecurityEvent(ctx, &event) != 1 {
+		log.Error("Recording " + event.Type + " event of " + event.Username + " failed")
+	}
+}
+
+func (srv *TCPServer) recordLoginFailure(ctx context.Context, req *api.Request, username string, reason string) {
+	srv.recordEvent(ctx, req, database.SecurityEvent{
+		Type:     api.EVENT_LOGIN_FAILURE,
+		Username: username,
+		Reason:   reason,
+	})
+}
+
+// Who acts in a session: its user, or the admin logged in as them
+func actorOf(sess api.Session) string {
+	if isImpersonated(sess) {
+		return sess.GetClaims().Impersonator
+	}
+	return sess.GetUsername()
+}
+
+// Lists security events for an admin, newest first and filtered by the request's
+// username, event type and time bounds. The next page is the one before the id of the
+// last event listed.
+func (srv *TCPServer) handleAuditReq(ctx context.Context, req *api.Request) api.Response {
+	data := req.Data
+	sid := data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+		api.Username:  data[api.Username],
+		api.EventType: data[api.EventType],
+	}).Debug("Handling audit request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err == nil && (isImpersonated(sess) || !srv.Admins[sess.GetUsername()]) {
+		err = ERR_NOT_AUDITOR
+	}
+	var filter database.EventFilter
+	if err == nil {
+		filter, err = eventFilter(data)
+	}
+	var events []database.SecurityEvent
+	if err == nil {
+		events, err = srv.DB.GetSecurityEvents(ctx, filter)
+	}
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.AUDIT_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	list := make([]map[string]string, 0, len(events))
+	for _, e := range events {
+		list = append(list, map[string]string{
+			api.EventId:   strconv.FormatInt(e.Id, 10),
+			api.EventTime: e.At.Format(time.RFC3339),
+			api.EventType: e.Type,
+			api.Username:  e.Username,
+			api.Actor:     e.Actor,
+			api.Reason:    e.Reason,
+			api.Detail:    e.Detail,
+			api.RequestId: e.RequestId,
+			api.ClientIP:  e.IP,
+			api.UserAgent: e.UserAgent,
+		})
+	}
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.AUDIT_SUCCESS,
+		Description: strconv.Itoa(len(list)) + " events",
+		Data:        nil,
+		List:        list,
+	}
+}
+
+// Parses the filter of an audit request, whose times are RFC 3339
+func eventFilter(data map[string]string) (database.EventFilter, error) {
+	filter := database.EventFilter{
+		Username: data[api.Username],
+		Type:     data[api.EventType],
+	}
+	var err error
+	if s := data[api.Since]; s != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, errors.New("Invalid since time " + s)
+		}
+	}
+	if s := data[api.Until]; s != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, errors.New("Invalid until time " + s)
+		}
+	}
+	if s := data[api.Before]; s != "" {
+		if filter.Before, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return filter, errors.New("Invalid event id " + s)
+		}
+	}
+	if s := data[api.Limit]; s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil {
+			return filter, errors.New("Invalid limit " + s)
+		}
+	}
+	return filter, nil
+}
+
+// Deletes the security events older than the retention period. A period of 0 keeps them.
+func (srv *TCPServer) purgeEvents(ctx context.Context) {
+	if srv.EventRetention <= 0 {
+		return
+	}
+	srv.DB.DeleteSecurityEvents(ctx, srv.Now().Add(-srv.EventRetention))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/security"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSecurityEvents(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	srv.Admins = parseAdmins("judy")
+	ctx := context.Background()
+	srv.DB.InsertUser(ctx, "judy", security.Hash("password"), "judy")
+
+	res := srv.handleData(request("REGISTER", map[string]string{
+		api.Username:  "olivia",
+		api.Nickname:  "olivia",
+		api.PwPlain:   "correct horse 42",
+		api.ClientIP:  "10.0.0.1",
+		api.UserAgent: "browser",
+	}))
+	if res.Code != api.INSERT_SUCCESS {
+		t.Fatalf("register: got %v %v", res.Code, res.Description)
+	}
+	srv.handleData(request("LOGIN", map[string]string{api.Username: "olivia", api.PwPlain: "wrong"}))
+	srv.handleData(request("LOGIN", map[string]string{api.Username: "nobody", api.PwPlain: "wrong"}))
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "olivia", api.PwPlain: "correct horse 42"}))
+	sid := res.Data[api.SessionId]
+	srv.handleData(request("EDIT", map[string]string{api.SessionId: sid, api.Bio: "hi", api.Version: "1"}))
+	srv.handleData(request("LOGOUT", map[string]string{api.SessionId: sid}))
+
+	events, _ := srv.DB.GetSecurityEvents(ctx, database.EventFilter{Username: "olivia"})
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type+" "+e.Reason+" "+e.Detail)
+	}
+	want := []string{
+		api.EVENT_LOGOUT + "  ",
+		api.EVENT_PROFILE_EDIT + "  bio",
+		api.EVENT_LOGIN_SUCCESS + "  " + api.AUTH_METHOD_PASSWORD,
+		api.EVENT_LOGIN_FAILURE + " " + api.REASON_WRONG_PASSWORD + " ",
+		api.EVENT_REGISTER + "  ",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("got %q", types)
+	}
+	register := events[4]
+	if register.IP != "10.0.0.1" || register.UserAgent != "browser" || register.RequestId != "rid" ||
+		register.Actor != "olivia" || !register.At.Equal(clock.Now()) {
+		t.Fatalf("got %+v", register)
+	}
+	unknown, _ := srv.DB.GetSecurityEvents(ctx, database.EventFilter{Username: "nobody"})
+	if len(unknown) != 1 || unknown[0].Reason != api.REASON_UNKNOWN_USER {
+		t.Fatalf("got %+v", unknown)
+	}
+
+	// only admins may read the events
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "olivia", api.PwPlain: "correct horse 42"}))
+	if res := srv.handleData(request("AUDIT_EVENTS", map[string]string{api.SessionId: res.Data[api.SessionId]})); res.Code != api.AUDIT_FAILED {
+		t.Fatalf("got %v", res.Code)
+	}
+	judy := login(t, srv, "judy", "laptop")
+	res = srv.handleData(request("AUDIT_EVENTS", map[string]string{
+		api.SessionId: judy,
+		api.EventType: api.EVENT_LOGIN_FAILURE,
+		api.Limit:     "1",
+	}))
+	if res.Code != api.AUDIT_SUCCESS || len(res.List) != 1 || res.List[0][api.Username] != "nobody" {
+		t.Fatalf("got %v %v", res.Code, res.List)
+	}
+	res = srv.handleData(request("AUDIT_EVENTS", map[string]string{
+		api.SessionId: judy,
+		api.EventType: api.EVENT_LOGIN_FAILURE,
+		api.Before:    res.List[0][api.EventId],
+	}))
+	if res.Code != api.AUDIT_SUCCESS || len(res.List) != 1 || res.List[0][api.Reason] != api.REASON_WRONG_PASSWORD {
+		t.Fatalf("next page: got %v %v", res.Code, res.List)
+	}
+	res = srv.handleData(request("AUDIT_EVENTS", map[string]string{api.SessionId: judy, api.Since: "yesterday"}))
+	if res.Code != api.AUDIT_FAILED {
+		t.Fatalf("got %v", res.Code)
+	}
+}
+
+func TestPurgeEvents(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	ctx := context.Background()
+	srv.recordLoginFailure(ctx, request("LOGIN", nil), "old", api.REASON_WRONG_PASSWORD)
+	clock.Advance(48 * time.Hour)
+	srv.recordLoginFailure(ctx, request("LOGIN", nil), "new", api.REASON_WRONG_PASSWORD)
+
+	srv.purgeEvents(ctx)
+	if events, _ := srv.DB.GetSecurityEvents(ctx, database.EventFilter{}); len(events) != 2 {
+		t.Fatalf("no retention keeps events for ever, got %+v", events)
+	}
+	srv.EventRetention = 24 * time.Hour
+	srv.purgeEvents(ctx)
+	if events, _ := srv.DB.GetSecurityEvents(ctx, database.EventFilter{}); len(events) != 1 || events[0].Username != "new" {
+		t.Fatalf("got %+v", events)
+	}
+}
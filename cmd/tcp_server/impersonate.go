@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/audit"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+var (
+	ERR_NOT_ADMIN     = errors.New("Only admins can log in as another user")
+	ERR_IMPERSONATING = errors.New("Not allowed while logged in as another user")
+)
+
+// ******************************************
+// *********** IMPERSONATE ******************
+// ******************************************
+
+// Opens a short-lived session as another user for an admin, who keeps their own session
+func (srv *TCPServer) handleImpersonateReq(ctx context.Context, req *api.Request) api.Response {
+	data := req.Data
+	sid := data[api.SessionId]
+	target := data[api.Username]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+		api.Username:  target,
+	}).Debug("Handling impersonate request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return impersonateFailed(req, err)
+	}
+	res := srv.impersonate(ctx, req, sess, target)
+	if isImpersonated(sess) {
+		srv.audit(req, sess.GetClaims().Impersonator, sess.GetUsername(), res)
+	} else {
+		srv.audit(req, sess.GetUsername(), target, res)
+	}
+	return res
+}
+
+func (srv *TCPServer) impersonate(ctx context.Context, req *api.Request, adminSess api.Session, target string) api.Response {
+	admin := adminSess.GetUsername()
+	if isImpersonated(adminSess) {
+		return impersonateFailed(req, ERR_IMPERSONATING)
+	}
+	if !srv.Admins[admin] {
+		log.Warn(admin + " tried to log in as " + target + " without being an admin")
+		return impersonateFailed(req, ERR_NOT_ADMIN)
+	}
+	if target == admin {
+		return impersonateFailed(req, errors.New("Already logged in as "+admin))
+	}
+	user, err := srv.DB.GetUser(ctx, target)
+	if err != nil {
+		log.Error(err)
+		return impersonateFailed(req, errors.New("No such user "+target))
+	}
+	claims := api.NewClaims(user, srv.Now(), api.AUTH_METHOD_IMPERSONATE)
+	claims.Impersonator = admin
+	device := api.Device{
+		UserAgent: req.Data[api.UserAgent],
+		IP:        req.Data[api.ClientIP],
+	}
+	sess, err := srv.SessMgr.CreateSession(claims, device)
+	if err != nil {
+		log.Error(err)
+		return impersonateFailed(req, err)
+	}
+	log.Info(admin + " logged in as " + target)
+	ret := make(map[string]string)
+	ret[api.Username] = target
+	ret[api.SessionId] = sess.GetSessID()
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.IMPERSONATE_SUCCESS,
+		Description: "Logged in as " + target,
+		Data:        ret,
+	}
+}
+
+func impersonateFailed(req *api.Request, err error) api.Response {
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.IMPERSONATE_FAILED,
+		Description: err.Error(),
+		Data:        nil,
+	}
+}
+
+func isImpersonated(sess api.Session) bool {
+	return sess.GetClaims().Impersonator != ""
+}
+
+// Returns the admin behind the request's session and the user they act as, or "" twice if
+// the user is acting themselves. GET_SESSION is left out, it only looks the session up for
+// the HTTP server.
+func (srv *TCPServer) impersonatorOf(req *api.Request) (string, string) {
+	sid := req.Data[api.SessionId]
+	if sid == "" || req.Type == "GET_SESSION" || req.Type == "IMPERSONATE" {
+		return "", ""
+	}
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil || !isImpersonated(sess) {
+		return "", ""
+	}
+	return sess.GetClaims().Impersonator, sess.GetUsername()
+}
+
+// Records that actor made the request on subject's account
+func (srv *TCPServer) audit(req *api.Request, actor string, subject string, res api.Response) {
+	if srv.Audit == nil {
+		return
+	}
+	err := srv.Audit.Record(audit.Entry{
+		Time:      srv.Now(),
+		Actor:     actor,
+		Subject:   subject,
+		Action:    req.Type,
+		Code:      res.Code,
+		RequestId: req.Id,
+	})
+	if err != nil {
+		log.Error("Writing audit log: ", err)
+	}
+}
+
+// Parses the comma separated usernames of --admins
+func parseAdmins(list string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, username := range strings.Split(list, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			admins[username] = true
+		}
+	}
+	return admins
+}
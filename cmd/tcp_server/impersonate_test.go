@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/audit"
+	"example.com/kendrick/internal/tcp_server/security"
+	"testing"
+	"time"
+)
+
+type fakeAudit struct {
+	entries []audit.Entry
+}
+
+func (a *fakeAudit) Record(e audit.Entry) error {
+	a.entries = append(a.entries, e)
+	return nil
+}
+
+func (a *fakeAudit) Close() error { return nil }
+
+func TestImpersonate(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	log := &fakeAudit{}
+	srv.Audit = log
+	srv.Admins = parseAdmins("judy, ")
+	srv.DB.InsertUser(context.Background(), "judy", security.Hash("password"), "judy")
+	srv.DB.InsertUser(context.Background(), "ken", security.Hash("password"), "ken")
+	admin := login(t, srv, "judy", "laptop")
+	user := login(t, srv, "ken", "phone")
+
+	res := srv.handleData(request("IMPERSONATE", map[string]string{api.SessionId: user, api.Username: "judy"}))
+	if res.Code != api.IMPERSONATE_FAILED {
+		t.Fatal("non-admins must not impersonate")
+	}
+	res = srv.handleData(request("IMPERSONATE", map[string]string{api.SessionId: admin, api.Username: "ken"}))
+	if res.Code != api.IMPERSONATE_SUCCESS {
+		t.Fatalf("impersonate: got %v %v", res.Code, res.Description)
+	}
+	as := res.Data[api.SessionId]
+
+	res = srv.handleData(request("GET_SESSION", map[string]string{api.SessionId: as}))
+	if res.Data[api.Username] != "ken" || res.Data[api.Impersonator] != "judy" {
+		t.Fatalf("unexpected session %v", res.Data)
+	}
+	res = srv.handleData(request("CHANGE_PASSWORD", map[string]string{
+		api.SessionId: as,
+		api.PwPlain:   "password",
+		api.NewPw:     "another password 1",
+	}))
+	if res.Code != api.CHANGE_PW_FAILED {
+		t.Fatalf("password change while impersonating: got %v", res.Code)
+	}
+	res = srv.handleData(request("TOTP_ENROLL", map[string]string{api.SessionId: as}))
+	if res.Code != api.TOTP_ENROLL_FAILED {
+		t.Fatalf("totp enroll while impersonating: got %v", res.Code)
+	}
+	res = srv.handleData(request("IMPERSONATE", map[string]string{api.SessionId: as, api.Username: "judy"}))
+	if res.Code != api.IMPERSONATE_FAILED {
+		t.Fatal("impersonation must not nest")
+	}
+
+	// the denied attempt, the impersonation, then everything done as ken apart from the lookup
+	actions := []string{"IMPERSONATE", "IMPERSONATE", "CHANGE_PASSWORD", "TOTP_ENROLL", "IMPERSONATE"}
+	if len(log.entries) != len(actions) {
+		t.Fatalf("unexpected audit log %+v", log.entries)
+	}
+	for i, e := range log.entries {
+		if e.Action != actions[i] {
+			t.Fatalf("entry %v: got %v, want %v", i, e.Action, actions[i])
+		}
+	}
+	if e := log.entries[2]; e.Actor != "judy" || e.Subject != "ken" || e.Code != api.CHANGE_PW_FAILED {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := log.entries[0]; e.Actor != "ken" || e.Code != api.IMPERSONATE_FAILED {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := log.entries[4]; e.Actor != "judy" || e.Subject != "ken" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
+	"errors"
 	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/audit"
 	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/cache"
 	database "example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"example.com/kendrick/internal/tcp_server/security"
 	"example.com/kendrick/internal/tcp_server/session"
+	"example.com/kendrick/internal/utils"
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -14,15 +23,27 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 type TCPServer struct {
-	Port    string
-	DB      database.DB
-	SessMgr session.SessionManager
+	Port      string
+	DB        database.DB
+	SessMgr   session.SessionManager
+	Pending   *auth.PendingLogins // logins waiting on a second factor
+	PwPolicy  *policy.Policy
+	SecretKey []byte          // encrypts TOTP secrets at rest
+	Admins    map[string]bool // usernames allowed to impersonate other users
+	Audit     audit.Log       // records impersonated actions, may be nil
+	Now       func() time.Time
+
+	DeletionGrace  time.Duration // how long a deleted account is kept before it is purged
+	EventRetention time.Duration // how long security events are kept, 0 for ever
 }
 
 var (
@@ -31,10 +52,107 @@ var (
 		"",
 		"Logrus log output, NONE/FILE/STDERR/ALL, default: STDERR",
 	)
-	logLevel   = flag.String("logLevel", "", "Logrus log level, DEBUG/ERROR/INFO, default: INFO")
-	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	logLevel    = flag.String("logLevel", "", "Logrus log level, DEBUG/ERROR/INFO, default: INFO")
+	cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
+	pwMinLength = flag.Int("pwMinLength", 8, "Minimum password length")
+	pwClasses   = flag.String(
+		"pwClasses",
+		"lower,digit",
+		"Character classes every password must contain, comma separated lower/upper/digit/symbol",
+	)
+	pwBreachedList = flag.String(
+		"pwBreachedList",
+		filepath.Join(utils.RootDir(), "../tcp_server/policy/breached.bin"),
+		"Compact breached password list, empty to disable the check",
+	)
+	sessIdleTimeout     = flag.Duration("sessIdleTimeout", 30*time.Minute, "Sessions unused for this long expire")
+	sessAbsoluteTimeout = flag.Duration("sessAbsoluteTimeout", 24*time.Hour, "Sessions older than this expire however active")
+	sessStore           = flag.String(
+		"sessions",
+		SESSIONS_REDIS,
+		"Session implementation, redis/token. token issues signed tokens checked without a redis round trip",
+	)
+	cacheStore      = flag.String("cache", CACHE_REDIS, "Cache for users and sessions, redis/memory. memory needs no redis but is per process")
+	cacheMaxEntries = flag.Int("cacheMaxEntries", 100000, "Size bound of each memory cache")
+	redisMode       = flag.String("redisMode", cache.REDIS_STANDALONE, "Redis topology, standalone/sentinel/cluster")
+	redisAddrs      = flag.String(
+		"redisAddrs",
+		"localhost:6379",
+		"Comma separated host:port of the Redis server, of the sentinels, or of some cluster nodes",
+	)
+	redisMaster   = flag.String("redisMaster", "mymaster", "Name of the master the sentinels watch")
+	redisDB       = flag.Int("redisDB", 0, "Redis database number, always 0 on a cluster")
+	redisUsername = flag.String("redisUsername", "", "Redis ACL user, empty for the default user")
+	redisPwFile   = flag.String(
+		"redisPwFile",
+		filepath.Join(utils.RootDir(), "../../configs/redisPw.txt"),
+		"File of the Redis password, no password if it is missing",
+	)
+	redisSentinelPwFile = flag.String("redisSentinelPwFile", "", "File of the sentinels' password, empty if they have none")
+	redisTLS            = flag.Bool("redisTLS", false, "Connect to Redis over TLS")
+	redisCACert         = flag.String("redisCACert", "", "PEM file of the CA that signed Redis' certificate, default: the system's CAs")
+	redisStartupWait    = flag.Duration(
+		"redisStartupWait",
+		30*time.Second,
+		"How long startup waits for Redis to answer. A Redis still down is connected to once it is up",
+	)
+	redisLegacyKeysFor = flag.Duration(
+		"redisLegacyKeysFor",
+		24*time.Hour,
+		"How long after startup sessions stored under the keys of older servers are still read, 0 never reads them",
+	)
+	dbDriver       = flag.String("db", DB_MYSQL, "Users database, mysql/sqlite/memory. sqlite and memory need no MySQL server")
+	dbPath         = flag.String("dbPath", "users.db", "File of the sqlite users database")
+	dbPrimary      = flag.String("dbPrimary", database.DEFAULT_MYSQL_ADDR, "host:port of the MySQL primary")
+	dbReplicas     = flag.String("dbReplicas", "", "Comma separated host:port of MySQL read replicas, which serve user lookups")
+	dbReplicaLag   = flag.Duration("dbReplicaLag", 5*time.Second, "How long after a user is written it is read from the primary")
+	dbQueryTimeout = flag.Duration("dbQueryTimeout", 5*time.Second, "Longest a single database query may take")
+	dbRetries      = flag.Int("dbRetries", 3, "Retries of a query failing with a deadlock, lock wait timeout or bad connection")
+	sessMaxPerUser = flag.Int("sessMaxPerUser", 0, "Most simultaneous sessions per user, 0 for no limit")
+	sessLimits     = flag.String("sessLimits", "", "File of per-user session limits, one username:max per line")
+	sessLimitMode  = flag.String(
+		"sessLimitMode",
+		session.LIMIT_EVICT_OLDEST,
+		"What a login beyond the session limit does, reject/evict. evict signs the oldest session out",
+	)
+	acctGracePeriod   = flag.Duration("acctGracePeriod", 30*24*time.Hour, "How long a deleted account is kept before its data is purged")
+	acctPurgeInterval = flag.Duration(
+		"acctPurgeInterval",
+		time.Hour,
+		"How often deleted accounts past the grace period, and security events past their retention, are purged",
+	)
+	eventRetention = flag.Duration("eventRetention", 365*24*time.Hour, "How long security events are kept, 0 for ever")
+	admins         = flag.String("admins", "", "Comma separated usernames allowed to log in as other users")
+	auditLog       = flag.String("auditLog", "audit.log", "File recording what admins do while logged in as other users")
+	sessTokenKeys  = flag.String(
+		"sessTokenKeys",
+		filepath.Join(utils.RootDir(), "../../configs/tokenKeys.txt"),
+		"Session token signing keys, one id:seed per line, active key first",
+	)
+)
+
+// Session implementations selectable with --sessions
+const (
+	SESSIONS_REDIS = "redis"
+	SESSIONS_TOKEN = "token"
+)
+
+// Caches selectable with --cache
+const (
+	CACHE_REDIS  = "redis"
+	CACHE_MEMORY = "memory"
 )
 
+// Users databases selectable with --db
+const (
+	DB_MYSQL  = "mysql"
+	DB_SQLITE = "sqlite"
+	DB_MEMORY = "memory"
+)
+
+// how long users stay cached
+const USER_CACHE_TTL = time.Minute
+
 // ********************************
 // *********** COMMON *************
 // ********************************
@@ -84,28 +202,63 @@ func (srv *TCPServer) handleConn(conn net.Conn) {
 	}
 }
 
-// Invokes the relevant request handler
+// Invokes the relevant request handler, auditing requests made by an admin impersonating a user
 func (srv *TCPServer) handleData(req *api.Request) api.Response {
+	impersonator, username := srv.impersonatorOf(req)
+	res := srv.dispatch(context.Background(), req)
+	if impersonator != "" {
+		srv.audit(req, impersonator, username, res)
+	}
+	return res
+}
+
+func (srv *TCPServer) dispatch(ctx context.Context, req *api.Request) api.Response {
 	switch req.Type {
 	case "LOGIN":
-		return srv.handleLoginReq(req)
+		return srv.handleLoginReq(ctx, req)
 	case "EDIT":
-		return srv.handleEditReq(req)
+		return srv.handleEditReq(ctx, req)
 	case "LOGOUT":
-		return srv.handleLogoutReq(req)
+		return srv.handleLogoutReq(ctx, req)
 	case "REGISTER":
-		return srv.handleRegReq(req)
+		return srv.handleRegReq(ctx, req)
 	case "HOME":
-		return srv.handleHomeReq(req)
+		return srv.handleHomeReq(ctx, req)
 	case "GET_SESSION":
-		return srv.handleSessReq(req)
+		return srv.handleSessReq(ctx, req)
+	case "LOGIN_TOTP":
+		return srv.handleTotpLoginReq(ctx, req)
+	case "TOTP_ENROLL":
+		return srv.handleTotpEnrollReq(ctx, req)
+	case "TOTP_CONFIRM":
+		return srv.handleTotpConfirmReq(ctx, req)
+	case "CHANGE_PASSWORD":
+		return srv.handlePwChangeReq(ctx, req)
+	case "LIST_SESSIONS":
+		return srv.handleListSessReq(ctx, req)
+	case "REVOKE_SESSION":
+		return srv.handleRevokeSessReq(ctx, req)
+	case "REVOKE_ALL_SESSIONS":
+		return srv.handleRevokeAllSessReq(ctx, req)
+	case "GET_KEYS":
+		return srv.handleKeysReq(ctx, req)
+	case "RESUME_SESSION":
+		return srv.handleResumeReq(ctx, req)
+	case "IMPERSONATE":
+		return srv.handleImpersonateReq(ctx, req)
+	case "DELETE_ACCOUNT":
+		return srv.handleDeleteAcctReq(ctx, req)
+	case "EXPORT_ACCOUNT":
+		return srv.handleExportAcctReq(ctx, req)
+	case "AUDIT_EVENTS":
+		return srv.handleAuditReq(ctx, req)
 	default:
 		log.Error("Unknown request source " + req.Type)
 	}
 	return api.Response{}
 }
 
-func (srv *TCPServer) handleSessReq(req *api.Request) api.Response {
+func (srv *TCPServer) handleSessReq(ctx context.Context, req *api.Request) api.Response {
 	sid := req.Data[api.SessionId]
 	log.WithFields(log.Fields{
 		api.SessionId: sid,
@@ -113,6 +266,22 @@ func (srv *TCPServer) handleSessReq(req *api.Request) api.Response {
 	}).Debug("Handling session request")
 
 	sess, err := srv.SessMgr.GetSession(sid)
+	if err == session.ERR_SESSION_TIMEOUT {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.GET_SESS_TIMEOUT,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if err == session.ERR_SESSION_EVICTED {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.GET_SESS_EVICTED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
 	if err != nil {
 		log.Error(err)
 		return api.Response{
@@ -125,8 +294,8 @@ func (srv *TCPServer) handleSessReq(req *api.Request) api.Response {
 	ret := make(map[string]string)
 	ret[api.Username] = sess.GetUsername()
 	ret[api.Nickname] = sess.GetNickname()
-	ret[api.PwHash] = sess.GetPwHash()
 	ret[api.ProfilePic] = sess.GetProfilePic()
+	ret[api.Impersonator] = sess.GetClaims().Impersonator
 	return api.Response{
 		Id:          req.Id,
 		Code:        api.GET_SESS_SUCCESS,
@@ -136,7 +305,7 @@ func (srv *TCPServer) handleSessReq(req *api.Request) api.Response {
 }
 
 // Checks the validity of username and password hash in login request.
-func (srv *TCPServer) handleLoginReq(req *api.Request) api.Response {
+func (srv *TCPServer) handleLoginReq(ctx context.Context, req *api.Request) api.Response {
 	data := req.Data
 	username := data[api.Username]
 	pw := data[api.PwPlain]
@@ -145,9 +314,14 @@ func (srv *TCPServer) handleLoginReq(req *api.Request) api.Response {
 		api.PwPlain:  pw,
 	}).Debug("Handling login request")
 
-	user, err := srv.DB.GetUser(username)
+	user, err := srv.DB.GetUser(ctx, username)
 	if err != nil {
 		log.Debug("Invalid password")
+		reason := api.REASON_UNKNOWN_USER
+		if err != database.ERR_USER_NOT_FOUND {
+			reason = api.REASON_ERROR
+		}
+		srv.recordLoginFailure(ctx, req, username, reason)
 		return api.Response{
 			Id:          req.Id,
 			Code:        api.LOGIN_FAILED,
@@ -157,9 +331,11 @@ func (srv *TCPServer) handleLoginReq(req *api.Request) api.Response {
 	}
 
 	if auth.IsValidPassword(user, pw) {
-		sess, err := srv.SessMgr.CreateSession(user)
-		if err != nil {
+		log.Debug("Valid password")
+		totp, err := srv.DB.GetTotp(ctx, username)
+		if err != nil && err != database.ERR_TOTP_NOT_FOUND {
 			log.Error(err)
+			srv.recordLoginFailure(ctx, req, username, api.REASON_ERROR)
 			return api.Response{
 				Id:          req.Id,
 				Code:        api.LOGIN_FAILED,
@@ -167,16 +343,21 @@ func (srv *TCPServer) handleLoginReq(req *api.Request) api.Response {
 				Data:        nil,
 			}
 		}
-		ret := make(map[string]string)
-		ret[api.Username] = username
-		ret[api.SessionId] = sess.GetSessID()
-		res := api.Response{
-			Id:          req.Id,
-			Code:        api.LOGIN_SUCCESS,
-			Description: "Login for " + username + " succeeded",
-			Data:        ret,
+		if totp != nil && totp.Enabled {
+			ret := make(map[string]string)
+			ret[api.Username] = username
+			ret[api.PendingToken] = srv.Pending.Add(username, data[api.Remember] == "true")
+			return api.Response{
+				Id:          req.Id,
+				Code:        api.LOGIN_TOTP_REQUIRED,
+				Description: "Second factor required for " + username,
+				Data:        ret,
+			}
+		}
+		res := srv.createSessionRes(ctx, req, user, api.AUTH_METHOD_PASSWORD)
+		if data[api.Remember] == "true" {
+			srv.addRememberToken(ctx, &res, username, auth.NewRememberFamily())
 		}
-		log.Debug("Valid password")
 		return res
 	}
 	res := api.Response{
@@ -186,43 +367,146 @@ func (srv *TCPServer) handleLoginReq(req *api.Request) api.Response {
 		Data:        nil,
 	}
 	log.Debug("Invalid password")
+	srv.recordLoginFailure(ctx, req, username, api.REASON_WRONG_PASSWORD)
 	return res
 }
 
-func (srv *TCPServer) handleEditReq(req *api.Request) api.Response {
+// Creates a session for a fully authenticated user, records the login and builds the login
+// response. Any session the client held before logging in is dropped, so its id can't be fixated.
+// authMethods are the ways the user proved who they are, see api.AUTH_METHOD_*.
+func (srv *TCPServer) createSessionRes(ctx context.Context, req *api.Request, user *api.User, authMethods ...string) api.Response {
+	if oldSid := req.Data[api.SessionId]; oldSid != "" {
+		if err := srv.SessMgr.DeleteSession(oldSid); err != nil {
+			log.Debug("Dropping previous session: ", err)
+		}
+	}
+	device := api.Device{
+		UserAgent: req.Data[api.UserAgent],
+		IP:        req.Data[api.ClientIP],
+	}
+	sess, err := srv.SessMgr.CreateSession(api.NewClaims(user, srv.Now(), authMethods...), device)
+	if err == session.ERR_SESSION_LIMIT {
+		log.Info("Login of " + user.Username + " refused, at session limit")
+		srv.recordLoginFailure(ctx, req, user.Username, api.REASON_SESSION_LIMIT)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.LOGIN_LIMITED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		srv.recordLoginFailure(ctx, req, user.Username, api.REASON_ERROR)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.LOGIN_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	srv.recordEvent(ctx, req, database.SecurityEvent{
+		Type:     api.EVENT_LOGIN_SUCCESS,
+		Username: user.Username,
+		Detail:   strings.Join(authMethods, ","),
+	})
+	srv.DB.InsertLogin(ctx, &database.Login{
+		Username:    user.Username,
+		At:          srv.Now(),
+		IP:          device.IP,
+		UserAgent:   device.UserAgent,
+		AuthMethods: authMethods,
+	})
+	ret := make(map[string]string)
+	ret[api.Username] = user.Username
+	ret[api.SessionId] = sess.GetSessID()
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.LOGIN_SUCCESS,
+		Description: "Login for " + user.Username + " succeeded",
+		Data:        ret,
+	}
+}
+
+func (srv *TCPServer) handleEditReq(ctx context.Context, req *api.Request) api.Response {
 	data := req.Data
 	sid := data[api.SessionId]
-	nickname := data[api.Nickname]
-	picPath := data[api.ProfilePic]
-	username := data[api.Username]
-	pwHash := data[api.PwHash]
 	log.WithFields(log.Fields{
-		api.RequestId:  req.Id,
-		api.SessionId:  sid,
-		api.Username:   username,
-		api.Nickname:   nickname,
-		api.ProfilePic: picPath,
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+		api.Version:   data[api.Version],
 	}).Debug("Handling edit request")
 
-	// Replace DB user details and current session details with new user
-	newUser := api.User{
-		Username:   username,
-		Nickname:   nickname,
-		ProfilePic: picPath,
-		PwHash:     pwHash,
+	// the version of the profile the edit was made on
+	version, err := strconv.ParseInt(data[api.Version], 10, 64)
+	if err != nil {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.EDIT_FAILED,
+			Description: "Edit is missing the profile version",
+			Data:        nil,
+		}
+	}
+
+	// the session, not the request, says whose profile this is
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.EDIT_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	username := sess.GetUsername()
+
+	// only the fields in the request change
+	patch, invalid := profilePatch(data)
+	if invalid != nil {
+		log.Debug("Edit request has invalid fields")
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.EDIT_INVALID,
+			Description: "Please correct the highlighted fields",
+			Data:        invalid,
+		}
 	}
-	numRows := srv.DB.UpdateUser(username, nickname, picPath)
-	err := srv.SessMgr.EditSession(sid, &newUser)
-	if numRows == 1 && err == nil {
+	if srv.DB.UpdateUser(ctx, username, patch, version) != 1 {
+		return srv.editConflictRes(ctx, req, username)
+	}
+	srv.recordEvent(ctx, req, database.SecurityEvent{
+		Type:     api.EVENT_PROFILE_EDIT,
+		Username: username,
+		Actor:    actorOf(sess),
+		Detail:   strings.Join(patch.Fields(), ","),
+	})
+	// only an edit that won updates the session, which then matches the database
+	claims := sess.GetClaims()
+	if patch.Nickname != nil {
+		claims.Nickname = *patch.Nickname
+	}
+	if patch.ProfilePic != nil {
+		claims.ProfilePic = *patch.ProfilePic
+	}
+	edited, err := srv.SessMgr.EditSession(sid, claims)
+	if err == nil {
+		var ret map[string]string
+		if edited.GetSessID() != sid {
+			// the client must switch to the new id
+			ret = make(map[string]string)
+			ret[api.SessionId] = edited.GetSessID()
+		}
 		res := api.Response{
 			Id:          req.Id,
 			Code:        api.EDIT_SUCCESS,
 			Description: "Edited " + username + " successfully",
-			Data:        nil,
+			Data:        ret,
 		}
 		log.Debug("Valid edit")
 		return res
 	}
+	log.Error(err)
 	res := api.Response{
 		Id:          req.Id,
 		Code:        api.EDIT_FAILED,
@@ -233,7 +517,29 @@ func (srv *TCPServer) handleEditReq(req *api.Request) api.Response {
 	return res
 }
 
-func (srv *TCPServer) handleLogoutReq(req *api.Request) api.Response {
+// Responds to an edit that changed nothing: a conflict with the current profile, if the
+// user is still there
+func (srv *TCPServer) editConflictRes(ctx context.Context, req *api.Request, username string) api.Response {
+	user, err := srv.DB.GetUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.EDIT_FAILED,
+			Description: "Editing " + username + " failed",
+			Data:        nil,
+		}
+	}
+	log.Debug("Edit of an outdated profile")
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.EDIT_CONFLICT,
+		Description: "The profile was changed since it was loaded",
+		Data:        profileData(user),
+	}
+}
+
+func (srv *TCPServer) handleLogoutReq(ctx context.Context, req *api.Request) api.Response {
 	data := req.Data
 	sid := data[api.SessionId]
 	log.WithFields(log.Fields{
@@ -241,6 +547,11 @@ func (srv *TCPServer) handleLogoutReq(req *api.Request) api.Response {
 		api.SessionId: sid,
 	}).Debug("Handling logout request")
 
+	if token := data[api.RememberToken]; token != "" {
+		srv.forgetRememberToken(ctx, token)
+	}
+	// only to know whose session it was
+	sess, sessErr := srv.SessMgr.GetSession(sid)
 	err := srv.SessMgr.DeleteSession(sid)
 	if err != nil {
 		return api.Response{
@@ -256,44 +567,64 @@ func (srv *TCPServer) handleLogoutReq(req *api.Request) api.Response {
 		Description: "Logged out session: " + sid,
 		Data:        nil,
 	}
+	if sessErr == nil {
+		srv.recordEvent(ctx, req, database.SecurityEvent{
+			Type:     api.EVENT_LOGOUT,
+			Username: sess.GetUsername(),
+			Actor:    actorOf(sess),
+		})
+	}
 	log.Debug("Valid logout")
 	return res
 }
 
-func (srv *TCPServer) handleRegReq(req *api.Request) api.Response {
+func (srv *TCPServer) handleRegReq(ctx context.Context, req *api.Request) api.Response {
 	data := req.Data
 	nickname := data[api.Nickname]
 	username := data[api.Username]
-	password := data[api.PwHash]
+	password := data[api.PwPlain]
 	log.WithFields(log.Fields{
 		api.RequestId: req.Id,
 		api.Username:  username,
-		api.PwHash:    password,
 		api.Nickname:  nickname,
 	}).Debug("Handling register request")
 
-	numRows := srv.DB.InsertUser(username, password, nickname)
+	if violations := srv.PwPolicy.Check(username, password); violations != nil {
+		log.Debug("Register request violates password policy")
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.INSERT_INVALID,
+			Description: "Please correct the highlighted fields",
+			Data:        fieldErrors(violations, api.PwPlain),
+		}
+	}
+
+	numRows := srv.DB.InsertUser(ctx, username, security.Hash(password), nickname)
 	if numRows == 1 {
 		res := api.Response{
 			Id:          req.Id,
 			Code:        api.INSERT_SUCCESS,
-			Description: "INSERT: " + username + " " + password + " " + nickname,
+			Description: "INSERT: " + username + " " + nickname,
 			Data:        nil,
 		}
+		srv.recordEvent(ctx, req, database.SecurityEvent{
+			Type:     api.EVENT_REGISTER,
+			Username: username,
+		})
 		log.Debug("Valid register")
 		return res
 	}
 	res := api.Response{
 		Id:          req.Id,
 		Code:        api.INSERT_FAILED,
-		Description: "INSERT failed: " + username + " " + password + " " + nickname,
+		Description: "INSERT failed: " + username + " " + nickname,
 		Data:        nil,
 	}
 	log.Debug("Invalid register")
 	return res
 }
 
-func (srv *TCPServer) handleHomeReq(req *api.Request) api.Response {
+func (srv *TCPServer) handleHomeReq(ctx context.Context, req *api.Request) api.Response {
 	data := req.Data
 	sid := data[api.SessionId]
 	log.WithFields(log.Fields{
@@ -312,17 +643,13 @@ func (srv *TCPServer) handleHomeReq(req *api.Request) api.Response {
 		}
 	}
 	username := sess.GetUsername()
-	user, err := srv.DB.GetUser(username)
+	user, err := srv.DB.GetUser(ctx, username)
 	if err == nil {
-		ret := make(map[string]string)
-		ret[api.Username] = user.Username
-		ret[api.Nickname] = user.Nickname
-		ret[api.ProfilePic] = user.ProfilePic
 		response := api.Response{
 			Id:          req.Id,
 			Code:        api.HOME_SUCCESS,
 			Description: "User " + username + " found!",
-			Data:        ret,
+			Data:        profileData(user),
 		}
 		log.Debug("Valid home request")
 		return response
@@ -381,6 +708,164 @@ func initLogger(logLevel string, logOutput string) {
 	}
 }
 
+// Builds the password policy from command line flags
+func initPwPolicy() (*policy.Policy, error) {
+	pwPolicy := policy.DefaultPolicy()
+	pwPolicy.MinLength = *pwMinLength
+	pwPolicy.RequiredClasses = nil
+	for _, class := range strings.Split(*pwClasses, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if !policy.IsClass(class) {
+			return nil, errors.New("Unknown password character class " + class)
+		}
+		pwPolicy.RequiredClasses = append(pwPolicy.RequiredClasses, class)
+	}
+	if *pwBreachedList != "" {
+		breached, err := policy.LoadBreachedList(*pwBreachedList)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Loaded ", breached.Len(), " breached passwords")
+		pwPolicy.Breached = breached
+	}
+	return pwPolicy, nil
+}
+
+// Creates a cache of the configured kind, keeping entries for ttl unless told otherwise
+func newCache(ttl time.Duration) (cache.Cache, error) {
+	switch *cacheStore {
+	case CACHE_REDIS:
+		config, err := redisConfig()
+		if err != nil {
+			return nil, err
+		}
+		return cache.NewRedisCache(config, ttl)
+	case CACHE_MEMORY:
+		return cache.NewMemoryCache(ttl, *cacheMaxEntries), nil
+	}
+	return nil, errors.New("Unknown cache " + *cacheStore)
+}
+
+// Builds the Redis connection settings from command line flags
+func redisConfig() (cache.RedisConfig, error) {
+	config := cache.DefaultRedisConfig()
+	config.Mode = *redisMode
+	config.Addrs = nil
+	for _, addr := range strings.Split(*redisAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			config.Addrs = append(config.Addrs, addr)
+		}
+	}
+	config.MasterName = *redisMaster
+	config.DB = *redisDB
+	config.Username = *redisUsername
+	config.StartupWait = *redisStartupWait
+	if *redisLegacyKeysFor > 0 {
+		config.LegacyKeysUntil = time.Now().Add(*redisLegacyKeysFor)
+	}
+	if pw, err := ioutil.ReadFile(*redisPwFile); err == nil {
+		config.Password = strings.TrimSpace(string(pw))
+	} else if !os.IsNotExist(err) {
+		return config, err
+	}
+	if *redisSentinelPwFile != "" {
+		pw, err := ioutil.ReadFile(*redisSentinelPwFile)
+		if err != nil {
+			return config, err
+		}
+		config.SentinelPassword = strings.TrimSpace(string(pw))
+	}
+	if *redisTLS {
+		config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		if *redisCACert != "" {
+			pem, err := ioutil.ReadFile(*redisCACert)
+			if err != nil {
+				return config, err
+			}
+			config.TLS.RootCAs = x509.NewCertPool()
+			if !config.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return config, errors.New("No certificate found in " + *redisCACert)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Opens the users database of the configured kind
+func initDB(userCache cache.DBCache) (database.DB, error) {
+	config := database.DefaultConfig()
+	config.Primary = *dbPrimary
+	for _, replica := range strings.Split(*dbReplicas, ",") {
+		if replica = strings.TrimSpace(replica); replica != "" {
+			config.Replicas = append(config.Replicas, replica)
+		}
+	}
+	config.ReplicaLag = *dbReplicaLag
+	config.QueryTimeout = *dbQueryTimeout
+	config.MaxRetries = *dbRetries
+	config.UserTTL = USER_CACHE_TTL
+	switch *dbDriver {
+	case DB_MYSQL:
+		return database.NewDB(userCache, config)
+	case DB_SQLITE:
+		return database.NewSQLiteDB(*dbPath, userCache, config)
+	case DB_MEMORY:
+		log.Warn("Users are kept in memory and lost when the server stops")
+		return database.NewMemoryDB(), nil
+	}
+	return nil, errors.New("Unknown users database " + *dbDriver)
+}
+
+func initSessLimit() (session.Limit, error) {
+	limit := session.Limit{
+		Default: *sessMaxPerUser,
+		Mode:    *sessLimitMode,
+	}
+	if *sessLimits != "" {
+		perUser, err := session.LoadLimits(*sessLimits)
+		if err != nil {
+			return limit, err
+		}
+		limit.PerUser = perUser
+	}
+	return limit, limit.Validate()
+}
+
+func initSessMgr() (session.SessionManager, error) {
+	sessCache, err := newCache(session.SessionCacheTTL(*sessAbsoluteTimeout))
+	if err != nil {
+		return nil, err
+	}
+	limit, err := initSessLimit()
+	if err != nil {
+		return nil, err
+	}
+	// processes sharing the cache hear of each other's session changes
+	events := session.NewEventBus(sessCache)
+	switch *sessStore {
+	case SESSIONS_REDIS:
+		return session.NewManager(sessCache, *sessIdleTimeout, *sessAbsoluteTimeout, limit, events)
+	case SESSIONS_TOKEN:
+		if limit.Enabled() {
+			return nil, errors.New("Session limits need the redis session implementation")
+		}
+		keys, err := session.LoadTokenKeys(*sessTokenKeys)
+		if err != nil {
+			log.Warn("No session token keys, sessions will not survive a restart: ", err)
+			keys = []session.TokenKey{session.RandomTokenKey()}
+		}
+		denied, err := session.NewSyncedDenyList(sessCache, session.DENYLIST_SYNC_INTERVAL)
+		if err != nil {
+			return nil, err
+		}
+		return session.NewTokenManager(keys, denied, *sessAbsoluteTimeout, events)
+	}
+	return nil, errors.New("Unknown session implementation " + *sessStore)
+}
+
 func (srv *TCPServer) Start() {
 	initLogger(*logLevel, *logOutput)
 
@@ -405,6 +890,9 @@ func (srv *TCPServer) Start() {
 
 func (srv *TCPServer) Stop() {
 	srv.SessMgr.Stop()
+	if srv.Audit != nil {
+		srv.Audit.Close()
+	}
 	log.Info("HTTP server stopped.")
 }
 
@@ -413,8 +901,23 @@ func main() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	// cpu profiling
 	flag.Parse()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "users" {
+		if err := runUsers(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// cpu profiling
 	log.Info("CPUPROFILE: " + *cpuprofile)
 	log.Info("LOGLEVEL: " + *logLevel)
 	log.Info("LOGOUTPUT: " + *logOutput)
@@ -430,24 +933,49 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
+	// password policy
+	pwPolicy, err := initPwPolicy()
+	if err != nil {
+		log.Panicln(err)
+	}
 	// session manager
-	sessMgr, err := session.NewManager(4)
+	sessMgr, err := initSessMgr()
 	if err != nil {
 		log.Panicln(err)
 	}
 	// database for users
-	db, err := database.NewDB()
+	userCache, err := newCache(USER_CACHE_TTL)
+	if err != nil {
+		log.Panicln(err)
+	}
+	db, err := initDB(userCache)
+	if err != nil {
+		log.Panicln(err)
+	}
+	auditLog, err := audit.NewFileLog(*auditLog)
 	if err != nil {
 		log.Panicln(err)
 	}
 
 	server := TCPServer{
-		Port:    "9999",
-		SessMgr: sessMgr,
-		DB:      db,
+		Port:      "9999",
+		SessMgr:   sessMgr,
+		DB:        db,
+		Pending:   auth.NewPendingLogins(auth.PENDING_LOGIN_TTL, time.Now),
+		PwPolicy:  pwPolicy,
+		SecretKey: security.DeriveKey(utils.ReadSecretKey()),
+		Admins:    parseAdmins(*admins),
+		Audit:     auditLog,
+		Now:       time.Now,
+
+		DeletionGrace:  *acctGracePeriod,
+		EventRetention: *eventRetention,
 	}
 	defer server.Stop()
 	go server.Start()
+	stopPurges := make(chan struct{})
+	defer close(stopPurges)
+	go server.runPurges(*acctPurgeInterval, stopPurges)
 
 	<-done
 	fmt.Println("SERVER STOPPED")
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"example.com/kendrick/internal/tcp_server/security"
+	"example.com/kendrick/internal/tcp_server/session"
+	"strconv"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+type fakeSessMgr struct {
+	sessions map[string]*api.SessionStruct
+	next     int
+}
+
+func newFakeSessMgr() *fakeSessMgr {
+	return &fakeSessMgr{sessions: make(map[string]*api.SessionStruct)}
+}
+
+func (m *fakeSessMgr) GetSession(sid string) (api.Session, error) {
+	if s, ok := m.sessions[sid]; ok {
+		return s, nil
+	}
+	return nil, session.ERR_NO_SUCH_SESSION
+}
+
+func (m *fakeSessMgr) CreateSession(claims api.Claims, device api.Device) (api.Session, error) {
+	m.next++
+	s := &api.SessionStruct{SessID: strconv.Itoa(m.next), Claims: claims, Device: device}
+	m.sessions[s.SessID] = s
+	return s, nil
+}
+
+func (m *fakeSessMgr) EditSession(sid string, claims api.Claims) (api.Session, error) {
+	m.sessions[sid] = &api.SessionStruct{SessID: sid, Claims: claims}
+	return m.sessions[sid], nil
+}
+
+func (m *fakeSessMgr) RotateSession(sid string) (api.Session, error) {
+	s, ok := m.sessions[sid]
+	if !ok {
+		return nil, session.ERR_NO_SUCH_SESSION
+	}
+	delete(m.sessions, sid)
+	m.next++
+	rotated := &api.SessionStruct{SessID: strconv.Itoa(m.next), Claims: s.Claims}
+	m.sessions[rotated.SessID] = rotated
+	return rotated, nil
+}
+
+func (m *fakeSessMgr) DeleteSession(sid string) error {
+	delete(m.sessions, sid)
+	return nil
+}
+
+func (m *fakeSessMgr) ListSessions(username string) ([]api.Session, error) {
+	var ret []api.Session
+	for i := 1; i <= m.next; i++ {
+		if s, ok := m.sessions[strconv.Itoa(i)]; ok && s.GetUsername() == username {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+func (m *fakeSessMgr) DeleteUserSessions(username string) error {
+	for sid, s := range m.sessions {
+		if s.GetUsername() == username {
+			delete(m.sessions, sid)
+		}
+	}
+	return nil
+}
+
+func (m *fakeSessMgr) Stop() {}
+
+func newTestServer(clock *fakeClock) *TCPServer {
+	return &TCPServer{
+		DB:        database.NewMemoryDB(),
+		SessMgr:   newFakeSessMgr(),
+		Pending:   auth.NewPendingLogins(auth.PENDING_LOGIN_TTL, clock.Now),
+		PwPolicy:  policy.DefaultPolicy(),
+		SecretKey: security.DeriveKey([]byte("test")),
+		Now:       clock.Now,
+	}
+}
+
+func request(reqType string, data map[string]string) *api.Request {
+	return &api.Request{Id: "rid", Type: reqType, Data: data}
+}
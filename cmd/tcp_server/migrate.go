@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	database "example.com/kendrick/internal/tcp_server/database"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+const MIGRATE_USAGE = "usage: tcp_server migrate up|down|status"
+
+// ***************************************
+// *********** MIGRATE COMMAND ***********
+// ***************************************
+
+// Runs `tcp_server migrate up|down|status` against the users database
+func runMigrate(args []string) error {
+	if len(args) != 1 {
+		return errors.New(MIGRATE_USAGE)
+	}
+	sqlDB, err := database.OpenMySQL(*dbPrimary)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+	migrator, err := database.NewMigrator(sqlDB)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		fmt.Printf("Applied %v migrations\n", applied)
+		return err
+	case "down":
+		reverted, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted migration %v %v\n", reverted.Version, reverted.Name)
+		return nil
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		printMigrationStatus(status)
+		return nil
+	}
+	return errors.New(MIGRATE_USAGE)
+}
+
+func printMigrationStatus(status []database.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+	for _, s := range status {
+		state := "pending"
+		if s.Dirty {
+			state = "dirty, applied halfway at " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		} else if s.Applied {
+			state = "applied at " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%04d\t%v\t%v\n", s.Version, s.Name, state)
+	}
+	w.Flush()
+}
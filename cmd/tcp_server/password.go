@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"example.com/kendrick/internal/tcp_server/security"
+	log "github.com/sirupsen/logrus"
+)
+
+// ******************************************
+// *********** CHANGE PASSWORD **************
+// ******************************************
+func (srv *TCPServer) handlePwChangeReq(ctx context.Context, req *api.Request) api.Response {
+	data := req.Data
+	sid := data[api.SessionId]
+	oldPw := data[api.PwPlain]
+	newPw := data[api.NewPw]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling change password request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if isImpersonated(sess) {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_FAILED,
+			Description: ERR_IMPERSONATING.Error(),
+			Data:        nil,
+		}
+	}
+	username := sess.GetUsername()
+	user, err := srv.DB.GetUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if !auth.IsValidPassword(user, oldPw) {
+		log.Debug("Invalid current password")
+		ret := make(map[string]string)
+		ret[api.PwPlain] = "Current password is incorrect."
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_INVALID,
+			Description: "Please correct the highlighted fields",
+			Data:        ret,
+		}
+	}
+	if violations := srv.PwPolicy.CheckPassword(username, newPw); violations != nil {
+		log.Debug("New password violates password policy")
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_INVALID,
+			Description: "Please correct the highlighted fields",
+			Data:        fieldErrors(violations, api.NewPw),
+		}
+	}
+
+	pwHash := security.Hash(newPw)
+	if srv.DB.UpdatePassword(ctx, username, pwHash) != 1 {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.CHANGE_PW_FAILED,
+			Description: "Changing password for " + username + " failed",
+			Data:        nil,
+		}
+	}
+	auth.ForgetPassword(username)
+	log.Info("Password changed for " + username)
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.CHANGE_PW_SUCCESS,
+		Description: "Password changed",
+		Data:        srv.rotateSession(sid),
+	}
+}
+
+// Gives the session a new id after a privilege change. Returns response data carrying the
+// new id, which the client must switch to; nil if rotation failed and the old id is still valid.
+func (srv *TCPServer) rotateSession(sid string) map[string]string {
+	sess, err := srv.SessMgr.RotateSession(sid)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	ret := make(map[string]string)
+	ret[api.SessionId] = sess.GetSessID()
+	return ret
+}
+
+// Maps policy violations to field errors keyed by request data keys.
+// pwKey is the request key holding the password that was checked.
+func fieldErrors(violations []policy.Violation, pwKey string) map[string]string {
+	ret := make(map[string]string)
+	for field, msg := range policy.ByField(violations) {
+		switch field {
+		case policy.FIELD_USERNAME:
+			ret[api.Username] = msg
+		case policy.FIELD_PASSWORD:
+			ret[pwKey] = msg
+		}
+	}
+	return ret
+}
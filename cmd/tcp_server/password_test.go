@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/security"
+	"testing"
+	"time"
+)
+
+func TestRegisterPolicy(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+
+	res := srv.handleData(request("REGISTER", map[string]string{api.Username: "", api.PwPlain: "", api.Nickname: "ken"}))
+	if res.Code != api.INSERT_INVALID {
+		t.Fatalf("empty username and password: got %v", res.Code)
+	}
+	if res.Data[api.Username] == "" || res.Data[api.PwPlain] == "" {
+		t.Fatalf("expected field errors for username and password, got %v", res.Data)
+	}
+
+	res = srv.handleData(request("REGISTER", map[string]string{api.Username: "kendrick", api.PwPlain: "kendrick123", api.Nickname: "ken"}))
+	if res.Code != api.INSERT_INVALID || res.Data[api.Username] != "" {
+		t.Fatalf("password containing username: got %v %v", res.Code, res.Data)
+	}
+
+	res = srv.handleData(request("REGISTER", map[string]string{api.Username: "kendrick", api.PwPlain: "correct horse 9", api.Nickname: "ken"}))
+	if res.Code != api.INSERT_SUCCESS {
+		t.Fatalf("valid register: got %v %v", res.Code, res.Data)
+	}
+	user, _ := srv.DB.GetUser(context.Background(), "kendrick")
+	if !security.ComparePwHash("correct horse 9", user.PwHash) {
+		t.Fatal("password should be hashed by the TCP server")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "alice", security.Hash("old password 1"), "alice")
+	res := srv.handleData(request("LOGIN", map[string]string{api.Username: "alice", api.PwPlain: "old password 1"}))
+	sid := res.Data[api.SessionId]
+
+	res = srv.handleData(request("CHANGE_PASSWORD", map[string]string{api.SessionId: sid, api.PwPlain: "wrong", api.NewPw: "new password 2"}))
+	if res.Code != api.CHANGE_PW_INVALID || res.Data[api.PwPlain] == "" {
+		t.Fatalf("wrong current password: got %v %v", res.Code, res.Data)
+	}
+	res = srv.handleData(request("CHANGE_PASSWORD", map[string]string{api.SessionId: sid, api.PwPlain: "old password 1", api.NewPw: "short"}))
+	if res.Code != api.CHANGE_PW_INVALID || res.Data[api.NewPw] == "" {
+		t.Fatalf("weak new password: got %v %v", res.Code, res.Data)
+	}
+	res = srv.handleData(request("CHANGE_PASSWORD", map[string]string{api.SessionId: sid, api.PwPlain: "old password 1", api.NewPw: "new password 2"}))
+	if res.Code != api.CHANGE_PW_SUCCESS {
+		t.Fatalf("change password: got %v %v", res.Code, res.Description)
+	}
+	if newSid := res.Data[api.SessionId]; newSid == "" || newSid == sid {
+		t.Fatalf("session id should rotate, got %q", newSid)
+	}
+	if _, err := srv.SessMgr.GetSession(sid); err == nil {
+		t.Fatal("old session id should no longer be valid")
+	}
+
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "alice", api.PwPlain: "old password 1"}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("old password should no longer work, got %v", res.Code)
+	}
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "alice", api.PwPlain: "new password 2"}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("new password should work, got %v", res.Code)
+	}
+}
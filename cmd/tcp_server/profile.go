@@ -0,0 +1,85 @@
+package main
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	"net/mail"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest values of the profile fields, as the users table allows
+const (
+	MAX_NICKNAME_LEN = 45
+	MAX_EMAIL_LEN    = 254
+	MAX_BIO_LEN      = 500
+)
+
+// The profile of a user, as sent to the HTTP server. Times are RFC 3339, empty if unknown.
+func profileData(user *api.User) map[string]string {
+	ret := make(map[string]string)
+	ret[api.Username] = user.Username
+	ret[api.Nickname] = user.Nickname
+	ret[api.ProfilePic] = user.ProfilePic
+	ret[api.Version] = strconv.FormatInt(user.Version, 10)
+	ret[api.Email] = user.Email
+	ret[api.Bio] = user.Bio
+	ret[api.Timezone] = user.Timezone
+	ret[api.CreatedAt] = formatTime(user.CreatedAt)
+	ret[api.LastLogin] = formatTime(user.LastLoginAt)
+	return ret
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Returns the profile fields an edit request sets, or the errors of those that are
+// invalid, keyed like the request. A field that is empty is cleared, bar the nickname.
+func profilePatch(data map[string]string) (*database.ProfilePatch, map[string]string) {
+	patch := &database.ProfilePatch{}
+	invalid := make(map[string]string)
+	if nickname, ok := data[api.Nickname]; ok {
+		if nickname == "" || utf8.RuneCountInString(nickname) > MAX_NICKNAME_LEN {
+			invalid[api.Nickname] = "Nickname must be 1 to " + strconv.Itoa(MAX_NICKNAME_LEN) + " characters"
+		}
+		patch.Nickname = &nickname
+	}
+	if picPath, ok := data[api.ProfilePic]; ok {
+		patch.ProfilePic = &picPath
+	}
+	if email, ok := data[api.Email]; ok {
+		if email != "" && !isEmail(email) {
+			invalid[api.Email] = "Not an email address"
+		}
+		patch.Email = &email
+	}
+	if bio, ok := data[api.Bio]; ok {
+		if utf8.RuneCountInString(bio) > MAX_BIO_LEN {
+			invalid[api.Bio] = "Bio must be at most " + strconv.Itoa(MAX_BIO_LEN) + " characters"
+		}
+		patch.Bio = &bio
+	}
+	if timezone, ok := data[api.Timezone]; ok {
+		// LoadLocation takes "Local" to mean the server's own zone, which differs between
+		// servers; "" is UTC and clears the field
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			invalid[api.Timezone] = "Unknown time zone, expected a name like Asia/Singapore"
+		}
+		patch.Timezone = &timezone
+	}
+	if len(invalid) > 0 {
+		return nil, invalid
+	}
+	return patch, nil
+}
+
+// Accepts a bare address, as in user@example.com
+func isEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && len(s) <= MAX_EMAIL_LEN
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// *************************************
+// *********** REMEMBER ME *************
+// *************************************
+
+// Creates a new session from a remember-me token, for a client whose session expired.
+// The token is used up and a successor from the same family is handed back. A token
+// presented again after it was used means a copy was stolen, so its whole family is revoked.
+func (srv *TCPServer) handleResumeReq(ctx context.Context, req *api.Request) api.Response {
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+	}).Debug("Handling resume session request")
+
+	failed := api.Response{
+		Id:          req.Id,
+		Code:        api.LOGIN_FAILED,
+		Description: "Invalid or expired remember-me token",
+		Data:        nil,
+	}
+	stored, validator, err := srv.getRememberToken(ctx, req.Data[api.RememberToken])
+	if err != nil {
+		log.Debug(err)
+		srv.recordLoginFailure(ctx, req, "", api.REASON_INVALID_TOKEN)
+		return failed
+	}
+	now := srv.Now()
+	if !now.Before(stored.Expires) {
+		log.Debug("Expired remember-me token")
+		srv.recordLoginFailure(ctx, req, stored.Username, api.REASON_INVALID_TOKEN)
+		return failed
+	}
+	if !auth.IsValidRememberValidator(validator, stored.ValidatorHash) {
+		// only someone who stole the selector gets here
+		log.Warn("Remember-me validator mismatch, revoking token family of " + stored.Username)
+		srv.DB.DeleteRememberFamily(ctx, stored.Family)
+		srv.recordLoginFailure(ctx, req, stored.Username, api.REASON_TOKEN_THEFT)
+		return failed
+	}
+	if stored.Used {
+		if now.Sub(stored.UsedAt) < auth.REMEMBER_REUSE_GRACE {
+			log.Debug("Remember-me token used concurrently")
+			return failed
+		}
+		log.Warn("Remember-me token reused, revoking token family of " + stored.Username)
+		srv.DB.DeleteRememberFamily(ctx, stored.Family)
+		srv.recordLoginFailure(ctx, req, stored.Username, api.REASON_TOKEN_THEFT)
+		return failed
+	}
+	if srv.DB.UseRememberToken(ctx, stored.Selector, now) != 1 {
+		log.Debug("Remember-me token used concurrently")
+		return failed
+	}
+	user, err := srv.DB.GetUser(ctx, stored.Username)
+	if err != nil {
+		log.Error(err)
+		srv.recordLoginFailure(ctx, req, stored.Username, api.REASON_ERROR)
+		return failed
+	}
+	res := srv.createSessionRes(ctx, req, user, api.AUTH_METHOD_REMEMBER)
+	srv.addRememberToken(ctx, &res, user.Username, stored.Family)
+	log.Info("Session of " + user.Username + " resumed with a remember-me token")
+	return res
+}
+
+// Adds a new remember-me token of the given family to a successful login response
+func (srv *TCPServer) addRememberToken(ctx context.Context, res *api.Response, username string, family string) {
+	if res.Code != api.LOGIN_SUCCESS {
+		return
+	}
+	selector, validatorHash, token := auth.NewRememberToken()
+	stored := database.RememberToken{
+		Selector:      selector,
+		ValidatorHash: validatorHash,
+		Family:        family,
+		Username:      username,
+		Expires:       srv.Now().Add(auth.REMEMBER_TTL),
+	}
+	if srv.DB.InsertRememberToken(ctx, &stored) != 1 {
+		log.Error("Could not store remember-me token of " + username)
+		return
+	}
+	res.Data[api.RememberToken] = token
+}
+
+// Revokes the family of a remember-me token, e.g. on logout
+func (srv *TCPServer) forgetRememberToken(ctx context.Context, token string) {
+	stored, validator, err := srv.getRememberToken(ctx, token)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	if auth.IsValidRememberValidator(validator, stored.ValidatorHash) {
+		srv.DB.DeleteRememberFamily(ctx, stored.Family)
+	}
+}
+
+// Looks up the stored token for one from a client, returning it with the client's validator
+func (srv *TCPServer) getRememberToken(ctx context.Context, token string) (*database.RememberToken, string, error) {
+	selector, validator, ok := auth.SplitRememberToken(token)
+	if !ok {
+		return nil, "", database.ERR_REMEMBER_TOKEN_NOT_FOUND
+	}
+	stored, err := srv.DB.GetRememberToken(ctx, selector)
+	if err != nil {
+		return nil, "", err
+	}
+	return stored, validator, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/security"
+	"testing"
+	"time"
+)
+
+func loginRemembered(t *testing.T, srv *TCPServer, username string) (string, string) {
+	res := srv.handleData(request("LOGIN", map[string]string{
+		api.Username: username,
+		api.PwPlain:  "password",
+		api.Remember: "true",
+	}))
+	if res.Code != api.LOGIN_SUCCESS || res.Data[api.RememberToken] == "" {
+		t.Fatalf("login %v: got %v %v", username, res.Code, res.Data)
+	}
+	return res.Data[api.SessionId], res.Data[api.RememberToken]
+}
+
+func resume(srv *TCPServer, token string) api.Response {
+	return srv.handleData(request("RESUME_SESSION", map[string]string{api.RememberToken: token}))
+}
+
+func TestRememberMeRotates(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	srv.DB.InsertUser(context.Background(), "frank", security.Hash("password"), "frank")
+
+	res := srv.handleData(request("LOGIN", map[string]string{api.Username: "frank", api.PwPlain: "password"}))
+	if res.Data[api.RememberToken] != "" {
+		t.Fatal("remember-me is opt-in")
+	}
+
+	sid, token := loginRemembered(t, srv, "frank")
+	srv.SessMgr.DeleteSession(sid) // as if it expired
+
+	res = resume(srv, token)
+	if res.Code != api.LOGIN_SUCCESS || res.Data[api.SessionId] == "" {
+		t.Fatalf("resume: got %v %v", res.Code, res.Description)
+	}
+	next := res.Data[api.RememberToken]
+	if next == "" || next == token {
+		t.Fatal("resuming should rotate the token")
+	}
+	sess, _ := srv.SessMgr.GetSession(res.Data[api.SessionId])
+	if methods := sess.GetClaims().AuthMethods; len(methods) != 1 || methods[0] != api.AUTH_METHOD_REMEMBER {
+		t.Fatalf("got auth methods %v", methods)
+	}
+
+	clock.Advance(auth.REMEMBER_TTL)
+	if res := resume(srv, next); res.Code != api.LOGIN_FAILED {
+		t.Fatal("expired token should be rejected")
+	}
+}
+
+func TestRememberMeReuseRevokesFamily(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	srv.DB.InsertUser(context.Background(), "grace", security.Hash("password"), "grace")
+	_, stolen := loginRemembered(t, srv, "grace")
+	_, other := loginRemembered(t, srv, "grace")
+
+	next := resume(srv, stolen).Data[api.RememberToken]
+	if res := resume(srv, stolen); res.Code != api.LOGIN_FAILED {
+		t.Fatal("a used token must not be accepted again")
+	}
+	res := resume(srv, next)
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatal("a reuse within the grace period should not revoke the family")
+	}
+	latest := res.Data[api.RememberToken]
+
+	clock.Advance(auth.REMEMBER_REUSE_GRACE)
+	if res := resume(srv, stolen); res.Code != api.LOGIN_FAILED {
+		t.Fatal("a used token must not be accepted again")
+	}
+	if res := resume(srv, latest); res.Code != api.LOGIN_FAILED {
+		t.Fatal("reusing a token should revoke its whole family")
+	}
+	if res := resume(srv, other); res.Code != api.LOGIN_SUCCESS {
+		t.Fatal("other families should be untouched")
+	}
+
+	selector, _, _ := auth.SplitRememberToken(other)
+	if res := resume(srv, selector+":forged"); res.Code != api.LOGIN_FAILED {
+		t.Fatal("forged validator should be rejected")
+	}
+}
+
+func TestLogoutForgetsRememberToken(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "heidi", security.Hash("password"), "heidi")
+	sid, token := loginRemembered(t, srv, "heidi")
+
+	srv.handleData(request("LOGOUT", map[string]string{api.SessionId: sid, api.RememberToken: token}))
+	if res := resume(srv, token); res.Code != api.LOGIN_FAILED {
+		t.Fatal("logging out should revoke the remember-me token")
+	}
+}
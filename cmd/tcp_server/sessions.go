@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/session"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Detail of the session revoke event of a user signing out everywhere, whose other ones
+// carry the public id of the session revoked
+const REVOKED_ALL = "all"
+
+// **********************************
+// *********** SESSIONS *************
+// **********************************
+
+// Lists the live sessions of the requesting session's user
+func (srv *TCPServer) handleListSessReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling list sessions request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.LIST_SESS_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	sessions, err := srv.SessMgr.ListSessions(sess.GetUsername())
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.LIST_SESS_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	list := make([]map[string]string, 0, len(sessions))
+	for _, s := range sessions {
+		row := make(map[string]string)
+		row[api.PublicSessId] = session.PublicId(s.GetSessID())
+		row[api.UserAgent] = s.GetDevice().UserAgent
+		row[api.ClientIP] = s.GetDevice().IP
+		row[api.CreatedAt] = s.GetCreatedAt().Format(time.RFC3339)
+		row[api.LastSeen] = s.GetLastSeen().Format(time.RFC3339)
+		if s.GetSessID() == sid {
+			row[api.Current] = "true"
+		}
+		list = append(list, row)
+	}
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.LIST_SESS_SUCCESS,
+		Description: "Success",
+		Data:        nil,
+		List:        list,
+	}
+}
+
+// Revokes one of the user's sessions, identified by its public id
+func (srv *TCPServer) handleRevokeSessReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	psid := req.Data[api.PublicSessId]
+	log.WithFields(log.Fields{
+		api.RequestId:    req.Id,
+		api.SessionId:    sid,
+		api.PublicSessId: psid,
+	}).Debug("Handling revoke session request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.REVOKE_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	// only look among the user's own sessions, so nobody can revoke someone else's
+	sessions, err := srv.SessMgr.ListSessions(sess.GetUsername())
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.REVOKE_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	for _, s := range sessions {
+		if session.PublicId(s.GetSessID()) != psid {
+			continue
+		}
+		if err := srv.SessMgr.DeleteSession(s.GetSessID()); err != nil {
+			log.Error(err)
+			return api.Response{
+				Id:          req.Id,
+				Code:        api.REVOKE_FAILED,
+				Description: err.Error(),
+				Data:        nil,
+			}
+		}
+		log.Info("Session " + psid + " of " + sess.GetUsername() + " revoked")
+		srv.recordEvent(ctx, req, database.SecurityEvent{
+			Type:     api.EVENT_SESSION_REVOKE,
+			Username: sess.GetUsername(),
+			Actor:    actorOf(sess),
+			Detail:   psid,
+		})
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.REVOKE_SUCCESS,
+			Description: "Session revoked",
+			Data:        nil,
+		}
+	}
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.REVOKE_FAILED,
+		Description: session.ERR_NO_SUCH_SESSION.Error(),
+		Data:        nil,
+	}
+}
+
+// Logs the user out everywhere, including the requesting session
+func (srv *TCPServer) handleRevokeAllSessReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling revoke all sessions request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err == nil && isImpersonated(sess) {
+		// would sign the user out everywhere and forget their devices
+		err = ERR_IMPERSONATING
+	}
+	if err == nil {
+		err = srv.SessMgr.DeleteUserSessions(sess.GetUsername())
+	}
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.REVOKE_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	// otherwise a remembered device would just log back in
+	srv.DB.DeleteUserRememberTokens(ctx, sess.GetUsername())
+	log.Info("All sessions of " + sess.GetUsername() + " revoked")
+	srv.recordEvent(ctx, req, database.SecurityEvent{
+		Type:     api.EVENT_SESSION_REVOKE,
+		Username: sess.GetUsername(),
+		Actor:    actorOf(sess),
+		Detail:   REVOKED_ALL,
+	})
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.REVOKE_SUCCESS,
+		Description: "All sessions revoked",
+		Data:        nil,
+	}
+}
+
+// Publishes the public keys of token sessions, so other services can verify them
+func (srv *TCPServer) handleKeysReq(ctx context.Context, req *api.Request) api.Response {
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+	}).Debug("Handling keys request")
+
+	publisher, ok := srv.SessMgr.(session.KeyPublisher)
+	if !ok {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.KEYS_FAILED,
+			Description: "Sessions are not signed tokens",
+			Data:        nil,
+		}
+	}
+	jwks, err := publisher.JWKS()
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.KEYS_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	ret := make(map[string]string)
+	ret[api.KeySet] = string(jwks)
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.KEYS_SUCCESS,
+		Description: "Success",
+		Data:        ret,
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"example.com/kendrick/internal/tcp_server/security"
+	"example.com/kendrick/internal/tcp_server/session"
+	"strings"
+	"testing"
+	"time"
+)
+
+func login(t *testing.T, srv *TCPServer, username string, ua string) string {
+	res := srv.handleData(request("LOGIN", map[string]string{
+		api.Username:  username,
+		api.PwPlain:   "password",
+		api.UserAgent: ua,
+	}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("login %v: got %v", username, res.Code)
+	}
+	return res.Data[api.SessionId]
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "carol", security.Hash("password"), "carol")
+	srv.DB.InsertUser(context.Background(), "dave", security.Hash("password"), "dave")
+	laptop := login(t, srv, "carol", "laptop")
+	phone := login(t, srv, "carol", "phone")
+	bob := login(t, srv, "dave", "dave's laptop")
+
+	res := srv.handleData(request("LIST_SESSIONS", map[string]string{api.SessionId: laptop}))
+	if res.Code != api.LIST_SESS_SUCCESS || len(res.List) != 2 {
+		t.Fatalf("list: got %v with %v sessions", res.Code, len(res.List))
+	}
+	if res.List[0][api.Current] != "true" || res.List[1][api.UserAgent] != "phone" {
+		t.Fatalf("unexpected list %v", res.List)
+	}
+	for _, row := range res.List {
+		if row[api.PublicSessId] == laptop || row[api.PublicSessId] == phone {
+			t.Fatal("session ids must not be exposed")
+		}
+	}
+
+	res = srv.handleData(request("REVOKE_SESSION", map[string]string{api.SessionId: laptop, api.PublicSessId: session.PublicId(bob)}))
+	if res.Code != api.REVOKE_FAILED {
+		t.Fatal("users must not be able to revoke each other's sessions")
+	}
+	res = srv.handleData(request("REVOKE_SESSION", map[string]string{api.SessionId: laptop, api.PublicSessId: session.PublicId(phone)}))
+	if res.Code != api.REVOKE_SUCCESS {
+		t.Fatalf("revoke: got %v", res.Code)
+	}
+	if _, err := srv.SessMgr.GetSession(phone); err == nil {
+		t.Fatal("revoked session should be gone")
+	}
+
+	res = srv.handleData(request("REVOKE_ALL_SESSIONS", map[string]string{api.SessionId: laptop}))
+	if res.Code != api.REVOKE_SUCCESS {
+		t.Fatalf("revoke all: got %v", res.Code)
+	}
+	if _, err := srv.SessMgr.GetSession(laptop); err == nil {
+		t.Fatal("revoke all should include the current session")
+	}
+	if _, err := srv.SessMgr.GetSession(bob); err != nil {
+		t.Fatal("other users should stay logged in")
+	}
+}
+
+func TestEditWithoutPwHash(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "erin", security.Hash("password"), "erin")
+	sid := login(t, srv, "erin", "laptop")
+
+	res := srv.handleData(request("EDIT", map[string]string{
+		api.SessionId:  sid,
+		api.Nickname:   "E",
+		api.ProfilePic: "/images/erin.jpg",
+		api.Version:    "1",
+	}))
+	if res.Code != api.EDIT_SUCCESS {
+		t.Fatalf("edit: got %v %v", res.Code, res.Description)
+	}
+	res = srv.handleData(request("GET_SESSION", map[string]string{api.SessionId: sid}))
+	if res.Code != api.GET_SESS_SUCCESS || res.Data[api.Nickname] != "E" || res.Data[api.Username] != "erin" {
+		t.Fatalf("get session: got %v %v", res.Code, res.Data)
+	}
+	if _, ok := res.Data[api.PwHash]; ok {
+		t.Fatal("sessions must not carry the password hash")
+	}
+}
+
+func TestEditConflict(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "erin", security.Hash("password"), "erin")
+	tab := login(t, srv, "erin", "laptop")
+	edit := func(nickname string, version string) api.Response {
+		return srv.handleData(request("EDIT", map[string]string{
+			api.SessionId: tab,
+			api.Nickname:  nickname,
+			api.Version:   version,
+		}))
+	}
+
+	if res := edit("first", "1"); res.Code != api.EDIT_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+	// a second tab still showing version 1
+	res := edit("second", "1")
+	if res.Code != api.EDIT_CONFLICT || res.Data[api.Nickname] != "first" || res.Data[api.Version] != "2" {
+		t.Fatalf("got %v %v", res.Code, res.Data)
+	}
+	if user, _ := srv.DB.GetUser(context.Background(), "erin"); user.Nickname != "first" {
+		t.Fatalf("a stale edit must not overwrite, got %+v", user)
+	}
+	sess, _ := srv.SessMgr.GetSession(tab)
+	if sess.GetNickname() != "first" {
+		t.Fatalf("a stale edit must not reach the session, got %v", sess.GetNickname())
+	}
+	if res := edit("second", "2"); res.Code != api.EDIT_SUCCESS {
+		t.Fatalf("got %v %v", res.Code, res.Description)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	mgr, err := session.NewManager(cache.NewMemoryCache(time.Hour, 100), time.Hour, 8*time.Hour, session.Limit{
+		Default: 1,
+		Mode:    session.LIMIT_EVICT_OLDEST,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Stop()
+	srv.SessMgr = mgr
+	srv.DB.InsertUser(context.Background(), "ivan", security.Hash("password"), "ivan")
+
+	laptop := login(t, srv, "ivan", "laptop")
+	login(t, srv, "ivan", "phone")
+	res := srv.handleData(request("GET_SESSION", map[string]string{api.SessionId: laptop}))
+	if res.Code != api.GET_SESS_EVICTED {
+		t.Fatalf("evicted session: got %v", res.Code)
+	}
+
+	mgr, _ = session.NewManager(cache.NewMemoryCache(time.Hour, 100), time.Hour, 8*time.Hour, session.Limit{
+		Default: 1,
+		Mode:    session.LIMIT_REJECT,
+	}, nil)
+	defer mgr.Stop()
+	srv.SessMgr = mgr
+	login(t, srv, "ivan", "laptop")
+	res = srv.handleData(request("LOGIN", map[string]string{api.Username: "ivan", api.PwPlain: "password"}))
+	if res.Code != api.LOGIN_LIMITED {
+		t.Fatalf("login past limit: got %v", res.Code)
+	}
+}
+
+func TestEditProfileFields(t *testing.T) {
+	srv := newTestServer(&fakeClock{t: time.Unix(1600000000, 0)})
+	srv.DB.InsertUser(context.Background(), "erin", security.Hash("password"), "erin")
+	sid := login(t, srv, "erin", "laptop")
+
+	res := srv.handleData(request("EDIT", map[string]string{
+		api.SessionId: sid,
+		api.Nickname:  "",
+		api.Email:     "erin at example.com",
+		api.Bio:       strings.Repeat("b", MAX_BIO_LEN+1),
+		api.Timezone:  "Mars/Olympus_Mons",
+		api.Version:   "1",
+	}))
+	if res.Code != api.EDIT_INVALID || len(res.Data) != 4 {
+		t.Fatalf("got %v %v", res.Code, res.Data)
+	}
+
+	// fields left out of the request keep their value
+	res = srv.handleData(request("EDIT", map[string]string{
+		api.SessionId: sid,
+		api.Email:     "erin@example.com",
+		api.Timezone:  "Asia/Singapore",
+		api.Version:   "1",
+	}))
+	if res.Code != api.EDIT_SUCCESS {
+		t.Fatalf("edit: got %v %v", res.Code, res.Description)
+	}
+	res = srv.handleData(request("HOME", map[string]string{api.SessionId: sid}))
+	if res.Data[api.Nickname] != "erin" || res.Data[api.Email] != "erin@example.com" ||
+		res.Data[api.Timezone] != "Asia/Singapore" || res.Data[api.Version] != "2" {
+		t.Fatalf("got %v", res.Data)
+	}
+	if res.Data[api.CreatedAt] == "" || res.Data[api.LastLogin] == "" {
+		t.Fatalf("creation and login times should be set, got %v", res.Data)
+	}
+}
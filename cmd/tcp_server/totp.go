@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/security"
+	"example.com/kendrick/internal/tcp_server/totp"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+const (
+	TOTP_ISSUER = "Kendrick Login App"
+)
+
+// ******************************
+// *********** TOTP *************
+// ******************************
+
+// Second login step: checks the TOTP (or recovery) code of a pending login and creates the session.
+func (srv *TCPServer) handleTotpLoginReq(ctx context.Context, req *api.Request) api.Response {
+	data := req.Data
+	token := data[api.PendingToken]
+	code := strings.TrimSpace(data[api.TotpCode])
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+	}).Debug("Handling totp login request")
+
+	failed := api.Response{
+		Id:          req.Id,
+		Code:        api.LOGIN_FAILED,
+		Description: "Invalid or expired authentication code",
+		Data:        nil,
+	}
+	username, remember, ok := srv.Pending.Get(token)
+	if !ok {
+		log.Debug("Invalid pending login")
+		srv.recordLoginFailure(ctx, req, "", api.REASON_INVALID_TOKEN)
+		return failed
+	}
+	valid, err := srv.checkTotpCode(ctx, username, code)
+	if err != nil {
+		log.Error(err)
+		srv.recordLoginFailure(ctx, req, username, api.REASON_ERROR)
+		return failed
+	}
+	secondFactor := api.AUTH_METHOD_TOTP
+	if !valid {
+		secondFactor = api.AUTH_METHOD_RECOVERY
+		codeHash := security.HashToken(auth.NormalizeRecoveryCode(code))
+		if srv.DB.UseRecoveryCode(ctx, username, codeHash) != 1 {
+			log.Debug("Invalid totp code")
+			srv.recordLoginFailure(ctx, req, username, api.REASON_WRONG_TOTP)
+			return failed
+		}
+		log.Info("Recovery code used by " + username)
+	}
+	user, err := srv.DB.GetUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		srv.recordLoginFailure(ctx, req, username, api.REASON_ERROR)
+		return failed
+	}
+	srv.Pending.Delete(token)
+	log.Debug("Valid totp code")
+	res := srv.createSessionRes(ctx, req, user, api.AUTH_METHOD_PASSWORD, secondFactor)
+	if remember {
+		srv.addRememberToken(ctx, &res, username, auth.NewRememberFamily())
+	}
+	return res
+}
+
+// Generates a fresh (not yet enabled) TOTP secret for the session's user
+func (srv *TCPServer) handleTotpEnrollReq(ctx context.Context, req *api.Request) api.Response {
+	sid := req.Data[api.SessionId]
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling totp enroll request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_ENROLL_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if isImpersonated(sess) {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_ENROLL_FAILED,
+			Description: ERR_IMPERSONATING.Error(),
+			Data:        nil,
+		}
+	}
+	username := sess.GetUsername()
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_ENROLL_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	encrypted, err := security.Encrypt(secret, srv.SecretKey)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_ENROLL_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if srv.DB.SetTotpSecret(ctx, username, encrypted) == 0 {
+		log.Debug("Totp already enabled")
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_ENROLL_FAILED,
+			Description: "Two-factor authentication is already enabled",
+			Data:        nil,
+		}
+	}
+	ret := make(map[string]string)
+	ret[api.TotpSecret] = secret
+	ret[api.TotpURI] = totp.URI(TOTP_ISSUER, username, secret)
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.TOTP_ENROLL_SUCCESS,
+		Description: "Scan the code with your authenticator app",
+		Data:        ret,
+	}
+}
+
+// Enables TOTP once the user proves their authenticator produces valid codes,
+// returning the recovery codes. They are only ever shown this once.
+func (srv *TCPServer) handleTotpConfirmReq(ctx context.Context, req *api.Request) api.Response {
+	data := req.Data
+	sid := data[api.SessionId]
+	code := strings.TrimSpace(data[api.TotpCode])
+	log.WithFields(log.Fields{
+		api.RequestId: req.Id,
+		api.SessionId: sid,
+	}).Debug("Handling totp confirm request")
+
+	sess, err := srv.SessMgr.GetSession(sid)
+	if err != nil {
+		log.Error(err)
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_CONFIRM_FAILED,
+			Description: err.Error(),
+			Data:        nil,
+		}
+	}
+	if isImpersonated(sess) {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_CONFIRM_FAILED,
+			Description: ERR_IMPERSONATING.Error(),
+			Data:        nil,
+		}
+	}
+	username := sess.GetUsername()
+	// the code is used up, so it can't also log in
+	valid, err := srv.checkTotpCode(ctx, username, code)
+	if err != nil || !valid {
+		log.Debug("Invalid totp code")
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_CONFIRM_FAILED,
+			Description: "Invalid authentication code",
+			Data:        nil,
+		}
+	}
+
+	codes := auth.GenerateRecoveryCodes(auth.RECOVERY_CODE_COUNT)
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = security.HashToken(c)
+	}
+	if srv.DB.EnableTotp(ctx, username, hashes) != 1 {
+		return api.Response{
+			Id:          req.Id,
+			Code:        api.TOTP_CONFIRM_FAILED,
+			Description: "Two-factor authentication is already enabled",
+			Data:        nil,
+		}
+	}
+	ret := srv.rotateSession(sid)
+	if ret == nil {
+		ret = make(map[string]string)
+	}
+	ret[api.RecoveryCodes] = strings.Join(codes, ",")
+	log.Info("Totp enabled for " + username)
+	return api.Response{
+		Id:          req.Id,
+		Code:        api.TOTP_CONFIRM_SUCCESS,
+		Description: "Two-factor authentication enabled",
+		Data:        ret,
+	}
+}
+
+// Checks a TOTP code of a user and uses it up, so it is accepted at most once
+func (srv *TCPServer) checkTotpCode(ctx context.Context, username string, code string) (bool, error) {
+	stored, err := srv.DB.GetTotp(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	secret, err := security.Decrypt(stored.Secret, srv.SecretKey)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, srv.Now(), stored.LastStep)
+	if !ok {
+		return false, nil
+	}
+	// a concurrent request with the same code may have used the step first
+	return srv.DB.UseTotpStep(ctx, username, step) == 1, nil
+}
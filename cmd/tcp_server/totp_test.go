@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/auth"
+	"example.com/kendrick/internal/tcp_server/security"
+	"example.com/kendrick/internal/tcp_server/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Registers a user and walks them through TOTP enrollment, returning the secret and recovery codes
+func enrollUser(t *testing.T, srv *TCPServer, clock *fakeClock) (string, []string) {
+	srv.DB.InsertUser(context.Background(), "kendrick", security.Hash("password"), "ken")
+	res := srv.handleData(request("LOGIN", map[string]string{api.Username: "kendrick", api.PwPlain: "password"}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("login before enrollment: got %v", res.Code)
+	}
+	sid := res.Data[api.SessionId]
+
+	res = srv.handleData(request("TOTP_ENROLL", map[string]string{api.SessionId: sid}))
+	if res.Code != api.TOTP_ENROLL_SUCCESS {
+		t.Fatalf("enroll: got %v %v", res.Code, res.Description)
+	}
+	secret := res.Data[api.TotpSecret]
+	if stored, _ := srv.DB.GetTotp(context.Background(), "kendrick"); stored.Secret == secret {
+		t.Fatal("secret should be encrypted at rest")
+	}
+
+	code, _ := totp.Code(secret, clock.Now())
+	res = srv.handleData(request("TOTP_CONFIRM", map[string]string{api.SessionId: sid, api.TotpCode: code}))
+	if res.Code != api.TOTP_CONFIRM_SUCCESS {
+		t.Fatalf("confirm: got %v %v", res.Code, res.Description)
+	}
+	return secret, strings.Split(res.Data[api.RecoveryCodes], ",")
+}
+
+func loginFirstFactor(t *testing.T, srv *TCPServer) string {
+	res := srv.handleData(request("LOGIN", map[string]string{api.Username: "kendrick", api.PwPlain: "password"}))
+	if res.Code != api.LOGIN_TOTP_REQUIRED {
+		t.Fatalf("login after enrollment: got %v", res.Code)
+	}
+	if res.Data[api.SessionId] != "" {
+		t.Fatal("no session should be created before the second factor")
+	}
+	return res.Data[api.PendingToken]
+}
+
+func TestTotpLogin(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	secret, _ := enrollUser(t, srv, clock)
+
+	pending := loginFirstFactor(t, srv)
+	clock.Advance(time.Minute)
+	code, _ := totp.Code(secret, clock.Now())
+	res := srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: code}))
+	if res.Code != api.LOGIN_SUCCESS || res.Data[api.SessionId] == "" {
+		t.Fatalf("second factor: got %v %v", res.Code, res.Description)
+	}
+	sess, _ := srv.SessMgr.GetSession(res.Data[api.SessionId])
+	if methods := sess.GetClaims().AuthMethods; len(methods) != 2 || methods[1] != api.AUTH_METHOD_TOTP {
+		t.Fatalf("got auth methods %v", methods)
+	}
+
+	// pending tokens are single-use
+	res = srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: code}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("reused pending token: got %v", res.Code)
+	}
+}
+
+func TestTotpPendingLoginExpires(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	secret, _ := enrollUser(t, srv, clock)
+
+	pending := loginFirstFactor(t, srv)
+	clock.Advance(auth.PENDING_LOGIN_TTL)
+	code, _ := totp.Code(secret, clock.Now())
+	res := srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: code}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("expired pending login: got %v", res.Code)
+	}
+}
+
+func TestTotpRecoveryCodeSingleUse(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	_, codes := enrollUser(t, srv, clock)
+	if len(codes) != auth.RECOVERY_CODE_COUNT {
+		t.Fatalf("got %v recovery codes", len(codes))
+	}
+
+	pending := loginFirstFactor(t, srv)
+	res := srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: codes[0]}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("recovery code: got %v", res.Code)
+	}
+
+	pending = loginFirstFactor(t, srv)
+	res = srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: codes[0]}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("reused recovery code: got %v", res.Code)
+	}
+}
+
+func TestTotpCodeReplay(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	srv := newTestServer(clock)
+	secret, _ := enrollUser(t, srv, clock)
+
+	// the code that confirmed enrollment is used up
+	confirmed, _ := totp.Code(secret, clock.Now())
+	pending := loginFirstFactor(t, srv)
+	res := srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: confirmed}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("code used at enrollment: got %v", res.Code)
+	}
+
+	clock.Advance(totp.PERIOD * time.Second)
+	code, _ := totp.Code(secret, clock.Now())
+	pending = loginFirstFactor(t, srv)
+	res = srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: code}))
+	if res.Code != api.LOGIN_SUCCESS {
+		t.Fatalf("fresh code: got %v", res.Code)
+	}
+	// replayed while still within the skew
+	clock.Advance(totp.PERIOD * time.Second)
+	pending = loginFirstFactor(t, srv)
+	res = srv.handleData(request("LOGIN_TOTP", map[string]string{api.PendingToken: pending, api.TotpCode: code}))
+	if res.Code != api.LOGIN_FAILED {
+		t.Fatalf("replayed code: got %v", res.Code)
+	}
+}
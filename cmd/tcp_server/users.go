@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"example.com/kendrick/internal/tcp_server/security"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const USERS_USAGE = "usage: tcp_server users import [--format=csv|jsonl] [--batch=500] [--dryRun] FILE\n" +
+	"       tcp_server users export [--format=csv|jsonl] [--batch=500] FILE"
+
+// File formats of the users command
+const (
+	FORMAT_CSV   = "csv"
+	FORMAT_JSONL = "jsonl"
+)
+
+// Columns of an exported CSV file. An imported one may have a password column instead of
+// pw_hash.
+var userColumns = []string{"username", "nickname", "pw_hash", "profile_pic", "email", "bio", "timezone"}
+
+var (
+	ERR_NO_USERNAME  = errors.New("no username")
+	ERR_NO_PASSWORD  = errors.New("needs one of password and pw_hash")
+	ERR_BAD_PW_HASH  = errors.New("pw_hash is not a bcrypt hash")
+	ERR_NO_USERNAMES = errors.New("CSV header has no username column")
+)
+
+// A user as imported and exported. Exports carry the hash, never a password.
+type userRecord struct {
+	Username   string `json:"username"`
+	Nickname   string `json:"nickname,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PwHash     string `json:"pw_hash,omitempty"`
+	ProfilePic string `json:"profile_pic,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Bio        string `json:"bio,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+}
+
+// Returns the user to insert, hashing a plaintext password. The nickname defaults to the
+// username. The username, and a plaintext password, must pass pwPolicy as on registration;
+// a hash can't be checked, so it is taken as it is.
+func (rec userRecord) toUser(pwPolicy *policy.Policy) (api.User, error) {
+	if rec.Username == "" {
+		return api.User{}, ERR_NO_USERNAME
+	}
+	if (rec.Password == "") == (rec.PwHash == "") {
+		return api.User{}, ERR_NO_PASSWORD
+	}
+	violations := pwPolicy.CheckUsername(rec.Username)
+	if rec.Password != "" {
+		violations = append(violations, pwPolicy.CheckPassword(rec.Username, rec.Password)...)
+	}
+	if violations != nil {
+		var msgs []string
+		for _, v := range violations {
+			msgs = append(msgs, v.Message)
+		}
+		return api.User{}, errors.New(strings.Join(msgs, " "))
+	}
+	user := api.User{
+		Username:   rec.Username,
+		Nickname:   rec.Nickname,
+		PwHash:     rec.PwHash,
+		ProfilePic: rec.ProfilePic,
+		Email:      rec.Email,
+		Bio:        rec.Bio,
+		Timezone:   rec.Timezone,
+	}
+	if user.Nickname == "" {
+		user.Nickname = rec.Username
+	}
+	if rec.Password != "" {
+		user.PwHash = security.Hash(rec.Password)
+	} else if _, err := bcrypt.Cost([]byte(rec.PwHash)); err != nil {
+		return api.User{}, ERR_BAD_PW_HASH
+	}
+	return user, nil
+}
+
+// Counts of what an import did, or would do on a dry run
+type importReport struct {
+	Imported   int
+	Duplicates int
+	Invalid    int
+}
+
+// ***************************************
+// *********** USERS COMMAND *************
+// ***************************************
+
+// Runs `tcp_server users import|export` against the users database of --db
+func runUsers(args []string) error {
+	if len(args) < 1 {
+		return errors.New(USERS_USAGE)
+	}
+	flags := flag.NewFlagSet("users "+args[0], flag.ContinueOnError)
+	format := flags.String("format", "", "csv/jsonl, default: by the file extension")
+	batch := flags.Int("batch", 500, "Users inserted per transaction, or read per query on export")
+	dryRun := flags.Bool("dryRun", false, "Report what an import would do without inserting")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *batch < 1 {
+		return errors.New(USERS_USAGE)
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = formatOf(path)
+	}
+	if *format != FORMAT_CSV && *format != FORMAT_JSONL {
+		return errors.New("Unknown format " + *format)
+	}
+
+	// a shared cache must hear of the imported users, it may hold lookups that found none
+	userCache, err := newCache(USER_CACHE_TTL)
+	if err != nil {
+		return err
+	}
+	defer userCache.Stop()
+	db, err := initDB(userCache)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "import":
+		pwPolicy, err := initPwPolicy()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		report, err := importUsers(ctx, db, pwPolicy, f, *format, *batch, *dryRun, os.Stdout)
+		verb := "Imported"
+		if *dryRun {
+			verb = "Would import"
+		}
+		fmt.Printf("%v %v users, %v duplicates, %v invalid\n", verb, report.Imported, report.Duplicates, report.Invalid)
+		return err
+	case "export":
+		out := os.Stdout
+		if path != "-" {
+			if out, err = os.Create(path); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		exported, err := exportUsers(ctx, db, out, *format, *batch)
+		if err != nil {
+			return err
+		}
+		if path != "-" {
+			fmt.Printf("Exported %v users\n", exported)
+		}
+		return nil
+	}
+	return errors.New(USERS_USAGE)
+}
+
+func formatOf(path string) string {
+	if ext := filepath.Ext(path); ext == ".jsonl" || ext == ".ndjson" {
+		return FORMAT_JSONL
+	}
+	return FORMAT_CSV
+}
+
+// Inserts the users read from r, batch users to a transaction, and reports each row that
+// is invalid or whose username is taken, or repeated, to out. A failing batch stops the import; the
+// batches before it stay imported.
+func importUsers(ctx context.Context, db database.DB, pwPolicy *policy.Policy, r io.Reader, format string, batch int, dryRun bool, out io.Writer) (importReport, error) {
+	var report importReport
+	var users []api.User
+	var rows []int // of each user in users
+	// a dry run inserts nothing, so the database can't tell of usernames repeated across batches
+	seen := make(map[string]bool)
+	flush := func() error {
+		if len(users) == 0 {
+			return nil
+		}
+		inserted, err := db.ImportUsers(ctx, users, dryRun)
+		if err != nil {
+			return fmt.Errorf("row %v: %v", rows[0], err)
+		}
+		for i, ok := range inserted {
+			if ok {
+				report.Imported++
+			} else {
+				report.Duplicates++
+				fmt.Fprintf(out, "row %v: %v: username taken\n", rows[i], users[i].Username)
+			}
+		}
+		users, rows = users[:0], rows[:0]
+		return nil
+	}
+
+	err := readUsers(r, format, func(row int, rec userRecord, err error) error {
+		var user api.User
+		if err == nil {
+			user, err = rec.toUser(pwPolicy)
+		}
+		if err != nil {
+			report.Invalid++
+			fmt.Fprintf(out, "row %v: %v\n", row, err)
+			return nil
+		}
+		if seen[user.Username] {
+			report.Duplicates++
+			fmt.Fprintf(out, "row %v: %v: username repeated\n", row, user.Username)
+			return nil
+		}
+		seen[user.Username] = true
+		users = append(users, user)
+		rows = append(rows, row)
+		if len(users) < batch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, flush()
+}
+
+// Calls each with every user read from r and its row number, counting from 1 after any
+// header. A row that can't be parsed is passed with its error; an error from each stops
+// the reading.
+func readUsers(r io.Reader, format string, each func(row int, rec userRecord, err error) error) error {
+	if format == FORMAT_JSONL {
+		return readJSONL(r, each)
+	}
+	return readCSV(r, each)
+}
+
+// One JSON object per line, blank lines are skipped
+func readJSONL(r io.Reader, each func(row int, rec userRecord, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	row := 0
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row++
+		var rec userRecord
+		err := json.Unmarshal([]byte(text), &rec)
+		if err := each(row, rec, err); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// The first row names the columns, in any order; unknown columns are ignored
+func readCSV(r io.Reader, each func(row int, rec userRecord, err error) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return ERR_NO_USERNAMES
+	}
+	for row := 1; ; row++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		rec := userRecord{
+			Username:   field("username"),
+			Nickname:   field("nickname"),
+			Password:   field("password"),
+			PwHash:     field("pw_hash"),
+			ProfilePic: field("profile_pic"),
+			Email:      field("email"),
+			Bio:        field("bio"),
+			Timezone:   field("timezone"),
+		}
+		if err := each(row, rec, err); err != nil {
+			return err
+		}
+	}
+}
+
+// Writes every user, a page of batch users at a time. Returns how many were written.
+func exportUsers(ctx context.Context, db database.DB, w io.Writer, format string, batch int) (int, error) {
+	var writeUser func(user api.User) error
+	var flush func() error
+	if format == FORMAT_JSONL {
+		buffered := bufio.NewWriter(w)
+		enc := json.NewEncoder(buffered)
+		writeUser = func(user api.User) error {
+			return enc.Encode(userRecord{
+				Username:   user.Username,
+				Nickname:   user.Nickname,
+				PwHash:     user.PwHash,
+				ProfilePic: user.ProfilePic,
+				Email:      user.Email,
+				Bio:        user.Bio,
+				Timezone:   user.Timezone,
+			})
+		}
+		flush = buffered.Flush
+	} else {
+		writer := csv.NewWriter(w)
+		if err := writer.Write(userColumns); err != nil {
+			return 0, err
+		}
+		writeUser = func(user api.User) error {
+			return writer.Write([]string{user.Username, user.Nickname, user.PwHash, user.ProfilePic,
+				user.Email, user.Bio, user.Timezone})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	}
+
+	count := 0
+	after := ""
+	for {
+		users, err := db.GetUsers(ctx, after, batch)
+		if err != nil {
+			return count, err
+		}
+		for _, user := range users {
+			if err := writeUser(user); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(users) < batch {
+			return count, flush()
+		}
+		after = users[len(users)-1].Username
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"example.com/kendrick/internal/tcp_server/database"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"example.com/kendrick/internal/tcp_server/security"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportUsers(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDB()
+	db.InsertUser(ctx, "taken", security.Hash("password"), "taken")
+	hash := security.Hash("hashed password")
+	input := "nickname,username,password,pw_hash\n" +
+		"Alice,alice,open sesame 1,\n" +
+		"Bob,bob,," + hash + "\n" +
+		",taken,password1,\n" +
+		"Eve,eve,,not a hash\n" +
+		"Alice again,alice,password1,\n" +
+		",carol,open sesame 2,\n" +
+		",../x,password1,\n" +
+		",a b,password1,\n" +
+		",dan,weak,\n"
+
+	var out bytes.Buffer
+	report, err := importUsers(ctx, db, policy.DefaultPolicy(), strings.NewReader(input), FORMAT_CSV, 2, true, &out)
+	if err != nil || report != (importReport{Imported: 3, Duplicates: 2, Invalid: 4}) {
+		t.Fatalf("dry run: got %+v, %v", report, err)
+	}
+	if _, err := db.GetUser(ctx, "alice"); err != database.ERR_USER_NOT_FOUND {
+		t.Fatal("a dry run must not insert")
+	}
+
+	out.Reset()
+	report, err = importUsers(ctx, db, policy.DefaultPolicy(), strings.NewReader(input), FORMAT_CSV, 2, false, &out)
+	if err != nil || report != (importReport{Imported: 3, Duplicates: 2, Invalid: 4}) {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+	// taken is reported once its batch is inserted
+	want := "row 4: " + ERR_BAD_PW_HASH.Error() + "\n" +
+		"row 5: alice: username repeated\n" +
+		"row 3: taken: username taken\n" +
+		"row 7: Username may only contain letters, digits, '.', '_' and '-'.\n" +
+		"row 8: Username may only contain letters, digits, '.', '_' and '-'.\n" +
+		"row 9: Password must be at least 8 characters. Password must contain a digit.\n"
+	if out.String() != want {
+		t.Fatalf("got report\n%v", out.String())
+	}
+	alice, _ := db.GetUser(ctx, "alice")
+	if alice.Nickname != "Alice" || !security.ComparePwHash("open sesame 1", alice.PwHash) {
+		t.Fatalf("plaintext passwords should be hashed, got %+v", alice)
+	}
+	if bob, _ := db.GetUser(ctx, "bob"); bob.PwHash != hash {
+		t.Fatalf("hashes should be kept, got %+v", bob)
+	}
+	if carol, _ := db.GetUser(ctx, "carol"); carol.Nickname != "carol" {
+		t.Fatalf("the nickname defaults to the username, got %+v", carol)
+	}
+}
+
+func TestExportUsersRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDB()
+	for _, username := range []string{"dave", "alice", "carol", "bob"} {
+		db.InsertUser(ctx, username, security.Hash(username), strings.ToUpper(username))
+	}
+	nickname, pic, bio := "BOB", "/images/bob.jpg", "Likes, \"quotes\""
+	db.UpdateUser(ctx, "bob", &database.ProfilePatch{Nickname: &nickname, ProfilePic: &pic, Bio: &bio}, 1)
+
+	for _, format := range []string{FORMAT_CSV, FORMAT_JSONL} {
+		var exported bytes.Buffer
+		count, err := exportUsers(ctx, db, &exported, format, 3)
+		if err != nil || count != 4 {
+			t.Fatalf("%v: got %v, %v", format, count, err)
+		}
+		copied := database.NewMemoryDB()
+		var out bytes.Buffer
+		report, err := importUsers(ctx, copied, policy.DefaultPolicy(), &exported, format, 3, false, &out)
+		if err != nil || report != (importReport{Imported: 4}) {
+			t.Fatalf("%v: got %+v, %v\n%v", format, report, err, out.String())
+		}
+		for _, username := range []string{"alice", "bob", "carol", "dave"} {
+			want, _ := db.GetUser(ctx, username)
+			want.Version = 1 // imported users start over
+			got, _ := copied.GetUser(ctx, username)
+			got.CreatedAt, want.CreatedAt = time.Time{}, time.Time{}
+			if *got != *want {
+				t.Fatalf("%v: got %+v, want %+v", format, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package cookie
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+This package signs cookie values with HMAC-SHA256 so the client can't forge or tamper with
+them. A signed value looks like
+
+	value.keyId.base64url(hmac(name | value | keyId))
+
+New cookies are always signed with the first (active) key; any configured key is accepted when
+verifying, so a key can be rotated by prepending a new one and removing the old one once every
+cookie signed by it has expired.
+*/
+
+const (
+	ENV_DEV  = "dev"
+	ENV_PROD = "prod"
+
+	MIN_SECRET_LENGTH = 32
+)
+
+var (
+	ERR_NO_KEYS       = errors.New("No cookie signing keys configured")
+	ERR_SHORT_SECRET  = errors.New("Cookie signing secret must be at least 32 bytes")
+	ERR_BAD_KEY_ID    = errors.New("Cookie key id must be non-empty and not contain '.'")
+	ERR_MALFORMED     = errors.New("Malformed signed cookie")
+	ERR_UNKNOWN_KEY   = errors.New("Cookie signed with an unknown key")
+	ERR_BAD_SIGNATURE = errors.New("Cookie signature mismatch")
+	ERR_UNKNOWN_ENV   = errors.New("Unknown environment")
+)
+
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// Attributes set on every cookie
+type Options struct {
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+type Codec struct {
+	keys    []Key
+	options Options
+}
+
+// Returns the cookie attributes for an environment. Cookies are always HttpOnly.
+func OptionsFor(env string) (Options, error) {
+	switch env {
+	case ENV_DEV:
+		return Options{Path: "/", SameSite: http.SameSiteLaxMode}, nil
+	case ENV_PROD:
+		return Options{Path: "/", Secure: true, SameSite: http.SameSiteLaxMode}, nil
+	}
+	return Options{}, ERR_UNKNOWN_ENV
+}
+
+func NewCodec(keys []Key, options Options) (*Codec, error) {
+	if len(keys) == 0 {
+		return nil, ERR_NO_KEYS
+	}
+	for _, k := range keys {
+		if k.Id == "" || strings.Contains(k.Id, ".") {
+			return nil, ERR_BAD_KEY_ID
+		}
+		if len(k.Secret) < MIN_SECRET_LENGTH {
+			return nil, ERR_SHORT_SECRET
+		}
+	}
+	return &Codec{keys: keys, options: options}, nil
+}
+
+// Reads signing keys from a file with one "id:secret" pair per line, active key first.
+// Blank lines and lines starting with # are ignored.
+func LoadKeys(path string) ([]Key, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []Key
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Bad cookie key line, expected id:secret")
+		}
+		keys = append(keys, Key{Id: parts[0], Secret: []byte(parts[1])})
+	}
+	return keys, scanner.Err()
+}
+
+// Generates a throwaway key, for development when no key file is configured
+func RandomKey() Key {
+	buf := make([]byte, MIN_SECRET_LENGTH)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return Key{Id: "ephemeral", Secret: buf}
+}
+
+// Sets a signed cookie. A zero maxAge makes a session cookie.
+func (c *Codec) Set(w http.ResponseWriter, name string, value string, maxAge time.Duration) {
+	key := c.keys[0]
+	cookie := c.cookie(name, value+"."+key.Id+"."+sign(key, name, value))
+	if maxAge > 0 {
+		cookie.MaxAge = int(maxAge.Seconds())
+		cookie.Expires = time.Now().Add(maxAge)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Returns the verified value of a signed cookie
+func (c *Codec) Get(r *http.Request, name string) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return c.Verify(name, cookie.Value)
+}
+
+// Verifies a signed cookie value, returning the original value
+func (c *Codec) Verify(name string, signed string) (string, error) {
+	sigAt := strings.LastIndex(signed, ".")
+	if sigAt < 0 {
+		return "", ERR_MALFORMED
+	}
+	kidAt := strings.LastIndex(signed[:sigAt], ".")
+	if kidAt < 0 {
+		return "", ERR_MALFORMED
+	}
+	value, kid, sig := signed[:kidAt], signed[kidAt+1:sigAt], signed[sigAt+1:]
+	for _, key := range c.keys {
+		if key.Id != kid {
+			continue
+		}
+		if !hmac.Equal([]byte(sig), []byte(sign(key, name, value))) {
+			return "", ERR_BAD_SIGNATURE
+		}
+		return value, nil
+	}
+	return "", ERR_UNKNOWN_KEY
+}
+
+// Expires a cookie on the client
+func (c *Codec) Delete(w http.ResponseWriter, name string) {
+	cookie := c.cookie(name, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// Applies the configured attributes to an unsigned cookie, e.g. the CSRF cookie
+func (c *Codec) Harden(cookie *http.Cookie) {
+	cookie.Path = c.options.Path
+	cookie.Domain = c.options.Domain
+	cookie.Secure = c.options.Secure
+	cookie.SameSite = c.options.SameSite
+	cookie.HttpOnly = true
+}
+
+func (c *Codec) cookie(name string, value string) *http.Cookie {
+	cookie := &http.Cookie{Name: name, Value: value}
+	c.Harden(cookie)
+	return cookie
+}
+
+func sign(key Key, name string, value string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(name + "|" + value + "|" + key.Id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,79 @@
+package cookie
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKey(id string) Key {
+	return Key{Id: id, Secret: []byte(strings.Repeat(id, MIN_SECRET_LENGTH))}
+}
+
+func roundTrip(t *testing.T, signer *Codec, verifier *Codec, value string) (string, error) {
+	w := httptest.NewRecorder()
+	signer.Set(w, "session", value, time.Hour)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %v cookies", len(cookies))
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	return verifier.Get(r, "session")
+}
+
+func TestSignVerify(t *testing.T) {
+	options, _ := OptionsFor(ENV_PROD)
+	codec, err := NewCodec([]Key{newKey("a")}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := roundTrip(t, codec, codec, "sid.with.dots")
+	if err != nil || got != "sid.with.dots" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	w := httptest.NewRecorder()
+	codec.Set(w, "session", "abc", time.Hour)
+	c := w.Result().Cookies()[0]
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("unsafe attributes: %+v", c)
+	}
+	if _, err := codec.Verify("session", "abd"+strings.TrimPrefix(c.Value, "abc")); err != ERR_BAD_SIGNATURE {
+		t.Errorf("tampered value: got %v", err)
+	}
+	if _, err := codec.Verify("other", c.Value); err != ERR_BAD_SIGNATURE {
+		t.Errorf("value moved to another cookie: got %v", err)
+	}
+	if _, err := codec.Verify("session", "abc"); err != ERR_MALFORMED {
+		t.Errorf("unsigned value: got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	options, _ := OptionsFor(ENV_DEV)
+	old, _ := NewCodec([]Key{newKey("a")}, options)
+	rotated, _ := NewCodec([]Key{newKey("b"), newKey("a")}, options)
+	retired, _ := NewCodec([]Key{newKey("b")}, options)
+
+	if got, err := roundTrip(t, old, rotated, "sid"); err != nil || got != "sid" {
+		t.Errorf("old key should verify after rotation, got %q %v", got, err)
+	}
+	if _, err := roundTrip(t, old, retired, "sid"); err != ERR_UNKNOWN_KEY {
+		t.Errorf("retired key: got %v", err)
+	}
+	if got, err := roundTrip(t, rotated, retired, "sid"); err != nil || got != "sid" {
+		t.Errorf("new cookies should be signed with the active key, got %q %v", got, err)
+	}
+}
+
+func TestNewCodecRejectsShortSecret(t *testing.T) {
+	if _, err := NewCodec([]Key{{Id: "a", Secret: []byte("short")}}, Options{}); err != ERR_SHORT_SECRET {
+		t.Errorf("got %v", err)
+	}
+	if _, err := NewCodec(nil, Options{}); err != ERR_NO_KEYS {
+		t.Errorf("got %v", err)
+	}
+}
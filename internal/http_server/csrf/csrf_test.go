@@ -0,0 +1,69 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postForm(token string, cookie string) *http.Request {
+	form := url.Values{}
+	if token != "" {
+		form.Set(FORM_FIELD, token)
+	}
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/edit", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: COOKIE_NAME, Value: cookie})
+	}
+	return r
+}
+
+func TestEnsureTokenSetsCookieOnce(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := EnsureToken(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	token := Token(r.Context())
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly {
+		t.Fatalf("got token %q, cookies %v", token, cookies)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(cookies[0])
+	r = EnsureToken(w, r)
+	if Token(r.Context()) != token || len(w.Result().Cookies()) != 0 {
+		t.Fatal("existing token should be reused")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		r    *http.Request
+		want error
+	}{
+		{"valid", postForm("abc", "abc"), nil},
+		{"no cookie", postForm("abc", ""), ERR_NO_COOKIE},
+		{"no token", postForm("", "abc"), ERR_NO_TOKEN},
+		{"mismatch", postForm("abd", "abc"), ERR_TOKEN_MISMATCH},
+	}
+	for _, test := range tests {
+		if got := Verify(test.r); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	r := postForm("abc", "abc")
+	r.Header.Set("Origin", "https://evil.example")
+	if got := Verify(r); got != ERR_BAD_ORIGIN {
+		t.Errorf("cross origin: got %v", got)
+	}
+	r = postForm("", "abc")
+	r.Header.Set(HEADER_NAME, "abc")
+	if got := Verify(r); got != nil {
+		t.Errorf("header token: got %v", got)
+	}
+}
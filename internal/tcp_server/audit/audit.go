@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+Audit log of actions taken on a user's account by someone else, such as an admin
+impersonating the user. Entries are tied to both identities.
+*/
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`   // who acted
+	Subject   string    `json:"subject"` // whose account they acted on
+	Action    string    `json:"action"`  // request type
+	Code      int       `json:"code"`    // response code
+	RequestId string    `json:"rid"`
+}
+
+type Log interface {
+	Record(e Entry) error
+	Close() error
+}
+
+// Appends entries to a file as JSON lines
+type FileLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileLog(path string) (*FileLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (l *FileLog) Record(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(e)
+}
+
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -3,15 +3,18 @@ package auth
 import (
 	"example.com/kendrick/api"
 	"example.com/kendrick/internal/tcp_server/security"
+	"sync"
 )
 
 const (
-	SESS_COOKIE_NAME     = "session"
-	USERNAME_COOKIE_NAME = "username"
+	SESS_COOKIE_NAME = "session"
 )
 
 // valid username-password pairs will be stored here
-var validPwCache = make(map[string]string, 250)
+var (
+	validPwCache = make(map[string]string, 250)
+	validPwMu    sync.RWMutex
+)
 
 /*
 This package handles password authentication.
@@ -20,13 +23,25 @@ This package handles password authentication.
 // Checks if a user's password matches the given pw string
 func IsValidPassword(user *api.User, pw string) bool {
 	// try to get from cache first
-	if validPw, ok := validPwCache[user.Username]; ok {
+	validPwMu.RLock()
+	validPw, ok := validPwCache[user.Username]
+	validPwMu.RUnlock()
+	if ok {
 		return validPw == pw
 	} else {
 		isPwValid := security.ComparePwHash(pw, user.PwHash)
 		if isPwValid {
+			validPwMu.Lock()
 			validPwCache[user.Username] = pw
+			validPwMu.Unlock()
 		}
 		return isPwValid
 	}
 }
+
+// Drops a cached password, must be called whenever a user's password changes
+func ForgetPassword(username string) {
+	validPwMu.Lock()
+	delete(validPwCache, username)
+	validPwMu.Unlock()
+}
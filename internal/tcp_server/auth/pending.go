@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"example.com/kendrick/internal/tcp_server/security"
+	"sync"
+	"time"
+)
+
+const (
+	PENDING_LOGIN_TTL      = time.Minute * 5
+	PENDING_LOGIN_ATTEMPTS = 5
+)
+
+/*
+Pending logins are users that passed the password check but still owe a second factor.
+The token handed back to the client is short-lived and only good for a few attempts.
+*/
+
+type pendingLogin struct {
+	username string
+	remember bool // whether the user asked to be remembered
+	expires  time.Time
+	attempts int
+}
+
+type PendingLogins struct {
+	mu      sync.Mutex
+	pending map[string]*pendingLogin
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func NewPendingLogins(ttl time.Duration, now func() time.Time) *PendingLogins {
+	return &PendingLogins{
+		pending: make(map[string]*pendingLogin),
+		ttl:     ttl,
+		now:     now,
+	}
+}
+
+// Records that username passed the first factor, returns the pending-login token
+func (p *PendingLogins) Add(username string, remember bool) string {
+	token := security.RandomToken(32)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeExpired()
+	p.pending[token] = &pendingLogin{
+		username: username,
+		remember: remember,
+		expires:  p.now().Add(p.ttl),
+	}
+	return token
+}
+
+// Returns the username a pending-login token belongs to, and whether they asked to be
+// remembered. Every call counts as an attempt; the token is dropped once it expires or
+// runs out of attempts.
+func (p *PendingLogins) Get(token string) (string, bool, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	login, ok := p.pending[token]
+	if !ok {
+		return "", false, false
+	}
+	login.attempts++
+	if !p.now().Before(login.expires) || login.attempts > PENDING_LOGIN_ATTEMPTS {
+		delete(p.pending, token)
+		return "", false, false
+	}
+	return login.username, login.remember, true
+}
+
+// Drops a pending login, called once the second factor succeeds
+func (p *PendingLogins) Delete(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, token)
+}
+
+func (p *PendingLogins) removeExpired() {
+	now := p.now()
+	for token, login := range p.pending {
+		if !now.Before(login.expires) {
+			delete(p.pending, token)
+		}
+	}
+}
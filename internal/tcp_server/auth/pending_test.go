@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestPendingLoginExpires(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	pending := NewPendingLogins(PENDING_LOGIN_TTL, clock.Now)
+	token := pending.Add("kendrick", true)
+
+	clock.Advance(PENDING_LOGIN_TTL - time.Second)
+	if username, remember, ok := pending.Get(token); !ok || username != "kendrick" || !remember {
+		t.Fatalf("got %v, %v before expiry", username, ok)
+	}
+	clock.Advance(time.Second)
+	if _, _, ok := pending.Get(token); ok {
+		t.Fatal("pending login should have expired")
+	}
+}
+
+func TestPendingLoginAttempts(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	pending := NewPendingLogins(PENDING_LOGIN_TTL, clock.Now)
+	token := pending.Add("kendrick", false)
+
+	for i := 0; i < PENDING_LOGIN_ATTEMPTS; i++ {
+		if _, _, ok := pending.Get(token); !ok {
+			t.Fatalf("attempt %v should be allowed", i+1)
+		}
+	}
+	if _, _, ok := pending.Get(token); ok {
+		t.Fatal("token should be dropped after too many attempts")
+	}
+}
+
+func TestPendingLoginDelete(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	pending := NewPendingLogins(PENDING_LOGIN_TTL, clock.Now)
+	token := pending.Add("kendrick", false)
+	pending.Delete(token)
+	if _, _, ok := pending.Get(token); ok {
+		t.Fatal("deleted token should not be usable")
+	}
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"log"
+	"strings"
+)
+
+const (
+	RECOVERY_CODE_COUNT = 10
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generates single-use recovery codes of the form "abcde-fghij"
+func GenerateRecoveryCodes(n int) []string {
+	codes := make([]string, n)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalln(err)
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(buf))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes
+}
+
+// Normalises user input so that spacing and case don't matter
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"example.com/kendrick/internal/tcp_server/security"
+	"strings"
+	"time"
+)
+
+/*
+Remember-me tokens have the form "selector:validator". The selector finds the stored token,
+the validator proves possession and is only stored hashed, so a leaked table can't be replayed.
+*/
+
+const (
+	REMEMBER_TTL = 30 * 24 * time.Hour
+	// a token replayed this soon after it was used is most likely a concurrent request of
+	// the same browser, rather than a stolen copy
+	REMEMBER_REUSE_GRACE = 30 * time.Second
+	REMEMBER_SEPARATOR   = ":"
+)
+
+// Generates a remember-me token. Returns the selector and the validator hash to store,
+// and the token to hand to the client.
+func NewRememberToken() (string, string, string) {
+	selector := security.RandomToken(18)
+	validator := security.RandomToken(32)
+	return selector, security.HashToken(validator), selector + REMEMBER_SEPARATOR + validator
+}
+
+// Generates the id shared by all tokens descending from one login
+func NewRememberFamily() string {
+	return security.RandomToken(18)
+}
+
+// Splits a token from a client into selector and validator
+func SplitRememberToken(token string) (string, string, bool) {
+	parts := strings.SplitN(token, REMEMBER_SEPARATOR, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Checks a validator from a client against the stored hash, in constant time
+func IsValidRememberValidator(validator string, validatorHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(security.HashToken(validator)), []byte(validatorHash)) == 1
+}
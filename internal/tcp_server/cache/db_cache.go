@@ -1,13 +1,57 @@
 package cache
 
 import (
+	"errors"
 	"example.com/kendrick/api"
+	"time"
 )
 
+var ERR_USER_SESSIONS_FULL = errors.New("cache: user is at their session limit")
+
 type DBCache interface {
 	GetSession(key string) (api.Session, error) // uuid to username
-	SetSession(key string, s api.Session) error
+	SetSession(key string, s api.Session, ttl time.Duration) error
 	DeleteSession(key string) error
-	GetUser(key string) ([]api.User, error) // username to user info
-	SetUser(key string, user []api.User) error
+	GetUser(key string) ([]api.User, error) // username to user info, ERR_CACHE_MISS if not cached
+	SetUser(key string, user []api.User, ttl time.Duration) error
+	DeleteUser(key string) error
+	AddUserSession(username string, sid string, created time.Time) error // per-user session index
+	// Indexes a session unless its user has max sessions already, not counting those in
+	// exempt, in one step. With evict, the oldest are unindexed to make room and returned;
+	// without, ERR_USER_SESSIONS_FULL is.
+	AddUserSessionLimited(username string, sid string, created time.Time, max int, evict bool, exempt []string) ([]string, error)
+	RemoveUserSession(username string, sid string) error
+	GetUserSessions(username string) ([]string, error) // oldest first
+	Stop()                                             // releases connections and background work
+}
+
+// What every cache implementation offers
+type Cache interface {
+	DBCache
+	DenyStore
+	PubSub
+}
+
+// Shared store behind the deny-lists of revoked session tokens
+type DenyStore interface {
+	AddDenied(id string, at time.Time, until time.Time) error
+	GetDenied(now time.Time) (map[string]DenyEntry, error) // entries still in force at now
+}
+
+// A revocation made at At, which stops mattering at Until
+type DenyEntry struct {
+	At    time.Time
+	Until time.Time
+}
+
+// Fire-and-forget messaging between the processes sharing a cache. A message reaches the
+// subscribers of its channel at the time it is published; nothing is stored for later.
+type PubSub interface {
+	Publish(channel string, msg []byte) error
+	Subscribe(channel string) (Subscriber, error)
+}
+
+type Subscriber interface {
+	Messages() <-chan []byte // closed once the subscriber is closed
+	Close() error
 }
@@ -0,0 +1,46 @@
+package cache
+
+import "strconv"
+
+/**
+Cache keys are "<kind>:v<version>:<id>". The kind keeps ids of different kinds apart, so a
+username can't name a session, and the version is bumped whenever the encoding of a kind
+changes, so that entries of the old shape are never decoded as the new one. Sessions written
+under the keys of an older version are still read, and rewritten under the current key, so
+that a deploy doesn't sign everyone out. They are only read during a migration window
+(RedisConfig.LegacyKeysUntil), as a miss would otherwise cost extra reads for good.
+The session indexes and the deny-list hold plain strings, and keep their own keys.
+*/
+
+const (
+	SESSION_KEY_PREFIX = "sess:"
+	USER_KEY_PREFIX    = "user:"
+	// Bump on a change to api.SessionStruct that older entries can't be decoded into
+	SESSION_KEY_VERSION = 1
+	// Bump on a change to api.User that older entries can't be decoded into. Users are
+	// not carried over, as a miss only costs a database read.
+	USER_KEY_VERSION = 1
+)
+
+func sessionKey(sid string) string {
+	return versionedKey(SESSION_KEY_PREFIX, SESSION_KEY_VERSION, sid)
+}
+
+func userKey(username string) string {
+	return versionedKey(USER_KEY_PREFIX, USER_KEY_VERSION, username)
+}
+
+// Keys a session may have been stored under by servers running an older version, newest
+// first. Before keys were versioned, a session was stored under its bare id.
+func legacySessionKeys(sid string) []string {
+	return []string{sid}
+}
+
+// Keys a user may have been stored under by servers running an older version
+func legacyUserKeys(username string) []string {
+	return []string{username}
+}
+
+func versionedKey(prefix string, version int, id string) string {
+	return prefix + "v" + strconv.Itoa(version) + ":" + id
+}
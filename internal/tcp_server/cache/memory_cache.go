@@ -0,0 +1,333 @@
+package cache
+
+import (
+	"errors"
+	"example.com/kendrick/api"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MEMORY_CACHE_SHARDS = 32
+	// how often expired entries are swept out
+	JANITOR_INTERVAL = time.Minute
+)
+
+var ERR_CACHE_MISS = errors.New("cache: key is missing")
+
+// In-process cache, for single node deployments and tests. Keys are spread over shards so
+// concurrent requests rarely contend on a lock. Each shard holds at most its share of
+// maxEntries; a full shard evicts the entry closest to expiring.
+type memoryCache struct {
+	shards  [MEMORY_CACHE_SHARDS]*shard
+	ttl     time.Duration // for users and session indexes; sessions bring their own
+	denied  map[string]DenyEntry
+	deniedM sync.Mutex
+	subs    map[string]map[*memSubscriber]struct{} // pub/sub channel to its subscribers
+	subsMu  sync.Mutex
+	stop    chan struct{}
+	once    sync.Once
+	now     func() time.Time
+}
+
+type shard struct {
+	mu         sync.RWMutex
+	items      map[string]memItem
+	maxEntries int
+}
+
+type memItem struct {
+	value   interface{}
+	expires time.Time
+}
+
+func NewMemoryCache(ttl time.Duration, maxEntries int) *memoryCache {
+	cache := newMemoryCache(ttl, maxEntries, time.Now)
+	go cache.janitor(JANITOR_INTERVAL)
+	return cache
+}
+
+func newMemoryCache(ttl time.Duration, maxEntries int, now func() time.Time) *memoryCache {
+	cache := &memoryCache{
+		ttl:    ttl,
+		denied: make(map[string]DenyEntry),
+		subs:   make(map[string]map[*memSubscriber]struct{}),
+		stop:   make(chan struct{}),
+		now:    now,
+	}
+	perShard := maxEntries / MEMORY_CACHE_SHARDS
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &shard{items: make(map[string]memItem), maxEntries: perShard}
+	}
+	return cache
+}
+
+// Sessions are stored by value, so callers can't change a cached session by accident
+func (cache *memoryCache) GetSession(sid string) (api.Session, error) {
+	value, ok := cache.get(sessionKey(sid))
+	if !ok {
+		return nil, ERR_CACHE_MISS
+	}
+	s, ok := value.(api.SessionStruct)
+	if !ok {
+		return nil, ERR_CACHE_MISS
+	}
+	return &s, nil
+}
+
+func (cache *memoryCache) SetSession(sid string, s api.Session, ttl time.Duration) error {
+	session, ok := s.(*api.SessionStruct)
+	if !ok {
+		return errors.New("cache: unsupported session type")
+	}
+	cache.set(sessionKey(sid), *session, ttl)
+	return nil
+}
+
+func (cache *memoryCache) DeleteSession(sid string) error {
+	cache.delete(sessionKey(sid))
+	return nil
+}
+
+func (cache *memoryCache) GetUser(username string) ([]api.User, error) {
+	value, ok := cache.get(userKey(username))
+	if !ok {
+		return nil, ERR_CACHE_MISS
+	}
+	users, ok := value.([]api.User)
+	if !ok {
+		return nil, ERR_CACHE_MISS
+	}
+	return append([]api.User(nil), users...), nil
+}
+
+func (cache *memoryCache) SetUser(username string, user []api.User, ttl time.Duration) error {
+	cache.set(userKey(username), append([]api.User(nil), user...), ttl)
+	return nil
+}
+
+func (cache *memoryCache) DeleteUser(username string) error {
+	cache.delete(userKey(username))
+	return nil
+}
+
+// Like the redis index, the index lives as long as the user's newest session
+func (cache *memoryCache) AddUserSession(username string, sid string, created time.Time) error {
+	key := USER_SESSIONS_PREFIX + username
+	shard := cache.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	index := make(map[string]time.Time)
+	if item, ok := shard.items[key]; ok && cache.now().Before(item.expires) {
+		for k, v := range item.value.(map[string]time.Time) {
+			index[k] = v
+		}
+	}
+	index[sid] = created
+	shard.put(key, memItem{value: index, expires: cache.now().Add(cache.ttl)}, cache.now())
+	return nil
+}
+
+func (cache *memoryCache) AddUserSessionLimited(
+	username string,
+	sid string,
+	created time.Time,
+	max int,
+	evict bool,
+	exempt []string,
+) ([]string, error) {
+	key := USER_SESSIONS_PREFIX + username
+	shard := cache.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	index := make(map[string]time.Time)
+	if item, ok := shard.items[key]; ok && cache.now().Before(item.expires) {
+		for k, v := range item.value.(map[string]time.Time) {
+			index[k] = v
+		}
+	}
+	skip := make(map[string]bool, len(exempt))
+	for _, sid := range exempt {
+		skip[sid] = true
+	}
+	var counted []string
+	for sid := range index {
+		if !skip[sid] {
+			counted = append(counted, sid)
+		}
+	}
+	var evicted []string
+	if over := len(counted) - max + 1; over > 0 {
+		if !evict {
+			return nil, ERR_USER_SESSIONS_FULL
+		}
+		sort.Slice(counted, func(i, j int) bool {
+			return index[counted[i]].Before(index[counted[j]])
+		})
+		evicted = counted[:over]
+		for _, sid := range evicted {
+			delete(index, sid)
+		}
+	}
+	index[sid] = created
+	shard.put(key, memItem{value: index, expires: cache.now().Add(cache.ttl)}, cache.now())
+	return evicted, nil
+}
+
+func (cache *memoryCache) RemoveUserSession(username string, sid string) error {
+	key := USER_SESSIONS_PREFIX + username
+	shard := cache.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	item, ok := shard.items[key]
+	if !ok {
+		return nil
+	}
+	index := make(map[string]time.Time)
+	for k, v := range item.value.(map[string]time.Time) {
+		if k != sid {
+			index[k] = v
+		}
+	}
+	item.value = index
+	shard.items[key] = item
+	return nil
+}
+
+func (cache *memoryCache) GetUserSessions(username string) ([]string, error) {
+	value, ok := cache.get(USER_SESSIONS_PREFIX + username)
+	if !ok {
+		return nil, nil
+	}
+	index := value.(map[string]time.Time)
+	ret := make([]string, 0, len(index))
+	for sid := range index {
+		ret = append(ret, sid)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return index[ret[i]].Before(index[ret[j]])
+	})
+	return ret, nil
+}
+
+func (cache *memoryCache) AddDenied(id string, at time.Time, until time.Time) error {
+	cache.deniedM.Lock()
+	defer cache.deniedM.Unlock()
+	if old, ok := cache.denied[id]; !ok || at.After(old.At) {
+		cache.denied[id] = DenyEntry{At: at, Until: until}
+	}
+	return nil
+}
+
+func (cache *memoryCache) GetDenied(now time.Time) (map[string]DenyEntry, error) {
+	cache.deniedM.Lock()
+	defer cache.deniedM.Unlock()
+	ret := make(map[string]DenyEntry)
+	for id, entry := range cache.denied {
+		if !now.Before(entry.Until) {
+			delete(cache.denied, id)
+			continue
+		}
+		ret[id] = entry
+	}
+	return ret, nil
+}
+
+// Stops the janitor. The cache stays usable.
+func (cache *memoryCache) Stop() {
+	cache.once.Do(func() {
+		close(cache.stop)
+	})
+}
+
+func (cache *memoryCache) get(key string) (interface{}, bool) {
+	shard := cache.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	item, ok := shard.items[key]
+	if !ok || !cache.now().Before(item.expires) {
+		return nil, false
+	}
+	return item.value, true
+}
+
+func (cache *memoryCache) set(key string, value interface{}, ttl time.Duration) {
+	shard := cache.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := cache.now()
+	shard.put(key, memItem{value: value, expires: now.Add(ttl)}, now)
+}
+
+func (cache *memoryCache) delete(key string) {
+	shard := cache.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.items, key)
+}
+
+func (cache *memoryCache) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return cache.shards[h.Sum32()%MEMORY_CACHE_SHARDS]
+}
+
+// Removes expired entries from every shard
+func (cache *memoryCache) sweep() {
+	now := cache.now()
+	for _, shard := range cache.shards {
+		shard.mu.Lock()
+		shard.sweep(now)
+		shard.mu.Unlock()
+	}
+}
+
+func (cache *memoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cache.sweep()
+		case <-cache.stop:
+			return
+		}
+	}
+}
+
+// Stores an item, making room if the shard is full. Callers hold the lock.
+func (s *shard) put(key string, item memItem, now time.Time) {
+	if _, ok := s.items[key]; !ok && len(s.items) >= s.maxEntries {
+		s.sweep(now)
+		if len(s.items) >= s.maxEntries {
+			s.evict()
+		}
+	}
+	s.items[key] = item
+}
+
+func (s *shard) sweep(now time.Time) {
+	for key, item := range s.items {
+		if !now.Before(item.expires) {
+			delete(s.items, key)
+		}
+	}
+}
+
+// Evicts the entry closest to expiring, which is the one the cache would lose first anyway
+func (s *shard) evict() {
+	var victim string
+	var soonest time.Time
+	found := false
+	for key, item := range s.items {
+		if !found || item.expires.Before(soonest) {
+			victim, soonest, found = key, item.expires, true
+		}
+	}
+	delete(s.items, victim)
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"example.com/kendrick/api"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	cache := newMemoryCache(time.Minute, 1000, clock.Now)
+
+	cache.SetSession("short", &api.SessionStruct{SessID: "short"}, time.Second)
+	cache.SetSession("long", &api.SessionStruct{SessID: "long"}, time.Hour)
+	cache.SetUser("kendrick", []api.User{{Username: "kendrick"}}, time.Minute)
+
+	clock.t = clock.t.Add(2 * time.Second)
+	if _, err := cache.GetSession("short"); err != ERR_CACHE_MISS {
+		t.Fatal("session should expire after its own ttl")
+	}
+	if _, err := cache.GetSession("long"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetUser("kendrick"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if _, err := cache.GetUser("kendrick"); err != ERR_CACHE_MISS {
+		t.Fatal("user should expire after its ttl")
+	}
+	cache.sweep()
+	total := 0
+	for _, shard := range cache.shards {
+		total += len(shard.items)
+	}
+	if total != 1 {
+		t.Fatalf("sweep left %v entries, want 1", total)
+	}
+}
+
+func TestMemoryCacheCopies(t *testing.T) {
+	cache := newMemoryCache(time.Minute, 1000, time.Now)
+	s := &api.SessionStruct{SessID: "sid", Claims: api.Claims{Nickname: "before"}}
+	cache.SetSession("sid", s, time.Minute)
+	s.Claims.Nickname = "after"
+
+	got, _ := cache.GetSession("sid")
+	got.(*api.SessionStruct).Claims.Nickname = "changed"
+	got, _ = cache.GetSession("sid")
+	if got.GetNickname() != "before" {
+		t.Fatal("cached sessions should not change through callers' pointers")
+	}
+}
+
+func TestMemoryCacheBounded(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	cache := newMemoryCache(time.Minute, MEMORY_CACHE_SHARDS*2, clock.Now)
+	for i := 0; i < 1000; i++ {
+		cache.SetSession(strconv.Itoa(i), &api.SessionStruct{}, time.Duration(i+1)*time.Second)
+	}
+	for _, shard := range cache.shards {
+		if len(shard.items) > 2 {
+			t.Fatalf("shard holds %v entries, bound is 2", len(shard.items))
+		}
+	}
+	// the entries closest to expiring go first
+	if _, err := cache.GetSession("999"); err != nil {
+		t.Fatal("longest lived entry should survive")
+	}
+}
+
+func TestMemoryCacheUserSessions(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	cache := newMemoryCache(time.Hour, 1000, clock.Now)
+	created := clock.Now()
+	cache.AddUserSession("kendrick", "b", created.Add(time.Second))
+	cache.AddUserSession("kendrick", "a", created)
+	cache.AddUserSession("kendrick", "c", created.Add(2*time.Second))
+	cache.RemoveUserSession("kendrick", "c")
+
+	sids, _ := cache.GetUserSessions("kendrick")
+	if len(sids) != 2 || sids[0] != "a" || sids[1] != "b" {
+		t.Fatalf("got %v, want [a b]", sids)
+	}
+	clock.t = clock.t.Add(time.Hour)
+	if sids, _ := cache.GetUserSessions("kendrick"); len(sids) != 0 {
+		t.Fatal("index should expire with the cache ttl")
+	}
+}
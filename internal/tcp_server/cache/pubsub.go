@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"github.com/go-redis/redis/v8"
+	"sync"
+)
+
+// How many messages a subscriber may fall behind by. Past that a memory subscriber misses
+// messages, and a redis subscriber holds up its connection until it catches up.
+const SUBSCRIBER_BUFFER = 64
+
+func (cache *redisCache) Publish(channel string, msg []byte) error {
+	return cache.rdb.Publish(ctx, channel, msg).Err()
+}
+
+func (cache *redisCache) Subscribe(channel string) (Subscriber, error) {
+	ps := cache.rdb.Subscribe(ctx, channel)
+	// wait for the confirmation, so that nothing published after we return is missed
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	sub := &redisSubscriber{
+		ps:       ps,
+		messages: make(chan []byte, SUBSCRIBER_BUFFER),
+		done:     make(chan struct{}),
+	}
+	go sub.forward()
+	return sub, nil
+}
+
+type redisSubscriber struct {
+	ps       *redis.PubSub
+	messages chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (sub *redisSubscriber) Messages() <-chan []byte {
+	return sub.messages
+}
+
+func (sub *redisSubscriber) Close() error {
+	var err error
+	sub.once.Do(func() {
+		close(sub.done)
+		err = sub.ps.Close()
+	})
+	return err
+}
+
+func (sub *redisSubscriber) forward() {
+	defer close(sub.messages)
+	for msg := range sub.ps.Channel() {
+		select {
+		case sub.messages <- []byte(msg.Payload):
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (cache *memoryCache) Publish(channel string, msg []byte) error {
+	cache.subsMu.Lock()
+	defer cache.subsMu.Unlock()
+	for sub := range cache.subs[channel] {
+		select {
+		case sub.messages <- append([]byte(nil), msg...):
+		default:
+			// too far behind, drop rather than stall the publisher
+		}
+	}
+	return nil
+}
+
+func (cache *memoryCache) Subscribe(channel string) (Subscriber, error) {
+	sub := &memSubscriber{
+		cache:    cache,
+		channel:  channel,
+		messages: make(chan []byte, SUBSCRIBER_BUFFER),
+	}
+	cache.subsMu.Lock()
+	defer cache.subsMu.Unlock()
+	if cache.subs[channel] == nil {
+		cache.subs[channel] = make(map[*memSubscriber]struct{})
+	}
+	cache.subs[channel][sub] = struct{}{}
+	return sub, nil
+}
+
+type memSubscriber struct {
+	cache    *memoryCache
+	channel  string
+	messages chan []byte
+	once     sync.Once
+}
+
+func (sub *memSubscriber) Messages() <-chan []byte {
+	return sub.messages
+}
+
+func (sub *memSubscriber) Close() error {
+	sub.once.Do(func() {
+		sub.cache.subsMu.Lock()
+		defer sub.cache.subsMu.Unlock()
+		delete(sub.cache.subs[sub.channel], sub)
+		close(sub.messages)
+	})
+	return nil
+}
@@ -2,89 +2,415 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"example.com/kendrick/api"
 	rcache "github.com/go-redis/cache/v8"
 	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type redisCache struct {
-	host   string
-	db     int
-	client *rcache.Cache
-	ttl    time.Duration
+	client      *rcache.Cache
+	rdb         redis.UniversalClient // for commands rcache doesn't wrap
+	ttl         time.Duration
+	legacyUntil time.Time // see RedisConfig.LegacyKeysUntil
 }
 
+const (
+	// Prefix of the sorted sets indexing each user's sessions by creation time
+	USER_SESSIONS_PREFIX = "user_sessions:"
+	// Sorted set of revoked session token ids, scored by when they stop mattering
+	DENYLIST_KEY = "session_denylist"
+)
+
+// Redis topologies
+const (
+	REDIS_STANDALONE = "standalone"
+	REDIS_SENTINEL   = "sentinel" // a master, failed over by Sentinel
+	REDIS_CLUSTER    = "cluster"
+)
+
 var ctx context.Context = context.TODO()
 
-func NewRedisCache(host string, db int, ttl time.Duration) *redisCache {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:            host,
-		DB:              db,
-		Password:        "", // no password set
-		MaxRetries:      3,
-		MinRetryBackoff: time.Millisecond * 8,
-		MaxRetryBackoff: time.Millisecond * 512,
-	})
-	_, err := rdb.Ping(ctx).Result()
+// Where Redis is and how to connect to it
+type RedisConfig struct {
+	Mode             string   // see REDIS_*
+	Addrs            []string // host:port of the server, of the sentinels, or of some cluster nodes
+	MasterName       string   // of the master the sentinels watch
+	DB               int      // always 0 on a cluster
+	Username         string   // of a Redis 6 ACL user, empty for the default user
+	Password         string
+	SentinelPassword string
+	TLS              *tls.Config // nil for plain TCP
+	// How long NewRedisCache waits for Redis to answer. A Redis still down after that is
+	// connected to once it is up.
+	StartupWait time.Duration
+	// Until when entries under the keys of older servers are read and deleted too. Zero
+	// never looks at them. Past the window, no live session can be under an older key.
+	LegacyKeysUntil time.Time
+}
+
+func DefaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		Mode:        REDIS_STANDALONE,
+		Addrs:       []string{"localhost:6379"},
+		StartupWait: 30 * time.Second,
+	}
+}
+
+// Returns a cache in the Redis of config. Fails on a config that can't work, not on a
+// Redis that is down.
+func NewRedisCache(config RedisConfig, ttl time.Duration) (*redisCache, error) {
+	rdb, err := newRedisClient(config)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
+	}
+	if err := waitForRedis(rdb, config.StartupWait); err != nil {
+		log.Warn("Redis is not up yet, starting without it: ", err)
 	}
 
+	// no local cache: a session revoked or a user written through one server must be seen
+	// by every other server at once, not once a local copy expires
 	mycache := rcache.New(&rcache.Options{
-		Redis:      rdb,
-		LocalCache: rcache.NewTinyLFU(1000, ttl),
+		Redis: rdb,
 	})
 
 	return &redisCache{
-		host:   host,
-		db:     db,
-		client: mycache,
-		ttl:    ttl,
+		client:      mycache,
+		rdb:         rdb,
+		ttl:         ttl,
+		legacyUntil: config.LegacyKeysUntil,
+	}, nil
+}
+
+func newRedisClient(config RedisConfig) (redis.UniversalClient, error) {
+	if len(config.Addrs) == 0 {
+		return nil, errors.New("No Redis address given")
+	}
+	switch config.Mode {
+	case REDIS_STANDALONE:
+		if len(config.Addrs) > 1 {
+			return nil, errors.New("A standalone Redis has one address, got " + strings.Join(config.Addrs, ","))
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:            config.Addrs[0],
+			DB:              config.DB,
+			Username:        config.Username,
+			Password:        config.Password,
+			TLSConfig:       config.TLS,
+			MaxRetries:      3,
+			MinRetryBackoff: time.Millisecond * 8,
+			MaxRetryBackoff: time.Millisecond * 512,
+		}), nil
+	case REDIS_SENTINEL:
+		if config.MasterName == "" {
+			return nil, errors.New("Redis Sentinel needs the name of the master")
+		}
+		// each new connection asks the sentinels for the master, so a failover is
+		// followed as soon as the old master's connections break
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.MasterName,
+			SentinelAddrs:    config.Addrs,
+			SentinelPassword: config.SentinelPassword,
+			DB:               config.DB,
+			Username:         config.Username,
+			Password:         config.Password,
+			TLSConfig:        config.TLS,
+			MaxRetries:       3,
+			MinRetryBackoff:  time.Millisecond * 8,
+			MaxRetryBackoff:  time.Millisecond * 512,
+		}), nil
+	case REDIS_CLUSTER:
+		if config.DB != 0 {
+			return nil, errors.New("Redis Cluster only has database 0")
+		}
+		// keys of one command or transaction must share a hash slot, as they each name one key
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           config.Addrs,
+			Username:        config.Username,
+			Password:        config.Password,
+			TLSConfig:       config.TLS,
+			MaxRetries:      3,
+			MinRetryBackoff: time.Millisecond * 8,
+			MaxRetryBackoff: time.Millisecond * 512,
+		}), nil
+	}
+	return nil, errors.New("Unknown Redis mode " + config.Mode)
+}
+
+// Pings Redis until it answers or wait is up, backing off between pings
+func waitForRedis(rdb redis.UniversalClient, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	delay := 50 * time.Millisecond
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := rdb.Ping(pingCtx).Err()
+		cancel()
+		if err == nil || !time.Now().Add(delay).Before(deadline) {
+			return err
+		}
+		log.Info("Waiting for Redis: ", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 2*time.Second {
+			delay = 2 * time.Second
+		}
 	}
 }
 
-// Gets the user associated with a session id (the key).
-func (cache *redisCache) GetSession(key string) (api.Session, error) {
+// Gets the session with the given id, reading it from an older key if need be
+func (cache *redisCache) GetSession(sid string) (api.Session, error) {
 	var s api.SessionStruct
-	err := cache.client.Get(ctx, key, &s)
+	err := cache.client.Get(ctx, sessionKey(sid), &s)
+	if err == rcache.ErrCacheMiss {
+		return cache.getLegacySession(sid)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &s, nil
 }
 
-func (cache *redisCache) SetSession(uuid string, s api.Session) error {
+// Reads a session stored under an older key, and copies it to the current key for the time
+// it has left. The old entry is left to expire, as servers not yet upgraded still read it.
+func (cache *redisCache) getLegacySession(sid string) (api.Session, error) {
+	for _, key := range cache.legacyKeys(legacySessionKeys(sid)) {
+		b, err := cache.rdb.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s api.SessionStruct
+		// an entry that can't be read is a miss, so only its user has to log in again
+		if err := cache.client.Unmarshal(b, &s); err != nil {
+			log.Warn("Skipping unreadable session at ", key, ": ", err)
+			continue
+		}
+		ttl, err := cache.rdb.PTTL(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ttl == -1:
+			// kept with no expiry
+			ttl = cache.ttl
+		case ttl <= 0:
+			// -2: expired since it was read
+			continue
+		}
+		if err := cache.SetSession(sid, &s, ttl); err != nil {
+			log.Error(err)
+		}
+		return &s, nil
+	}
+	return nil, rcache.ErrCacheMiss
+}
+
+func (cache *redisCache) SetSession(sid string, s api.Session, ttl time.Duration) error {
 	err := cache.client.Set(&rcache.Item{
 		Ctx:   ctx,
-		Key:   uuid,
+		Key:   sessionKey(sid),
 		Value: s,
-		TTL:   cache.ttl,
+		TTL:   ttl,
 	})
 	return err
 }
 
+// Deletes the session under its older keys too, or reading them would bring it back
 func (cache *redisCache) DeleteSession(sid string) error {
-	err := cache.client.Delete(ctx, sid)
-	return err
+	return cache.delete(sessionKey(sid), cache.legacyKeys(legacySessionKeys(sid)))
 }
 
-func (cache *redisCache) GetUser(key string) ([]api.User, error) {
+func (cache *redisCache) GetUser(username string) ([]api.User, error) {
 	var users []api.User
-	err := cache.client.Get(ctx, key, &users)
+	err := cache.client.Get(ctx, userKey(username), &users)
+	if err == rcache.ErrCacheMiss {
+		return nil, ERR_CACHE_MISS
+	}
 	if err != nil {
 		return nil, err
 	}
 	return users, err
 }
 
-func (cache *redisCache) SetUser(username string, user []api.User) error {
+func (cache *redisCache) SetUser(username string, user []api.User, ttl time.Duration) error {
 	err := cache.client.Set(&rcache.Item{
 		Ctx:   ctx,
-		Key:   username,
+		Key:   userKey(username),
 		Value: user,
-		TTL:   cache.ttl,
+		TTL:   ttl,
+	})
+	return err
+}
+
+// Deletes the user under its older keys too, which servers not yet upgraded still read
+func (cache *redisCache) DeleteUser(username string) error {
+	return cache.delete(userKey(username), cache.legacyKeys(legacyUserKeys(username)))
+}
+
+// Returns keys, the older keys of an entry, within the migration window and none after it
+func (cache *redisCache) legacyKeys(keys []string) []string {
+	if time.Now().After(cache.legacyUntil) {
+		return nil
+	}
+	return keys
+}
+
+// Deletes a key and its older forms one at a time, as a cluster may hold them on
+// different nodes
+func (cache *redisCache) delete(key string, legacy []string) error {
+	err := cache.client.Delete(ctx, key)
+	for _, key := range legacy {
+		if legacyErr := cache.client.Delete(ctx, key); err == nil {
+			err = legacyErr
+		}
+	}
+	return err
+}
+
+// Adds a session to its user's index. The index lives as long as the user's newest session.
+func (cache *redisCache) AddUserSession(username string, sid string, created time.Time) error {
+	key := USER_SESSIONS_PREFIX + username
+	pipe := cache.rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{
+		Score:  float64(toMillis(created)),
+		Member: sid,
+	})
+	pipe.Expire(ctx, key, cache.ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Counts, evicts and indexes in one script, so servers logging a user in at the same time
+// can't overshoot the limit together. A nil reply means the user is full.
+var addUserSessionLimited = redis.NewScript(`
+local exempt = {}
+for i = 6, #ARGV do
+	exempt[ARGV[i]] = true
+end
+local counted = {}
+for _, sid in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if not exempt[sid] then
+		table.insert(counted, sid)
+	end
+end
+local evicted = {}
+local over = #counted - tonumber(ARGV[3]) + 1
+if over > 0 then
+	if ARGV[4] ~= '1' then
+		return false
+	end
+	for i = 1, over do
+		redis.call('ZREM', KEYS[1], counted[i])
+		table.insert(evicted, counted[i])
+	end
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return evicted
+`)
+
+func (cache *redisCache) AddUserSessionLimited(
+	username string,
+	sid string,
+	created time.Time,
+	max int,
+	evict bool,
+	exempt []string,
+) ([]string, error) {
+	evictArg := "0"
+	if evict {
+		evictArg = "1"
+	}
+	args := []interface{}{sid, toMillis(created), max, evictArg, cache.ttl.Milliseconds()}
+	for _, sid := range exempt {
+		args = append(args, sid)
+	}
+	reply, err := addUserSessionLimited.Run(ctx, cache.rdb, []string{USER_SESSIONS_PREFIX + username}, args...).Result()
+	if err == redis.Nil {
+		return nil, ERR_USER_SESSIONS_FULL
+	}
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	evicted := make([]string, 0, len(members))
+	for _, member := range members {
+		if sid, ok := member.(string); ok {
+			evicted = append(evicted, sid)
+		}
+	}
+	return evicted, nil
+}
+
+func (cache *redisCache) RemoveUserSession(username string, sid string) error {
+	return cache.rdb.ZRem(ctx, USER_SESSIONS_PREFIX+username, sid).Err()
+}
+
+func (cache *redisCache) GetUserSessions(username string) ([]string, error) {
+	return cache.rdb.ZRange(ctx, USER_SESSIONS_PREFIX+username, 0, -1).Result()
+}
+
+func (cache *redisCache) Stop() {
+	if err := cache.rdb.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// Deny-list members are "id|at" with at in unix ms, so re-denying an id adds a member
+func (cache *redisCache) AddDenied(id string, at time.Time, until time.Time) error {
+	pipe := cache.rdb.TxPipeline()
+	pipe.ZAdd(ctx, DENYLIST_KEY, &redis.Z{
+		Score:  float64(toMillis(until)),
+		Member: id + "|" + strconv.FormatInt(toMillis(at), 10),
 	})
+	// drop the entries that stopped mattering before this one was made
+	pipe.ZRemRangeByScore(ctx, DENYLIST_KEY, "-inf", "("+strconv.FormatInt(toMillis(at), 10))
+	_, err := pipe.Exec(ctx)
 	return err
 }
+
+func (cache *redisCache) GetDenied(now time.Time) (map[string]DenyEntry, error) {
+	members, err := cache.rdb.ZRangeByScoreWithScores(ctx, DENYLIST_KEY, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(toMillis(now), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]DenyEntry, len(members))
+	for _, z := range members {
+		member, _ := z.Member.(string)
+		sep := strings.LastIndex(member, "|")
+		if sep < 0 {
+			log.Warn("Skipping malformed deny-list member ", member)
+			continue
+		}
+		at, err := strconv.ParseInt(member[sep+1:], 10, 64)
+		if err != nil {
+			log.Warn("Skipping malformed deny-list member ", member)
+			continue
+		}
+		id := member[:sep]
+		entry := DenyEntry{At: fromMillis(at), Until: fromMillis(int64(z.Score))}
+		// keep the latest revocation of an id
+		if old, ok := ret[id]; ok && old.At.After(entry.At) {
+			continue
+		}
+		ret[id] = entry
+	}
+	return ret, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,457 @@
+package cache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"example.com/kendrick/api"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	rcache "github.com/go-redis/cache/v8"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRedisCache(t *testing.T, config RedisConfig) *redisCache {
+	t.Helper()
+	cache, err := NewRedisCache(config, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Stop)
+	return cache
+}
+
+func runRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+// Sets a user and reads it back
+func roundTrip(cache *redisCache, username string) error {
+	if err := cache.SetUser(username, []api.User{{Username: username}}, time.Minute); err != nil {
+		return err
+	}
+	users, err := cache.GetUser(username)
+	if err == nil && (len(users) != 1 || users[0].Username != username) {
+		return ERR_CACHE_MISS
+	}
+	return err
+}
+
+func TestRedisConfigErrors(t *testing.T) {
+	configs := map[string]RedisConfig{
+		"no address":      {Mode: REDIS_STANDALONE},
+		"two addresses":   {Mode: REDIS_STANDALONE, Addrs: []string{"a:6379", "b:6379"}},
+		"no master name":  {Mode: REDIS_SENTINEL, Addrs: []string{"a:26379"}},
+		"cluster with db": {Mode: REDIS_CLUSTER, Addrs: []string{"a:6379"}, DB: 1},
+		"unknown mode":    {Mode: "ring", Addrs: []string{"a:6379"}},
+	}
+	for name, config := range configs {
+		if _, err := NewRedisCache(config, time.Minute); err == nil {
+			t.Errorf("%v: should be refused", name)
+		}
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	m := runRedis(t)
+	m.RequireUserAuth("kendrick", "secret")
+
+	config := RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}, Username: "kendrick", Password: "wrong"}
+	if err := roundTrip(newTestRedisCache(t, config), "alice"); err == nil {
+		t.Fatal("a wrong password should be refused")
+	}
+	config.Password = "secret"
+	if err := roundTrip(newTestRedisCache(t, config), "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	cert, roots := selfSigned(t)
+	m, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	config := RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}, TLS: &tls.Config{RootCAs: roots}}
+	if err := roundTrip(newTestRedisCache(t, config), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// a certificate that isn't trusted is refused
+	config.TLS = &tls.Config{RootCAs: x509.NewCertPool()}
+	if err := roundTrip(newTestRedisCache(t, config), "bob"); err == nil {
+		t.Fatal("an untrusted certificate should be refused")
+	}
+}
+
+func TestRedisReconnects(t *testing.T) {
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}})
+	if err := roundTrip(cache, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+	if _, err := cache.GetUser("alice"); err == nil {
+		t.Fatal("Redis is down")
+	}
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := cache.GetUser("alice"); err != nil || users[0].Username != "alice" {
+		t.Fatalf("got %v, %v", users, err)
+	}
+}
+
+func TestRedisStartsLate(t *testing.T) {
+	addr := freeAddr(t)
+	m := miniredis.NewMiniRedis()
+	defer m.Close()
+
+	// not waiting at all, the cache is still made
+	config := RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{addr}}
+	cache := newTestRedisCache(t, config)
+	if err := roundTrip(cache, "alice"); err == nil {
+		t.Fatal("Redis is not up yet")
+	}
+
+	// waiting, the cache is made once Redis is up
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := m.StartAddr(addr); err != nil {
+			t.Error(err)
+		}
+	}()
+	config.StartupWait = 10 * time.Second
+	start := time.Now()
+	waited := newTestRedisCache(t, config)
+	if time.Since(start) >= config.StartupWait {
+		t.Fatal("should stop waiting once Redis is up")
+	}
+	if err := roundTrip(waited, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	// and the one made before connects too
+	if err := roundTrip(cache, "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	m1 := runRedis(t)
+	m2 := runRedis(t)
+	sentinel := newFakeSentinel(t, "mymaster", m1.Addr())
+
+	cache := newTestRedisCache(t, RedisConfig{
+		Mode:       REDIS_SENTINEL,
+		Addrs:      []string{sentinel.addr()},
+		MasterName: "mymaster",
+	})
+	if err := roundTrip(cache, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !m1.Exists(userKey("alice")) {
+		t.Fatal("should write to the first master")
+	}
+
+	// the sentinels promote m2, and m1 goes away
+	sentinel.setMaster(m2.Addr())
+	m1.Close()
+	if err := roundTrip(cache, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if !m2.Exists(userKey("bob")) {
+		t.Fatal("should write to the new master")
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	// a miniredis is a cluster of one node owning every slot
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{Mode: REDIS_CLUSTER, Addrs: []string{m.Addr()}})
+	if err := roundTrip(cache, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// transactions name a single key
+	now := time.Now()
+	if err := cache.AddUserSession("alice", "s1", now); err != nil {
+		t.Fatal(err)
+	}
+	if sids, err := cache.GetUserSessions("alice"); err != nil || len(sids) != 1 || sids[0] != "s1" {
+		t.Fatalf("got %v, %v", sids, err)
+	}
+	if err := cache.AddDenied("t1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if denied, err := cache.GetDenied(now); err != nil || len(denied) != 1 {
+		t.Fatalf("got %v, %v", denied, err)
+	}
+}
+
+func TestRedisUserSessionLimit(t *testing.T) {
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}})
+	start := time.Unix(1600000000, 0)
+	for i, sid := range []string{"s1", "admin", "s2"} {
+		if err := cache.AddUserSession("alice", sid, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exempt := []string{"admin"}
+
+	if _, err := cache.AddUserSessionLimited("alice", "s3", start.Add(time.Minute), 2, false, exempt); err != ERR_USER_SESSIONS_FULL {
+		t.Fatalf("got %v", err)
+	}
+	evicted, err := cache.AddUserSessionLimited("alice", "s3", start.Add(time.Minute), 2, true, exempt)
+	if err != nil || len(evicted) != 1 || evicted[0] != "s1" {
+		t.Fatalf("got %v, %v", evicted, err)
+	}
+	if sids, _ := cache.GetUserSessions("alice"); len(sids) != 3 || sids[0] != "admin" || sids[2] != "s3" {
+		t.Fatalf("got %v", sids)
+	}
+	if ttl := m.TTL(USER_SESSIONS_PREFIX + "alice"); ttl != time.Minute {
+		t.Fatalf("got ttl %v", ttl)
+	}
+	// room to spare evicts nothing
+	if evicted, err := cache.AddUserSessionLimited("bob", "s1", start, 2, true, nil); err != nil || len(evicted) != 0 {
+		t.Fatalf("got %v, %v", evicted, err)
+	}
+}
+
+func TestRedisSessionRevokedEverywhere(t *testing.T) {
+	m := runRedis(t)
+	config := RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}}
+	// two servers sharing a Redis
+	first, second := newTestRedisCache(t, config), newTestRedisCache(t, config)
+	if err := first.SetSession("s1", &api.SessionStruct{SessID: "s1"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.GetSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.DeleteSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.GetSession("s1"); err == nil {
+		t.Fatal("a session revoked on one server must be gone on the others")
+	}
+}
+
+func TestRedisKeyKinds(t *testing.T) {
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}})
+
+	// a username that is also a session id
+	id := "0b8a4c4e-6a3b-4b8e-9d4f-2f1c3d5e7a9b"
+	if err := cache.SetSession(id, &api.SessionStruct{SessID: id, Claims: api.Claims{Username: "alice"}}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetUser(id, []api.User{{Username: id}}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := cache.GetSession(id); err != nil || s.GetUsername() != "alice" {
+		t.Fatalf("got %v, %v", s, err)
+	}
+	if !m.Exists(SESSION_KEY_PREFIX+"v1:"+id) || !m.Exists(USER_KEY_PREFIX+"v1:"+id) {
+		t.Fatalf("got keys %v", m.Keys())
+	}
+}
+
+func TestRedisLegacySessions(t *testing.T) {
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{
+		Mode:            REDIS_STANDALONE,
+		Addrs:           []string{m.Addr()},
+		LegacyKeysUntil: time.Now().Add(time.Hour),
+	})
+	// as written by a server from before keys were versioned
+	old := rcache.New(&rcache.Options{Redis: cache.rdb})
+	err := old.Set(&rcache.Item{
+		Ctx:   ctx,
+		Key:   "s1",
+		Value: &api.SessionStruct{SessID: "s1", Claims: api.Claims{Username: "alice"}},
+		TTL:   10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := cache.GetSession("s1"); err != nil || s.GetUsername() != "alice" {
+		t.Fatalf("got %v, %v", s, err)
+	}
+	// copied for the time it has left, and left for servers not yet upgraded
+	if ttl := m.TTL(sessionKey("s1")); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Fatalf("got ttl %v", ttl)
+	}
+	if !m.Exists("s1") {
+		t.Fatal("the old entry should be kept")
+	}
+
+	// deleting removes both, so the old one can't bring the session back
+	if err := cache.DeleteSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetSession("s1"); err == nil {
+		t.Fatal("the session was deleted")
+	}
+	if m.Exists("s1") {
+		t.Fatal("the old entry should be deleted")
+	}
+
+	// an entry that can't be decoded is a miss
+	m.Set("s2", "not msgpack")
+	if _, err := cache.GetSession("s2"); err != rcache.ErrCacheMiss {
+		t.Fatalf("got %v", err)
+	}
+
+	// an entry kept with no expiry is copied for the cache's own ttl
+	b, err := old.Marshal(&api.SessionStruct{SessID: "s3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set("s3", string(b))
+	if _, err := cache.GetSession("s3"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(sessionKey("s3")); ttl != time.Minute {
+		t.Fatalf("got ttl %v", ttl)
+	}
+}
+
+func TestRedisLegacySessionsWindow(t *testing.T) {
+	m := runRedis(t)
+	cache := newTestRedisCache(t, RedisConfig{
+		Mode:            REDIS_STANDALONE,
+		Addrs:           []string{m.Addr()},
+		LegacyKeysUntil: time.Now().Add(-time.Second),
+	})
+	old := rcache.New(&rcache.Options{Redis: cache.rdb})
+	err := old.Set(&rcache.Item{Ctx: ctx, Key: "s1", Value: &api.SessionStruct{SessID: "s1"}, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// past the window, older keys are neither read nor deleted
+	if _, err := cache.GetSession("s1"); err != rcache.ErrCacheMiss {
+		t.Fatalf("got %v", err)
+	}
+	if err := cache.DeleteSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exists("s1") {
+		t.Fatal("the old entry should be left alone")
+	}
+}
+
+// A sentinel watching one master, which the test fails over by hand
+type fakeSentinel struct {
+	srv    *server.Server
+	mu     sync.Mutex
+	master string
+}
+
+func newFakeSentinel(t *testing.T, name string, master string) *fakeSentinel {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	s := &fakeSentinel{srv: srv, master: master}
+	srv.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+	srv.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		switch {
+		case len(args) == 2 && args[0] == "get-master-addr-by-name" && args[1] == name:
+			host, port, _ := net.SplitHostPort(s.getMaster())
+			c.WriteLen(2)
+			c.WriteBulk(host)
+			c.WriteBulk(port)
+		case len(args) == 2 && args[0] == "sentinels":
+			c.WriteLen(0)
+		default:
+			c.WriteError("ERR unsupported")
+		}
+	})
+	// failovers are not announced, only found on reconnecting
+	srv.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		for i, channel := range args {
+			c.WriteLen(3)
+			c.WriteBulk("subscribe")
+			c.WriteBulk(channel)
+			c.WriteInt(i + 1)
+		}
+	})
+	return s
+}
+
+func (s *fakeSentinel) addr() string {
+	return s.srv.Addr().String()
+}
+
+func (s *fakeSentinel) getMaster() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master
+}
+
+func (s *fakeSentinel) setMaster(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.master = addr
+}
+
+// An address nothing listens on yet
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// A certificate for 127.0.0.1, and a pool trusting it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
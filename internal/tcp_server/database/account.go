@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// A successful login, kept so users can see where their account was used
+type Login struct {
+	Username    string
+	At          time.Time
+	IP          string
+	UserAgent   string
+	AuthMethods []string // see api.AUTH_METHOD_*
+}
+
+// Tables holding a user's data besides users, emptied when the user is purged
+var userTables = []string{"login_history", "remember_tokens", "recovery_codes", "totp_secrets"}
+
+// Marks a user deleted. The user can no longer be found, but their data is kept until
+// PurgeUser, so a deletion can still be undone by hand.
+func (db *DBStruct) DeleteUser(ctx context.Context, username string, at time.Time) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, DELETE_USER, at, username)
+	if utils.IsError(err) {
+		return 0
+	}
+	log.Info("DELETE user: username: " + username)
+	if rows == 1 {
+		db.wrote(username)
+		db.users.invalidate(username)
+	}
+	return rows
+}
+
+// Returns the users deleted at or before a time
+func (db *DBStruct) GetDeletedUsers(ctx context.Context, before time.Time) ([]string, error) {
+	db.ensureConnected()
+	primary, _ := db.pools()
+	var ret []string
+	err := db.query(ctx, primary, GET_DELETED, func(rows *sql.Rows) error {
+		ret = nil
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err != nil {
+				return err
+			}
+			ret = append(ret, username)
+		}
+		return nil
+	}, before)
+	if utils.IsError(err) {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Erases a deleted user and all their data, in a single transaction. Returns 1 if the user
+// was erased, 0 if there is no such deleted user.
+func (db *DBStruct) PurgeUser(ctx context.Context, username string) int64 {
+	db.ensureConnected()
+	var rows int64
+	err := db.transaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE username = ? AND deleted_at IS NOT NULL", username)
+		if err != nil {
+			return err
+		}
+		rows, err = result.RowsAffected()
+		if err != nil || rows != 1 {
+			return err
+		}
+		for _, table := range userTables {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE username = ?", username); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if utils.IsError(err) || rows != 1 {
+		return 0
+	}
+	log.Info("PURGE user: username: " + username)
+	return rows
+}
+
+// Records a login, which becomes the user's last
+func (db *DBStruct) InsertLogin(ctx context.Context, login *Login) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, INSERT_LOGIN,
+		login.Username, login.At, login.IP, login.UserAgent, strings.Join(login.AuthMethods, ","))
+	if utils.IsError(err) {
+		return 0
+	}
+	_, err = db.exec(ctx, SET_LAST_LOGIN, login.At, login.Username)
+	if utils.IsError(err) {
+		return rows
+	}
+	db.wrote(login.Username)
+	db.users.invalidate(login.Username)
+	return rows
+}
+
+// Returns a user's logins, newest first
+func (db *DBStruct) GetLogins(ctx context.Context, username string) ([]Login, error) {
+	db.ensureConnected()
+	primary, _ := db.pools()
+	var ret []Login
+	err := db.query(ctx, primary, GET_LOGINS, func(rows *sql.Rows) error {
+		ret = nil
+		for rows.Next() {
+			var login Login
+			var methods string
+			if err := rows.Scan(&login.Username, &login.At, &login.IP, &login.UserAgent, &methods); err != nil {
+				return err
+			}
+			if methods != "" {
+				login.AuthMethods = strings.Split(methods, ",")
+			}
+			ret = append(ret, login)
+		}
+		return nil
+	}, username)
+	if utils.IsError(err) {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+)
+
+// rolls back a dry run once every user has been tried
+var errDryRun = errors.New("Dry run")
+
+// Inserts users in a single transaction. Returns for each user whether it was inserted,
+// false if the username is taken, including by an earlier user in the batch. On an error
+// nothing is inserted. A dry run reports the same but rolls the transaction back.
+func (db *DBStruct) ImportUsers(ctx context.Context, users []api.User, dryRun bool) ([]bool, error) {
+	db.ensureConnected()
+	var inserted []bool
+	createdAt := db.now()
+	err := db.transaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		inserted = make([]bool, len(users))
+		stmt, err := tx.PrepareContext(ctx, db.driver.queries[INSERT_USER])
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, user := range users {
+			// a failed statement doesn't end the transaction, only the row is skipped
+			_, err := stmt.ExecContext(ctx, user.Username, user.Nickname, user.PwHash,
+				optional(user.ProfilePic), optional(user.Email), optional(user.Bio), optional(user.Timezone), createdAt)
+			if db.driver.isDuplicate(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			inserted[i] = true
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return inserted, nil
+	}
+	if utils.IsError(err) {
+		return nil, err
+	}
+	count := 0
+	for i, user := range users {
+		if inserted[i] {
+			count++
+			db.wrote(user.Username)
+			db.users.invalidate(user.Username)
+		}
+	}
+	log.Info("IMPORT users: " + strconv.Itoa(count) + " of " + strconv.Itoa(len(users)))
+	return inserted, nil
+}
+
+// Returns up to limit users with usernames after the given one, in username order, so
+// that all users can be read a page at a time. Deleted users are left out.
+func (db *DBStruct) GetUsers(ctx context.Context, after string, limit int) ([]api.User, error) {
+	db.ensureConnected()
+	primary, _ := db.pools()
+	var ret []api.User
+	err := db.query(ctx, primary, GET_USERS, func(rows *sql.Rows) error {
+		ret = nil
+		for rows.Next() {
+			var row userRow
+			if err := rows.Scan(row.dest()...); err != nil {
+				return err
+			}
+			ret = append(ret, row.toUser())
+		}
+		return nil
+	}, after, limit)
+	if utils.IsError(err) {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Stores an empty field as NULL
+func optional(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,413 @@
+package database
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"example.com/kendrick/internal/tcp_server/security"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The behaviour every DB implementation must share. Usernames are random, so the suite can
+// run against a database that outlives it.
+func testContract(t *testing.T, newDB func(t *testing.T) DB) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, newDB(t)) })
+	t.Run("Totp", func(t *testing.T) { testTotp(t, newDB(t)) })
+	t.Run("RememberTokens", func(t *testing.T) { testRememberTokens(t, newDB(t)) })
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, newDB(t)) })
+	t.Run("Import", func(t *testing.T) { testImport(t, newDB(t)) })
+	t.Run("SecurityEvents", func(t *testing.T) { testSecurityEvents(t, newDB(t)) })
+}
+
+func TestMemoryDB(t *testing.T) {
+	testContract(t, func(t *testing.T) DB {
+		return NewMemoryDB()
+	})
+}
+
+func TestSQLiteDB(t *testing.T) {
+	testContract(t, func(t *testing.T) DB {
+		userCache := cache.NewMemoryCache(time.Minute, 1000)
+		db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "users.db"), userCache, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Disconnect()
+			userCache.Stop()
+		})
+		return db
+	})
+}
+
+// Needs the MySQL server of configs/dbPw.txt
+func TestMySQLDB(t *testing.T) {
+	if os.Getenv("MYSQL_TESTS") == "" {
+		t.Skip("set MYSQL_TESTS=1 to run against MySQL")
+	}
+	testContract(t, func(t *testing.T) DB {
+		userCache := cache.NewMemoryCache(time.Minute, 1000)
+		db, err := NewDB(userCache, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Disconnect()
+			userCache.Stop()
+		})
+		return db
+	})
+}
+
+func newUsername() string {
+	return "test_" + security.RandomToken(8)
+}
+
+func testUsers(t *testing.T, db DB) {
+	ctx := context.Background()
+	username := newUsername()
+	start := time.Now().Add(-time.Second)
+	if _, err := db.GetUser(ctx, username); err != ERR_USER_NOT_FOUND {
+		t.Fatalf("unknown user: got %v", err)
+	}
+	if db.InsertUser(ctx, username, "hash", "nick") != 1 {
+		t.Fatal("insert failed")
+	}
+	if db.InsertUser(ctx, username, "other", "other") != 0 {
+		t.Fatal("duplicate insert should affect no rows")
+	}
+	user, err := db.GetUser(ctx, username)
+	if err != nil || user.Username != username || user.PwHash != "hash" || user.Nickname != "nick" || user.ProfilePic != "" ||
+		user.Version != 1 || user.CreatedAt.Before(start) || !user.LastLoginAt.IsZero() {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+
+	if db.UpdateUser(ctx, username, patch("new nick", "pic.png"), 1) != 1 || db.UpdatePassword(ctx, username, "new hash") != 1 {
+		t.Fatal("update failed")
+	}
+	user, _ = db.GetUser(ctx, username)
+	if user.Nickname != "new nick" || user.ProfilePic != "pic.png" || user.PwHash != "new hash" || user.Version != 2 {
+		t.Fatalf("update not visible: %+v", user)
+	}
+	if db.UpdateUser(ctx, username, patch("stale nick", ""), 1) != 0 {
+		t.Fatal("an edit of an outdated version should affect no rows")
+	}
+	bio, timezone := "hello", "Asia/Singapore"
+	if db.UpdateUser(ctx, username, &ProfilePatch{Bio: &bio, Timezone: &timezone}, 2) != 1 {
+		t.Fatal("update failed")
+	}
+	user, _ = db.GetUser(ctx, username)
+	if user.Nickname != "new nick" || user.ProfilePic != "pic.png" || user.Email != "" || user.Bio != bio ||
+		user.Timezone != timezone || user.Version != 3 {
+		t.Fatalf("only the fields patched should change, got %+v", user)
+	}
+	user.Nickname = "changed by caller"
+	if again, _ := db.GetUser(ctx, username); again.Nickname != "new nick" {
+		t.Fatal("callers must not be able to change stored users")
+	}
+	if db.UpdateUser(ctx, newUsername(), patch("nick", ""), 1) != 0 || db.UpdatePassword(ctx, newUsername(), "hash") != 0 {
+		t.Fatal("updating an unknown user should affect no rows")
+	}
+}
+
+func testTotp(t *testing.T, db DB) {
+	ctx := context.Background()
+	username := newUsername()
+	db.InsertUser(ctx, username, "hash", "nick")
+	if _, err := db.GetTotp(ctx, username); err != ERR_TOTP_NOT_FOUND {
+		t.Fatalf("no secret: got %v", err)
+	}
+	if db.SetTotpSecret(ctx, username, "first") == 0 || db.SetTotpSecret(ctx, username, "second") == 0 {
+		t.Fatal("a secret that isn't enabled can be replaced")
+	}
+	if db.UseRecoveryCode(ctx, username, "code1") != 0 {
+		t.Fatal("no recovery codes before enabling")
+	}
+	if db.EnableTotp(ctx, username, []string{"code1", "code2"}) != 1 {
+		t.Fatal("enable failed")
+	}
+	if db.EnableTotp(ctx, username, []string{"code3"}) != 0 {
+		t.Fatal("enabling twice should fail")
+	}
+	if db.SetTotpSecret(ctx, username, "third") != 0 {
+		t.Fatal("an enabled secret must not be replaced")
+	}
+	secret, err := db.GetTotp(ctx, username)
+	if err != nil || secret.Username != username || secret.Secret != "second" || !secret.Enabled {
+		t.Fatalf("got %+v, %v", secret, err)
+	}
+
+	if db.UseTotpStep(ctx, username, 100) != 1 || db.UseTotpStep(ctx, username, 100) != 0 || db.UseTotpStep(ctx, username, 99) != 0 {
+		t.Fatal("each time step is accepted once, in order")
+	}
+	if db.UseTotpStep(ctx, username, 101) != 1 || db.UseTotpStep(ctx, newUsername(), 200) != 0 {
+		t.Fatal("only later steps of users with a secret are accepted")
+	}
+	if secret, _ := db.GetTotp(ctx, username); secret.LastStep != 101 {
+		t.Fatalf("got last step %v", secret.LastStep)
+	}
+
+	if db.UseRecoveryCode(ctx, username, "code1") != 1 {
+		t.Fatal("recovery code rejected")
+	}
+	if db.UseRecoveryCode(ctx, username, "code1") != 0 {
+		t.Fatal("recovery codes are single use")
+	}
+	if db.UseRecoveryCode(ctx, username, "code3") != 0 || db.UseRecoveryCode(ctx, newUsername(), "code2") != 0 {
+		t.Fatal("unknown recovery code accepted")
+	}
+}
+
+func testRememberTokens(t *testing.T, db DB) {
+	ctx := context.Background()
+	username := newUsername()
+	family := security.RandomToken(12)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	first := &RememberToken{
+		Selector:      security.RandomToken(12),
+		ValidatorHash: "validator",
+		Family:        family,
+		Username:      username,
+		Expires:       expires,
+	}
+	second := *first
+	second.Selector = security.RandomToken(12)
+	other := *first
+	other.Selector = security.RandomToken(12)
+	other.Family = security.RandomToken(12)
+
+	if _, err := db.GetRememberToken(ctx, first.Selector); err != ERR_REMEMBER_TOKEN_NOT_FOUND {
+		t.Fatalf("unknown token: got %v", err)
+	}
+	for _, token := range []*RememberToken{first, &second, &other} {
+		if db.InsertRememberToken(ctx, token) != 1 {
+			t.Fatal("insert failed")
+		}
+	}
+	token, err := db.GetRememberToken(ctx, first.Selector)
+	if err != nil || token.Username != username || token.Family != family || token.Used || !token.Expires.Equal(expires) {
+		t.Fatalf("got %+v, %v", token, err)
+	}
+
+	usedAt := time.Now().Truncate(time.Second)
+	if db.UseRememberToken(ctx, first.Selector, usedAt) != 1 {
+		t.Fatal("use failed")
+	}
+	if db.UseRememberToken(ctx, first.Selector, usedAt) != 0 {
+		t.Fatal("tokens are single use")
+	}
+	token, _ = db.GetRememberToken(ctx, first.Selector)
+	if !token.Used || !token.UsedAt.Equal(usedAt) {
+		t.Fatalf("use not visible: %+v", token)
+	}
+
+	if db.DeleteRememberFamily(ctx, family) != 2 {
+		t.Fatal("family not deleted")
+	}
+	if _, err := db.GetRememberToken(ctx, second.Selector); err != ERR_REMEMBER_TOKEN_NOT_FOUND {
+		t.Fatal("deleted token still found")
+	}
+	if db.DeleteUserRememberTokens(ctx, username) != 1 {
+		t.Fatal("user's tokens not deleted")
+	}
+}
+
+func testAccounts(t *testing.T, db DB) {
+	ctx := context.Background()
+	username := newUsername()
+	db.InsertUser(ctx, username, "hash", "nick")
+	start := time.Now().Truncate(time.Second)
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		login := &Login{
+			Username:    username,
+			At:          start.Add(time.Duration(i) * time.Minute),
+			IP:          ip,
+			UserAgent:   "browser",
+			AuthMethods: []string{"pwd", "otp"},
+		}
+		if db.InsertLogin(ctx, login) != 1 {
+			t.Fatal("insert login failed")
+		}
+	}
+	logins, err := db.GetLogins(ctx, username)
+	if err != nil || len(logins) != 2 || logins[0].IP != "10.0.0.2" || !logins[0].At.Equal(start.Add(time.Minute)) ||
+		len(logins[0].AuthMethods) != 2 || logins[0].AuthMethods[1] != "otp" {
+		t.Fatalf("got %+v, %v", logins, err)
+	}
+	if user, _ := db.GetUser(ctx, username); !user.LastLoginAt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("the last login should be on the user, got %+v", user)
+	}
+
+	if db.PurgeUser(ctx, username) != 0 {
+		t.Fatal("only deleted users can be purged")
+	}
+	if db.DeleteUser(ctx, username, start) != 1 || db.DeleteUser(ctx, username, start) != 0 {
+		t.Fatal("a user is deleted once")
+	}
+	if _, err := db.GetUser(ctx, username); err != ERR_USER_NOT_FOUND {
+		t.Fatalf("deleted user: got %v", err)
+	}
+	if db.UpdateUser(ctx, username, patch("nick", ""), 1) != 0 || db.InsertUser(ctx, username, "hash", "nick") != 0 {
+		t.Fatal("a deleted user's username stays taken until purged")
+	}
+	if deleted, _ := db.GetDeletedUsers(ctx, start.Add(-time.Second)); contains(deleted, username) {
+		t.Fatal("deleted after the cutoff")
+	}
+	if deleted, _ := db.GetDeletedUsers(ctx, start); !contains(deleted, username) {
+		t.Fatalf("got %v", deleted)
+	}
+
+	if db.PurgeUser(ctx, username) != 1 {
+		t.Fatal("purge failed")
+	}
+	if logins, _ := db.GetLogins(ctx, username); len(logins) != 0 {
+		t.Fatal("purged user's logins kept")
+	}
+	if deleted, _ := db.GetDeletedUsers(ctx, start); contains(deleted, username) {
+		t.Fatal("purged user still deleted")
+	}
+	if db.InsertUser(ctx, username, "hash", "nick") != 1 {
+		t.Fatal("a purged username can be registered again")
+	}
+}
+
+func testImport(t *testing.T, db DB) {
+	ctx := context.Background()
+	base := newUsername()
+	db.InsertUser(ctx, base+"_taken", "hash", "nick")
+	users := []api.User{
+		{Username: base + "_a", Nickname: "a", PwHash: "hash", ProfilePic: "/images/a.jpg", Version: 1, Email: "a@example.com"},
+		{Username: base + "_taken", Nickname: "taken", PwHash: "hash", Version: 1},
+		{Username: base + "_a", Nickname: "again", PwHash: "hash", Version: 1},
+		{Username: base + "_b", Nickname: "b", PwHash: "hash", Version: 1},
+	}
+	want := []bool{true, false, false, true}
+
+	inserted, err := db.ImportUsers(ctx, users, true)
+	if err != nil || !reflect.DeepEqual(inserted, want) {
+		t.Fatalf("dry run: got %v, %v", inserted, err)
+	}
+	if _, err := db.GetUser(ctx, base+"_a"); err != ERR_USER_NOT_FOUND {
+		t.Fatal("a dry run must not insert")
+	}
+	inserted, err = db.ImportUsers(ctx, users, false)
+	if err != nil || !reflect.DeepEqual(inserted, want) {
+		t.Fatalf("got %v, %v", inserted, err)
+	}
+	if user, err := db.GetUser(ctx, base+"_a"); err != nil || withoutTimes(*user) != users[0] || user.CreatedAt.IsZero() {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+
+	page, err := db.GetUsers(ctx, base, 2)
+	if err != nil || len(page) != 2 || withoutTimes(page[0]) != users[0] || withoutTimes(page[1]) != users[3] {
+		t.Fatalf("got %+v, %v", page, err)
+	}
+	db.DeleteUser(ctx, base+"_taken", time.Now())
+	page, err = db.GetUsers(ctx, base+"_a", 2)
+	if err != nil || len(page) != 1 || withoutTimes(page[0]) != users[3] {
+		t.Fatalf("deleted users should be left out, got %+v, %v", page, err)
+	}
+}
+
+func patch(nickname string, picPath string) *ProfilePatch {
+	return &ProfilePatch{Nickname: &nickname, ProfilePic: &picPath}
+}
+
+// Users hold times, which compare equal only with Time.Equal
+func withoutTimes(user api.User) api.User {
+	user.CreatedAt = time.Time{}
+	user.LastLoginAt = time.Time{}
+	return user
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func testSecurityEvents(t *testing.T, db DB) {
+	ctx := context.Background()
+	username, other := newUsername(), newUsername()
+	// long expired, so the retention below can't touch events of anything else
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Now().Truncate(time.Second)
+	events := []SecurityEvent{
+		{At: old, Type: api.EVENT_REGISTER, Username: username},
+		{At: start, Type: api.EVENT_LOGIN_FAILURE, Username: username, Reason: api.REASON_WRONG_PASSWORD},
+		{At: start, Type: api.EVENT_LOGIN_SUCCESS, Username: other},
+		{At: start.Add(time.Minute), Type: api.EVENT_LOGIN_SUCCESS, Username: username},
+		{At: start.Add(2 * time.Minute), Type: api.EVENT_PROFILE_EDIT, Username: username, Actor: "admin",
+			Detail: "nickname", RequestId: "rid", IP: "10.0.0.1", UserAgent: "browser"},
+	}
+	for i := range events {
+		if db.InsertSecurityEvent(ctx, &events[i]) != 1 {
+			t.Fatal("insert event failed")
+		}
+	}
+
+	got, err := db.GetSecurityEvents(ctx, EventFilter{Username: username})
+	if err != nil || len(got) != 4 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	edit := got[0]
+	edit.Id = 0
+	if !edit.At.Equal(events[4].At) {
+		t.Fatalf("got %v, want %v", edit.At, events[4].At)
+	}
+	edit.At = events[4].At
+	if edit != events[4] || got[3].Type != api.EVENT_REGISTER {
+		t.Fatalf("events should be newest first, got %+v", got)
+	}
+
+	got, _ = db.GetSecurityEvents(ctx, EventFilter{Username: username, Type: api.EVENT_LOGIN_FAILURE})
+	if len(got) != 1 || got[0].Reason != api.REASON_WRONG_PASSWORD {
+		t.Fatalf("type filter: got %+v", got)
+	}
+	got, _ = db.GetSecurityEvents(ctx, EventFilter{Username: username, Since: start, Until: start.Add(2 * time.Minute)})
+	if len(got) != 2 || got[0].Type != api.EVENT_LOGIN_SUCCESS || got[1].Type != api.EVENT_LOGIN_FAILURE {
+		t.Fatalf("time filter: got %+v", got)
+	}
+
+	// paging
+	var types []string
+	filter := EventFilter{Username: username, Limit: 3}
+	for {
+		page, err := db.GetSecurityEvents(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page {
+			types = append(types, e.Type)
+		}
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.Before = page[len(page)-1].Id
+	}
+	want := []string{api.EVENT_PROFILE_EDIT, api.EVENT_LOGIN_SUCCESS, api.EVENT_LOGIN_FAILURE, api.EVENT_REGISTER}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("paging: got %v", types)
+	}
+
+	if db.DeleteSecurityEvents(ctx, old.Add(time.Hour)) < 1 {
+		t.Fatal("old events should be deleted")
+	}
+	if got, _ := db.GetSecurityEvents(ctx, EventFilter{Username: username}); len(got) != 3 {
+		t.Fatalf("retention: got %+v", got)
+	}
+
+	if sqlDB, ok := db.(*DBStruct); ok {
+		primary, _ := sqlDB.pools()
+		if _, err := primary.sqlDB.Exec("UPDATE security_events SET type = 'logout' WHERE username = ?", username); err == nil {
+			t.Fatal("events must not be updated")
+		}
+	}
+}
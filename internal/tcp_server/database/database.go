@@ -1,128 +1,302 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"example.com/kendrick/api"
 	"example.com/kendrick/internal/tcp_server/cache"
 	"example.com/kendrick/internal/utils"
-	"github.com/go-sql-driver/mysql"
-	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
 	"time"
 )
 
 // https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
 const (
-	GET_USER       = iota
-	INSERT_USER    = iota
-	UPDATE_USER    = iota
-	GET_SESSION    = iota
-	GET_SESSIONS   = iota
-	INSERT_SESSION = iota
-	DUP_PKEY       = 1062
+	GET_USER             = iota
+	INSERT_USER          = iota
+	UPDATE_USER          = iota
+	GET_SESSION          = iota
+	GET_SESSIONS         = iota
+	INSERT_SESSION       = iota
+	GET_TOTP             = iota
+	SET_TOTP             = iota
+	ENABLE_TOTP          = iota
+	USE_RECOVERY         = iota
+	UPDATE_PW            = iota
+	GET_REMEMBER         = iota
+	INSERT_REMEMBER      = iota
+	USE_REMEMBER         = iota
+	DELETE_FAMILY        = iota
+	DELETE_USER_REMEMBER = iota
+	DELETE_USER          = iota
+	GET_DELETED          = iota
+	INSERT_LOGIN         = iota
+	GET_LOGINS           = iota
+	GET_USERS            = iota
+	SET_LAST_LOGIN       = iota
+	INSERT_EVENT         = iota
+	GET_EVENTS           = iota
+	DELETE_EVENTS        = iota
+	USE_TOTP_STEP        = iota
+	DUP_PKEY             = 1062
+	LOCK_WAIT_TIMEOUT    = 1205
+	LOCK_DEADLOCK        = 1213
+	UNKNOWN_STMT_HANDLER = 1243 // the server forgot a prepared statement, e.g. on restarting
 )
 
 var (
-	ERR_USER_NOT_FOUND = errors.New("No such user found!")
+	ERR_USER_NOT_FOUND           = errors.New("No such user found!")
+	ERR_TOTP_NOT_FOUND           = errors.New("Two-factor authentication is not set up")
+	ERR_REMEMBER_TOKEN_NOT_FOUND = errors.New("No such remember-me token")
 )
 
+// Every method bar Connect and Disconnect takes a context bounding how long it may take,
+// retries included
 type DB interface {
 	Connect()
 	Disconnect()
-	GetUser(username string) (*api.User, error)
-	InsertUser(username string, pwHash string, nickname string) int64
-	UpdateUser(key string, nickname string, picPath string) int64
+	GetUser(ctx context.Context, username string) (*api.User, error)
+	InsertUser(ctx context.Context, username string, pwHash string, nickname string) int64
+	UpdateUser(ctx context.Context, key string, patch *ProfilePatch, version int64) int64
+	UpdatePassword(ctx context.Context, key string, pwHash string) int64
+	GetTotp(ctx context.Context, username string) (*TotpSecret, error)
+	SetTotpSecret(ctx context.Context, username string, secret string) int64
+	EnableTotp(ctx context.Context, username string, recoveryCodeHashes []string) int64
+	UseTotpStep(ctx context.Context, username string, step int64) int64
+	UseRecoveryCode(ctx context.Context, username string, codeHash string) int64
+	GetRememberToken(ctx context.Context, selector string) (*RememberToken, error)
+	InsertRememberToken(ctx context.Context, token *RememberToken) int64
+	UseRememberToken(ctx context.Context, selector string, usedAt time.Time) int64
+	DeleteRememberFamily(ctx context.Context, family string) int64
+	DeleteUserRememberTokens(ctx context.Context, username string) int64
+	DeleteUser(ctx context.Context, username string, at time.Time) int64
+	GetDeletedUsers(ctx context.Context, before time.Time) ([]string, error)
+	PurgeUser(ctx context.Context, username string) int64
+	InsertLogin(ctx context.Context, login *Login) int64
+	GetLogins(ctx context.Context, username string) ([]Login, error)
+	ImportUsers(ctx context.Context, users []api.User, dryRun bool) ([]bool, error)
+	GetUsers(ctx context.Context, after string, limit int) ([]api.User, error)
+	InsertSecurityEvent(ctx context.Context, event *SecurityEvent) int64
+	GetSecurityEvents(ctx context.Context, filter EventFilter) ([]SecurityEvent, error)
+	DeleteSecurityEvents(ctx context.Context, before time.Time) int64
 }
 
+// Changes to a user's profile. Fields left nil are left as they are.
+type ProfilePatch struct {
+	Nickname   *string
+	ProfilePic *string
+	Email      *string
+	Bio        *string
+	Timezone   *string
+}
+
+// Names the fields the patch changes, as the columns of users
+func (p *ProfilePatch) Fields() []string {
+	var ret []string
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"nickname", p.Nickname},
+		{"profile_pic", p.ProfilePic},
+		{"email", p.Email},
+		{"bio", p.Bio},
+		{"timezone", p.Timezone},
+	} {
+		if field.value != nil {
+			ret = append(ret, field.name)
+		}
+	}
+	return ret
+}
+
+// A user's TOTP secret, still encrypted as stored in the database
+type TotpSecret struct {
+	Username string
+	Secret   string
+	Enabled  bool
+	LastStep int64 // time step of the last code accepted, see totp.Validate
+}
+
+// Runs on any database/sql database, see driver
 type DBStruct struct {
-	sqlDB      *sql.DB
-	statements map[int]*sql.Stmt
-	userCache  cache.DBCache
+	mu          sync.RWMutex // guards the pools
+	primary     *pool
+	replicas    []*pool       // serve reads of users, see readPool
+	nextReplica uint32        // atomic, spreads reads over the replicas
+	stopChecks  chan struct{} // stops the replica health checks
+	users       *userLoader   // reads users through the cache
+	driver      driver
+	config      Config
+	jitter      func(n int64) int64 // random in [0, n), spreads out retries
+	now         func() time.Time
+
+	writesMu     sync.Mutex
+	recentWrites map[string]time.Time // users read from the primary until then
 }
 
-func NewDB() (DB, error) {
+type Config struct {
+	Primary        string        // address of the database, the file for SQLite
+	Replicas       []string      // addresses of read replicas of the primary
+	ReplicaLag     time.Duration // how long after a write its user is read from the primary
+	HealthInterval time.Duration // between pings of each replica
+	QueryTimeout   time.Duration // bounds each attempt at a query
+	MaxRetries     int           // attempts after the first one, for transient errors only
+	RetryDelay     time.Duration // before the first retry, doubling with each one after
+	MaxDelay       time.Duration // caps the delay between retries
+	UserTTL        time.Duration // how long users stay cached
+	NotFoundTTL    time.Duration // how long a lookup that found no user stays cached
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Primary:        DEFAULT_MYSQL_ADDR,
+		ReplicaLag:     5 * time.Second,
+		HealthInterval: 5 * time.Second,
+		QueryTimeout:   5 * time.Second,
+		MaxRetries:     3,
+		RetryDelay:     20 * time.Millisecond,
+		MaxDelay:       time.Second,
+		UserTTL:        time.Minute,
+		NotFoundTTL:    5 * time.Second,
+	}
+}
+
+// What DBStruct needs to know about the SQL database it runs on
+type driver struct {
+	name        string
+	open        func(addr string) (*sql.DB, error) // returns a configured connection pool
+	migrate     func(sqlDB *sql.DB) error
+	queries     map[int]string
+	isDuplicate func(err error) bool
+	isTransient func(err error) bool // worth retrying
+	isStale     func(err error) bool // the statement has to be prepared again
+}
+
+// Returns the MySQL users database
+func NewDB(userCache cache.DBCache, config Config) (DB, error) {
+	return newDBStruct(mysqlDriver, userCache, config), nil
+}
+
+func newDBStruct(driver driver, userCache cache.DBCache, config Config) *DBStruct {
 	ret := DBStruct{
-		sqlDB:      nil,
-		statements: nil,
-		userCache:  nil,
+		driver:       driver,
+		config:       config,
+		jitter:       defaultJitter,
+		now:          time.Now,
+		recentWrites: make(map[string]time.Time),
 	}
+	ret.users = newUserLoader(userCache, config, ret.queryUser)
 	ret.Connect()
-	return &ret, nil
+	return &ret
 }
 
-// Converts sql return statement to slice of User
-func rowsToUsers(rows *sql.Rows) []api.User {
-	var ret []api.User
-	for rows.Next() {
-		var user api.User
-		err := rows.Scan(&user.Username, &user.Nickname, &user.PwHash, &user.ProfilePic)
-		if err != nil {
-			log.Panicln(err)
-		}
-		ret = append(ret, user)
+// Edits the profile of a user, if it is still at version. Returns 0 if it has been edited
+// since, or there is no such user.
+func (db *DBStruct) UpdateUser(ctx context.Context, key string, patch *ProfilePatch, version int64) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, UPDATE_USER, nullString(patch.Nickname), nullString(patch.ProfilePic),
+		nullString(patch.Email), nullString(patch.Bio), nullString(patch.Timezone), key, version)
+	if utils.IsError(err) {
+		return 0
 	}
-	return ret
+	log.Debug("UPDATE: username: " + key + " | version: " + strconv.FormatInt(version, 10))
+	// on a conflict, the version the caller read may have come from a stale cache
+	db.wrote(key)
+	db.users.invalidate(key)
+	return rows
 }
 
-func (db *DBStruct) UpdateUser(key string, nickname string, picPath string) int64 {
+func (db *DBStruct) UpdatePassword(ctx context.Context, key string, pwHash string) int64 {
 	db.ensureConnected()
-	result, err := db.statements[UPDATE_USER].Exec(nickname, picPath, key)
-	if err != nil {
-		log.Panicln(err)
+	rows, err := db.exec(ctx, UPDATE_PW, pwHash, key)
+	if utils.IsError(err) {
+		return 0
 	}
-	log.Debug("UPDATE: username: " + key + " | nickname: " + nickname + " | profile_pic: " + picPath)
-	var rows int64
-	rows, err = result.RowsAffected()
+	log.Debug("UPDATE password: username: " + key)
 	if rows == 1 {
-		// update the redis cache
-		res, err := db.statements[GET_USER].Query(key)
-		if utils.IsError(err) {
-			return rows
-		}
-		defer res.Close()
-		newRows := rowsToUsers(res)
-		err = db.userCache.SetUser(key, newRows)
-		if utils.IsError(err) {
-			return rows
-		}
-		log.Debug("UPDATE redis user cache ", newRows)
+		db.wrote(key)
+		db.users.invalidate(key)
 	}
 	return rows
 }
 
-func (db *DBStruct) InsertUser(username string, pwHash string, nickname string) int64 {
+// A user as read from userColumns, whose times may be NULL
+type userRow struct {
+	user        api.User
+	createdAt   sql.NullTime
+	lastLoginAt sql.NullTime
+}
+
+func (r *userRow) dest() []interface{} {
+	return []interface{}{&r.user.Username, &r.user.Nickname, &r.user.PwHash, &r.user.ProfilePic, &r.user.Version,
+		&r.user.Email, &r.user.Bio, &r.user.Timezone, &r.createdAt, &r.lastLoginAt}
+}
+
+func (r *userRow) toUser() api.User {
+	ret := r.user
+	ret.CreatedAt = r.createdAt.Time
+	ret.LastLoginAt = r.lastLoginAt.Time
+	return ret
+}
+
+func nullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+// Reads a user from the database, as the rows the cache holds: none if there is no such user
+func (db *DBStruct) queryUser(ctx context.Context, key string) ([]api.User, error) {
+	var row userRow
+	dest := row.dest()
+	p := db.readPool(key)
+	err := db.queryRow(ctx, p, GET_USER, dest, key)
+	if primary, _ := db.pools(); p != primary && err != nil && err != sql.ErrNoRows && ctx.Err() == nil {
+		log.Error("Reading from replica ", p.addr, ": ", err)
+		p.setHealthy(false)
+		err = db.queryRow(ctx, primary, GET_USER, dest, key)
+	}
+	if err == sql.ErrNoRows {
+		return []api.User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []api.User{row.toUser()}, nil
+}
+
+func (db *DBStruct) InsertUser(ctx context.Context, username string, pwHash string, nickname string) int64 {
 	db.ensureConnected()
-	result, err := db.statements[INSERT_USER].Exec(username, nickname, pwHash, sql.NullString{})
+	rows, err := db.exec(ctx, INSERT_USER, username, nickname, pwHash,
+		sql.NullString{}, sql.NullString{}, sql.NullString{}, sql.NullString{}, db.now())
 	if err != nil {
 		// duplicate username pkey
-		if me, ok := err.(*mysql.MySQLError); ok && me.Number == DUP_PKEY {
+		if db.driver.isDuplicate(err) {
 			return 0
 		}
-		log.Panicln(err)
+		log.Error(err)
+		return 0
 	}
 	log.Println("INSERT users: username: " + username + " | nickname: " + nickname + " | pwHash " + pwHash)
-	rows, err := result.RowsAffected()
+	if rows == 1 {
+		// the cache may hold an earlier lookup that found no such user
+		db.wrote(username)
+		db.users.invalidate(username)
+	}
 	return rows
 }
 
 // Retrieves a user based on key (his unique username)
-func (db *DBStruct) GetUser(key string) (*api.User, error) {
+func (db *DBStruct) GetUser(ctx context.Context, key string) (*api.User, error) {
 	db.ensureConnected()
-	userRows, err := db.userCache.GetUser(key)
-	if err != nil {
-		log.Error(err)
-		res, err := db.statements[GET_USER].Query(key)
-		if utils.IsError(err) {
-			return nil, err
-		}
-		defer res.Close()
-		ret := rowsToUsers(res)
-		err = db.userCache.SetUser(key, ret)
-		if utils.IsError(err) {
-			return nil, err
-		}
-		return &ret[0], nil
+	userRows, err := db.users.get(ctx, key)
+	if utils.IsError(err) {
+		return nil, err
 	}
 	if len(userRows) < 1 {
 		return nil, ERR_USER_NOT_FOUND
@@ -130,56 +304,126 @@ func (db *DBStruct) GetUser(key string) (*api.User, error) {
 	return &userRows[0], nil
 }
 
-func (db *DBStruct) Connect() {
-	var err error
-	// read password
-	pw := utils.ReadPw()
-
-	// Connect to the database
-	db.sqlDB, err = sql.Open("mysql", "root:"+pw+"@tcp(localhost:3306)/users_db")
-	if err != nil {
-		log.Panicln(err.Error())
+// Retrieves the (encrypted) TOTP secret of a user
+func (db *DBStruct) GetTotp(ctx context.Context, username string) (*TotpSecret, error) {
+	db.ensureConnected()
+	var ret TotpSecret
+	primary, _ := db.pools()
+	err := db.queryRow(ctx, primary, GET_TOTP, []interface{}{&ret.Username, &ret.Secret, &ret.Enabled, &ret.LastStep}, username)
+	if err == sql.ErrNoRows {
+		return nil, ERR_TOTP_NOT_FOUND
 	}
-	// Prepare statements
-	statements := make(map[int]*sql.Stmt, 10)
-	updateUser, err := db.sqlDB.Prepare("UPDATE users_test SET nickname=?, profile_pic=? WHERE username=?")
-	if err != nil {
-		log.Panicln(err)
+	if utils.IsError(err) {
+		return nil, err
 	}
-	insertUser, err := db.sqlDB.Prepare("INSERT INTO users_test VALUES (?, ?, ?, ?)")
-	if err != nil {
-		log.Panicln(err)
+	return &ret, nil
+}
+
+// Stores a new, not yet enabled, TOTP secret for a user. Fails if TOTP is already enabled.
+func (db *DBStruct) SetTotpSecret(ctx context.Context, username string, secret string) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, SET_TOTP, username, secret, secret)
+	if utils.IsError(err) {
+		return 0
 	}
-	getUser, err := db.sqlDB.Prepare("SELECT username, nickname, pw_hash, COALESCE(profile_pic, '') FROM users_test WHERE username = ?")
-	if err != nil {
-		log.Panicln(err)
+	log.Debug("SET totp secret: username: " + username)
+	return rows
+}
+
+// Enables TOTP for a user and replaces their recovery codes, in a single transaction
+func (db *DBStruct) EnableTotp(ctx context.Context, username string, recoveryCodeHashes []string) int64 {
+	db.ensureConnected()
+	var rows int64
+	err := db.transaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, db.driver.queries[ENABLE_TOTP], username)
+		if err != nil {
+			return err
+		}
+		rows, err = result.RowsAffected()
+		if err != nil || rows != 1 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE username = ?", username)
+		if err != nil {
+			return err
+		}
+		for _, hash := range recoveryCodeHashes {
+			_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (username, code_hash, used) VALUES (?, ?, FALSE)", username, hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if utils.IsError(err) || rows != 1 {
+		return 0
 	}
+	log.Debug("ENABLE totp: username: " + username)
+	return rows
+}
 
-	statements[GET_USER] = getUser
-	statements[INSERT_USER] = insertUser
-	statements[UPDATE_USER] = updateUser
-	db.statements = statements
+// Records that a TOTP code of step was accepted. Returns 1 unless a code of that step or a
+// later one was accepted already, so that of two logins replaying one code only one passes.
+func (db *DBStruct) UseTotpStep(ctx context.Context, username string, step int64) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, USE_TOTP_STEP, step, username, step)
+	if utils.IsError(err) {
+		return 0
+	}
+	return rows
+}
 
-	// user cache
-	userCache := cache.NewRedisCache("localhost:6379", 0, time.Minute)
-	db.userCache = userCache
+// Marks an unused recovery code as used. Returns 1 if the code was valid.
+func (db *DBStruct) UseRecoveryCode(ctx context.Context, username string, codeHash string) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, USE_RECOVERY, username, codeHash)
+	if utils.IsError(err) {
+		return 0
+	}
+	return rows
+}
 
-	db.sqlDB.SetMaxOpenConns(100)
-	db.sqlDB.SetMaxIdleConns(150)
-	db.sqlDB.SetConnMaxLifetime(time.Second * 60)
-	log.Println("Connected to MySQL database")
+// Connects to the database and its replicas, and brings the schema up to date. Statements
+// are prepared afresh, as they are used.
+func (db *DBStruct) Connect() {
+	sqlDB, err := db.driver.open(db.config.Primary)
+	if err != nil {
+		log.Panicln(err.Error())
+	}
+	if err := db.driver.migrate(sqlDB); err != nil {
+		log.Panicln(err)
+	}
+	replicas := db.openReplicas()
+	stop := make(chan struct{})
+	if len(replicas) > 0 {
+		go db.checkReplicas(replicas, stop)
+	}
+	db.mu.Lock()
+	db.primary = newPool(db.config.Primary, sqlDB)
+	db.replicas = replicas
+	db.stopChecks = stop
+	db.mu.Unlock()
+	log.Println("Connected to "+db.driver.name+" database, with ", len(replicas), " replicas")
 }
 
 func (db *DBStruct) Disconnect() {
-	_ = db.sqlDB.Close()
-	log.Println("Disconnected from MySQL database")
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.primary == nil {
+		return
+	}
+	close(db.stopChecks)
+	db.primary.close()
+	for _, replica := range db.replicas {
+		replica.close()
+	}
+	db.primary = nil
+	db.replicas = nil
+	log.Println("Disconnected from " + db.driver.name + " database")
 }
 
 func (db *DBStruct) ensureConnected() {
-	if db.sqlDB == nil {
+	if primary, _ := db.pools(); primary == nil {
 		db.Connect()
 	}
-	if db == nil {
-		panic("Not connected to MySQL database!")
-	}
 }
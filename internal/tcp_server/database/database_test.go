@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"example.com/kendrick/api"
 	"example.com/kendrick/internal/utils"
 	"io/ioutil"
 	"log"
@@ -21,17 +22,16 @@ func BenchmarkPreparedStatements(b *testing.B) {
 		log.Panicln(err.Error())
 	}
 	// Prepare statement
-	getUser, err := db.Prepare("SELECT username, nickname, pw_hash, COALESCE(profile_pic, '') FROM users_test WHERE username = ?")
+	getUser, err := db.Prepare(mysqlQueries[GET_USER])
 
 	// Get users without prepared statements
 	b.Run("GET USER (No prepared statements", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			rows, err := db.Query("SELECT username, nickname, pw_hash, COALESCE(profile_pic, '') FROM users_test WHERE username = ?", "kendrick")
+			rows, err := db.Query(mysqlQueries[GET_USER], "kendrick")
 			if err != nil {
 				log.Panicln(err)
 			}
-			rows.Close()
-			rowsToUsers(rows)
+			scanUsers(rows)
 		}
 	})
 	// Get users with prepared statements
@@ -41,12 +41,25 @@ func BenchmarkPreparedStatements(b *testing.B) {
 			if err != nil {
 				log.Panicln(err)
 			}
-			rows.Close()
-			rowsToUsers(rows)
+			scanUsers(rows)
 		}
 	})
 }
 
+// Reads the rows of GET_USER as queryUser does
+func scanUsers(rows *sql.Rows) []api.User {
+	defer rows.Close()
+	var ret []api.User
+	for rows.Next() {
+		var row userRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			log.Panicln(err)
+		}
+		ret = append(ret, row.toUser())
+	}
+	return ret
+}
+
 //func BenchmarkInsertSession(b *testing.B) {
 //	pwBytes, err := ioutil.ReadFile(filepath.Join(utils.RootDir(), "../../configs/dbPw.txt"))
 //	if err != nil {
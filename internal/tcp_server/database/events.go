@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"time"
+)
+
+/**
+Security events: logins, logouts and changes made to accounts, kept in the append-only
+security_events table so that what happened to an account can be traced afterwards.
+Events are never changed, only deleted once older than the retention period.
+*/
+
+// The most events GetSecurityEvents returns at once
+const MAX_EVENTS_PAGE = 500
+
+type SecurityEvent struct {
+	Id        int64
+	At        time.Time
+	Type      string // see api.EVENT_*
+	Username  string // whose account, as given: a failed login may name no user
+	Actor     string // who acted, the user unless an admin is impersonating them
+	Reason    string // why a login failed, see api.REASON_*
+	Detail    string // e.g. which profile fields were edited
+	RequestId string
+	IP        string
+	UserAgent string
+}
+
+// Narrows down the events GetSecurityEvents returns. Zero fields match every event.
+type EventFilter struct {
+	Username string
+	Type     string
+	Since    time.Time // inclusive
+	Until    time.Time // exclusive
+	Before   int64     // id of the last event of the previous page
+	Limit    int       // at most MAX_EVENTS_PAGE
+}
+
+// The bounds of the filter as query arguments, in the order of GET_EVENTS
+func (f EventFilter) args() []interface{} {
+	until := f.Until
+	if until.IsZero() {
+		until = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	before := f.Before
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	return []interface{}{f.Username, f.Username, f.Type, f.Type, f.Since.UTC(), until.UTC(), before, f.limit()}
+}
+
+func (f EventFilter) limit() int {
+	if f.Limit <= 0 || f.Limit > MAX_EVENTS_PAGE {
+		return MAX_EVENTS_PAGE
+	}
+	return f.Limit
+}
+
+func (f EventFilter) matches(e *SecurityEvent) bool {
+	return (f.Username == "" || e.Username == f.Username) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		!e.At.Before(f.Since) &&
+		(f.Until.IsZero() || e.At.Before(f.Until)) &&
+		(f.Before <= 0 || e.Id < f.Before)
+}
+
+func (db *DBStruct) InsertSecurityEvent(ctx context.Context, event *SecurityEvent) int64 {
+	db.ensureConnected()
+	// in UTC, so that SQLite, which compares times as text, orders them
+	rows, err := db.exec(ctx, INSERT_EVENT, event.At.UTC(), event.Type, event.Username, event.Actor, event.Reason,
+		event.Detail, event.RequestId, event.IP, event.UserAgent)
+	if utils.IsError(err) {
+		return 0
+	}
+	return rows
+}
+
+// Returns the events matching the filter, newest first. The next page is the one before
+// the id of the last event returned.
+func (db *DBStruct) GetSecurityEvents(ctx context.Context, filter EventFilter) ([]SecurityEvent, error) {
+	db.ensureConnected()
+	primary, _ := db.pools()
+	var ret []SecurityEvent
+	err := db.query(ctx, primary, GET_EVENTS, func(rows *sql.Rows) error {
+		ret = nil
+		for rows.Next() {
+			var e SecurityEvent
+			err := rows.Scan(&e.Id, &e.At, &e.Type, &e.Username, &e.Actor, &e.Reason,
+				&e.Detail, &e.RequestId, &e.IP, &e.UserAgent)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, e)
+		}
+		return nil
+	}, filter.args()...)
+	if utils.IsError(err) {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Deletes the events older than a time, returning how many
+func (db *DBStruct) DeleteSecurityEvents(ctx context.Context, before time.Time) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, DELETE_EVENTS, before.UTC())
+	if utils.IsError(err) {
+		return 0
+	}
+	log.Info("DELETE security events: " + strconv.FormatInt(rows, 10) + " before " + before.Format(time.RFC3339))
+	return rows
+}
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Users database held in process memory, for development and tests. Everything is lost
+// when the process exits. Results are copies, like rows read from a real database.
+type memoryDB struct {
+	mu       sync.Mutex
+	users    map[string]api.User
+	totp     map[string]TotpSecret
+	recovery map[string]map[string]bool // username to code hash to used
+	remember map[string]RememberToken   // by selector
+	deleted  map[string]time.Time       // users deleted, by username
+	logins   map[string][]Login         // by username, oldest first
+	events   []SecurityEvent            // oldest first
+	eventId  int64                      // of the last event inserted
+}
+
+func NewMemoryDB() DB {
+	return &memoryDB{
+		users:    make(map[string]api.User),
+		totp:     make(map[string]TotpSecret),
+		recovery: make(map[string]map[string]bool),
+		remember: make(map[string]RememberToken),
+		deleted:  make(map[string]time.Time),
+		logins:   make(map[string][]Login),
+	}
+}
+
+func (db *memoryDB) Connect()    {}
+func (db *memoryDB) Disconnect() {}
+
+func (db *memoryDB) GetUser(ctx context.Context, username string) (*api.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[username]
+	if _, deleted := db.deleted[username]; !ok || deleted {
+		return nil, ERR_USER_NOT_FOUND
+	}
+	return &user, nil
+}
+
+func (db *memoryDB) InsertUser(ctx context.Context, username string, pwHash string, nickname string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[username]; ok {
+		return 0
+	}
+	db.users[username] = api.User{
+		Username:  username,
+		Nickname:  nickname,
+		PwHash:    pwHash,
+		Version:   1,
+		CreatedAt: time.Now(),
+	}
+	return 1
+}
+
+func (db *memoryDB) UpdateUser(ctx context.Context, key string, patch *ProfilePatch, version int64) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[key]
+	if _, deleted := db.deleted[key]; !ok || deleted || user.Version != version {
+		return 0
+	}
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{patch.Nickname, &user.Nickname},
+		{patch.ProfilePic, &user.ProfilePic},
+		{patch.Email, &user.Email},
+		{patch.Bio, &user.Bio},
+		{patch.Timezone, &user.Timezone},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+	user.Version++
+	db.users[key] = user
+	return 1
+}
+
+func (db *memoryDB) UpdatePassword(ctx context.Context, key string, pwHash string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[key]
+	if _, deleted := db.deleted[key]; !ok || deleted {
+		return 0
+	}
+	user.PwHash = pwHash
+	db.users[key] = user
+	return 1
+}
+
+func (db *memoryDB) GetTotp(ctx context.Context, username string) (*TotpSecret, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	secret, ok := db.totp[username]
+	if !ok {
+		return nil, ERR_TOTP_NOT_FOUND
+	}
+	return &secret, nil
+}
+
+func (db *memoryDB) SetTotpSecret(ctx context.Context, username string, secret string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	old, ok := db.totp[username]
+	if ok && old.Enabled {
+		return 0
+	}
+	db.totp[username] = TotpSecret{Username: username, Secret: secret, LastStep: old.LastStep}
+	return 1
+}
+
+func (db *memoryDB) EnableTotp(ctx context.Context, username string, recoveryCodeHashes []string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	secret, ok := db.totp[username]
+	if !ok || secret.Enabled {
+		return 0
+	}
+	secret.Enabled = true
+	db.totp[username] = secret
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = false
+	}
+	db.recovery[username] = codes
+	return 1
+}
+
+func (db *memoryDB) UseTotpStep(ctx context.Context, username string, step int64) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	secret, ok := db.totp[username]
+	if !ok || secret.LastStep >= step {
+		return 0
+	}
+	secret.LastStep = step
+	db.totp[username] = secret
+	return 1
+}
+
+func (db *memoryDB) UseRecoveryCode(ctx context.Context, username string, codeHash string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	used, ok := db.recovery[username][codeHash]
+	if !ok || used {
+		return 0
+	}
+	db.recovery[username][codeHash] = true
+	return 1
+}
+
+func (db *memoryDB) GetRememberToken(ctx context.Context, selector string) (*RememberToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token, ok := db.remember[selector]
+	if !ok {
+		return nil, ERR_REMEMBER_TOKEN_NOT_FOUND
+	}
+	return &token, nil
+}
+
+func (db *memoryDB) InsertRememberToken(ctx context.Context, token *RememberToken) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.remember[token.Selector]; ok {
+		return 0
+	}
+	stored := *token
+	stored.Used = false
+	stored.UsedAt = time.Time{}
+	db.remember[token.Selector] = stored
+	return 1
+}
+
+func (db *memoryDB) UseRememberToken(ctx context.Context, selector string, usedAt time.Time) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token, ok := db.remember[selector]
+	if !ok || token.Used {
+		return 0
+	}
+	token.Used = true
+	token.UsedAt = usedAt
+	db.remember[selector] = token
+	return 1
+}
+
+func (db *memoryDB) DeleteRememberFamily(ctx context.Context, family string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var rows int64
+	for selector, token := range db.remember {
+		if token.Family == family {
+			delete(db.remember, selector)
+			rows++
+		}
+	}
+	return rows
+}
+
+func (db *memoryDB) DeleteUserRememberTokens(ctx context.Context, username string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var rows int64
+	for selector, token := range db.remember {
+		if token.Username == username {
+			delete(db.remember, selector)
+			rows++
+		}
+	}
+	return rows
+}
+
+func (db *memoryDB) DeleteUser(ctx context.Context, username string, at time.Time) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[username]; !ok {
+		return 0
+	}
+	if _, deleted := db.deleted[username]; deleted {
+		return 0
+	}
+	db.deleted[username] = at
+	return 1
+}
+
+func (db *memoryDB) GetDeletedUsers(ctx context.Context, before time.Time) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var ret []string
+	for username, at := range db.deleted {
+		if !at.After(before) {
+			ret = append(ret, username)
+		}
+	}
+	return ret, nil
+}
+
+func (db *memoryDB) PurgeUser(ctx context.Context, username string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, deleted := db.deleted[username]; !deleted {
+		return 0
+	}
+	delete(db.users, username)
+	delete(db.deleted, username)
+	delete(db.totp, username)
+	delete(db.recovery, username)
+	delete(db.logins, username)
+	for selector, token := range db.remember {
+		if token.Username == username {
+			delete(db.remember, selector)
+		}
+	}
+	return 1
+}
+
+func (db *memoryDB) InsertLogin(ctx context.Context, login *Login) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := *login
+	stored.AuthMethods = append([]string(nil), login.AuthMethods...)
+	db.logins[login.Username] = append(db.logins[login.Username], stored)
+	if user, ok := db.users[login.Username]; ok {
+		user.LastLoginAt = login.At
+		db.users[login.Username] = user
+	}
+	return 1
+}
+
+func (db *memoryDB) GetLogins(ctx context.Context, username string) ([]Login, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	logins := db.logins[username]
+	ret := make([]Login, 0, len(logins))
+	for i := len(logins) - 1; i >= 0; i-- {
+		ret = append(ret, logins[i])
+	}
+	return ret, nil
+}
+
+func (db *memoryDB) ImportUsers(ctx context.Context, users []api.User, dryRun bool) ([]bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	inserted := make([]bool, len(users))
+	taken := make(map[string]bool)
+	for i, user := range users {
+		if _, ok := db.users[user.Username]; ok || taken[user.Username] {
+			continue
+		}
+		taken[user.Username] = true
+		inserted[i] = true
+	}
+	if !dryRun {
+		for i, user := range users {
+			if inserted[i] {
+				user.Version = 1
+				user.CreatedAt = time.Now()
+				user.LastLoginAt = time.Time{}
+				db.users[user.Username] = user
+			}
+		}
+	}
+	return inserted, nil
+}
+
+func (db *memoryDB) GetUsers(ctx context.Context, after string, limit int) ([]api.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var usernames []string
+	for username := range db.users {
+		if _, deleted := db.deleted[username]; username > after && !deleted {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+	ret := make([]api.User, 0, len(usernames))
+	for _, username := range usernames {
+		ret = append(ret, db.users[username])
+	}
+	return ret, nil
+}
+
+func (db *memoryDB) InsertSecurityEvent(ctx context.Context, event *SecurityEvent) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.eventId++
+	stored := *event
+	stored.Id = db.eventId
+	db.events = append(db.events, stored)
+	return 1
+}
+
+func (db *memoryDB) GetSecurityEvents(ctx context.Context, filter EventFilter) ([]SecurityEvent, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var ret []SecurityEvent
+	for i := len(db.events) - 1; i >= 0 && len(ret) < filter.limit(); i-- {
+		if filter.matches(&db.events[i]) {
+			ret = append(ret, db.events[i])
+		}
+	}
+	return ret, nil
+}
+
+func (db *memoryDB) DeleteSecurityEvents(ctx context.Context, before time.Time) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var kept []SecurityEvent
+	for _, event := range db.events {
+		if !event.At.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	deleted := len(db.events) - len(kept)
+	db.events = kept
+	return int64(deleted)
+}
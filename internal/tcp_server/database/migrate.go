@@ -0,0 +1,309 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Versioned schema migrations. Each migration is a pair of files in migrations/,
+NNNN_name.up.sql and NNNN_name.down.sql, applied in version order. Applied versions are
+recorded in schema_migrations. MySQL can't roll DDL back, so a migration that fails
+halfway is left marked dirty and has to be repaired by hand.
+*/
+
+const (
+	// named lock held while migrating, so servers starting together don't race
+	MIGRATION_LOCK         = "kendrick_schema_migrations"
+	MIGRATION_LOCK_TIMEOUT = time.Minute
+)
+
+var (
+	ERR_MIGRATION_LOCK  = errors.New("Timed out waiting for another server to finish migrating")
+	ERR_NOTHING_APPLIED = errors.New("No migration to revert")
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var (
+	migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	// a semicolon ending a line, bar whitespace and a -- comment
+	statementEnd = regexp.MustCompile(`;[ \t\r]*(--[^\n]*)?(\n|$)`)
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// A migration and whether it is applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	Dirty     bool // failed halfway
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// Returns a migrator for the migrations built into the binary
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Reads the migrations in fsys/migrations, ordered by version
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, path := range paths {
+		file := path[strings.LastIndex(path, "/")+1:]
+		match := migrationName.FindStringSubmatch(file)
+		if match == nil {
+			return nil, fmt.Errorf("Bad migration file name %v", file)
+		}
+		version, _ := strconv.Atoi(match[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("Migration %v has two names, %v and %v", version, m.Name, match[2])
+		}
+		body, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	ret := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("Migration %v needs both an up and a down file", m.Version)
+		}
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+// Applies every pending migration, returning how many were applied
+func (m *Migrator) Up() (int, error) {
+	applied := 0
+	err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		status, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			if s.Dirty {
+				return errDirty(s.Migration)
+			}
+		}
+		for _, s := range status {
+			if s.Applied {
+				continue
+			}
+			log.Info("Applying migration ", s.Version, " ", s.Name)
+			if err := m.apply(ctx, conn, s.Migration); err != nil {
+				return err
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Reverts the latest applied migration, returning it
+func (m *Migrator) Down() (*Migration, error) {
+	var reverted *Migration
+	err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		status, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(status) - 1; i >= 0; i-- {
+			s := status[i]
+			if s.Dirty {
+				return errDirty(s.Migration)
+			}
+			if !s.Applied {
+				continue
+			}
+			log.Info("Reverting migration ", s.Version, " ", s.Name)
+			if err := m.revert(ctx, conn, s.Migration); err != nil {
+				return err
+			}
+			reverted = &s.Migration
+			return nil
+		}
+		return ERR_NOTHING_APPLIED
+	})
+	return reverted, err
+}
+
+// Lists every migration with whether it is applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return m.status(ctx, conn)
+}
+
+func (m *Migrator) status(ctx context.Context, conn *sql.Conn) ([]MigrationStatus, error) {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations ("+
+		"version INT NOT NULL PRIMARY KEY, "+
+		"name VARCHAR(255) NOT NULL, "+
+		"dirty BOOLEAN NOT NULL DEFAULT FALSE, "+
+		"applied_at DATETIME NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT version, dirty, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var s MigrationStatus
+		if err := rows.Scan(&s.Version, &s.Dirty, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		s.Applied = true
+		applied[s.Version] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ret := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		ret[i] = applied[migration.Version]
+		ret[i].Migration = migration
+		delete(applied, migration.Version)
+	}
+	for version := range applied {
+		log.Warn("Schema has migration ", version, ", which this build doesn't know")
+	}
+	return ret, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	_, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, dirty, applied_at) "+
+		"VALUES (?, ?, TRUE, NOW())", migration.Version, migration.Name)
+	if err != nil {
+		return err
+	}
+	if err := execScript(ctx, conn, migration.Up); err != nil {
+		return fmt.Errorf("Migration %v %v failed: %v", migration.Version, migration.Name, err)
+	}
+	_, err = conn.ExecContext(ctx, "UPDATE schema_migrations SET dirty = FALSE WHERE version = ?", migration.Version)
+	return err
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	_, err := conn.ExecContext(ctx, "UPDATE schema_migrations SET dirty = TRUE WHERE version = ?", migration.Version)
+	if err != nil {
+		return err
+	}
+	if err := execScript(ctx, conn, migration.Down); err != nil {
+		return fmt.Errorf("Reverting migration %v %v failed: %v", migration.Version, migration.Name, err)
+	}
+	_, err = conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+	return err
+}
+
+// Runs f on a connection holding the migration lock. MySQL named locks belong to a
+// connection, so everything under the lock must use conn.
+func (m *Migrator) withLock(f func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)",
+		MIGRATION_LOCK, int(MIGRATION_LOCK_TIMEOUT.Seconds())).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return ERR_MIGRATION_LOCK
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", MIGRATION_LOCK); err != nil {
+			log.Error(err)
+		}
+	}()
+	return f(ctx, conn)
+}
+
+// Runs the statements of a migration file one by one, as the driver runs one per call
+func execScript(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, statement := range splitStatements(script) {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Splits a script into statements at semicolons ending a line, even if a comment follows
+func splitStatements(script string) []string {
+	var ret []string
+	for _, part := range statementEnd.Split(script, -1) {
+		if isBlank(part) {
+			continue
+		}
+		ret = append(ret, strings.TrimSpace(part))
+	}
+	return ret
+}
+
+// Reports whether a piece of SQL holds nothing but whitespace and -- comments
+func isBlank(script string) bool {
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+func errDirty(migration Migration) error {
+	return fmt.Errorf("Migration %v %v failed halfway. Repair the schema by hand, then delete "+
+		"its row from schema_migrations to retry it", migration.Version, migration.Name)
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Quoted strings and -- comments, which may hold semicolons that end nothing
+var sqlNoise = regexp.MustCompile(`'[^']*'|--[^\n]*`)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %v %v: versions must count up from 1 without gaps", m.Version, m.Name)
+		}
+		if len(splitStatements(m.Up)) == 0 || len(splitStatements(m.Down)) == 0 {
+			t.Fatalf("migration %v %v has an empty script", m.Version, m.Name)
+		}
+		// the driver runs one statement per call, so two left together fail on MySQL
+		for _, statement := range append(splitStatements(m.Up), splitStatements(m.Down)...) {
+			if strings.Contains(sqlNoise.ReplaceAllString(statement, ""), ";") {
+				t.Fatalf("migration %v %v: not split into single statements at\n%v", m.Version, m.Name, statement)
+			}
+		}
+	}
+}
+
+func TestLoadMigrationsRejectsIncomplete(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0001_a.up.sql":   {Data: []byte("CREATE TABLE a (id INT);")},
+		"migrations/0001_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"migrations/0002_b.up.sql":   {Data: []byte("CREATE TABLE b (id INT);")},
+	}
+	if _, err := LoadMigrations(fsys); err == nil {
+		t.Fatal("a migration without a down file should be rejected")
+	}
+	fsys["migrations/0002_b.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE b;")}
+	migrations, err := LoadMigrations(fsys)
+	if err != nil || len(migrations) != 2 || migrations[1].Name != "b" {
+		t.Fatalf("got %v, %v", migrations, err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- leading comment\nCREATE TABLE a (\n    x INT -- not ; the end\n);\n\nDROP TABLE b;\n-- trailing comment\n"
+	statements := splitStatements(script)
+	if len(statements) != 2 || statements[1] != "DROP TABLE b" {
+		t.Fatalf("got %q", statements)
+	}
+
+	// a comment after the semicolon still ends the statement
+	script = "ALTER TABLE a ADD COLUMN y INT; -- why\r\nCREATE TABLE c (id INT);\t-- ; too\nDROP TABLE d;"
+	statements = splitStatements(script)
+	want := []string{"ALTER TABLE a ADD COLUMN y INT", "CREATE TABLE c (id INT)", "DROP TABLE d"}
+	if len(statements) != len(want) {
+		t.Fatalf("got %q", statements)
+	}
+	for i := range want {
+		if statements[i] != want[i] {
+			t.Fatalf("got %q", statements)
+		}
+	}
+}
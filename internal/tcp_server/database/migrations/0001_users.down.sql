@@ -0,0 +1 @@
+DROP TABLE users_test;
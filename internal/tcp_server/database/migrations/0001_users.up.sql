@@ -0,0 +1,8 @@
+-- The users table as it was created by hand before migrations, named users_test.
+-- IF NOT EXISTS adopts such an existing table.
+CREATE TABLE IF NOT EXISTS users_test (
+    username    VARCHAR(45) NOT NULL PRIMARY KEY,
+    nickname    VARCHAR(45) NOT NULL,
+    pw_hash     CHAR(60) NOT NULL, -- bcrypt
+    profile_pic VARCHAR(255) NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS totp_secrets (
+    username VARCHAR(45) NOT NULL PRIMARY KEY,
+    secret   VARCHAR(255) NOT NULL, -- AES-GCM encrypted, base64
+    enabled  BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    username  VARCHAR(45) NOT NULL,
+    code_hash CHAR(64) NOT NULL, -- sha256 hex
+    used      BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, code_hash)
+);
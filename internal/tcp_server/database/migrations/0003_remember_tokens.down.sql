@@ -0,0 +1 @@
+DROP TABLE remember_tokens;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS remember_tokens (
+    selector       CHAR(24) NOT NULL PRIMARY KEY,
+    validator_hash CHAR(64) NOT NULL, -- sha256 hex
+    family         CHAR(24) NOT NULL, -- shared by all tokens rotated from one login
+    username       VARCHAR(45) NOT NULL,
+    expires        DATETIME NOT NULL,
+    used           BOOLEAN NOT NULL DEFAULT FALSE,
+    used_at        DATETIME NULL,
+    INDEX (family),
+    INDEX (username)
+);
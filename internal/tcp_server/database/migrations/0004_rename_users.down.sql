@@ -0,0 +1 @@
+RENAME TABLE users TO users_test;
@@ -0,0 +1 @@
+RENAME TABLE users_test TO users;
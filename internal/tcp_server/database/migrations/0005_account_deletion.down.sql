@@ -0,0 +1,2 @@
+DROP TABLE login_history;
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,11 @@
+-- set when the user deleted the account
+ALTER TABLE users ADD COLUMN deleted_at DATETIME NULL;
+CREATE TABLE IF NOT EXISTS login_history (
+    id           BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    username     VARCHAR(45) NOT NULL,
+    logged_in_at DATETIME NOT NULL,
+    ip           VARCHAR(45) NOT NULL,
+    user_agent   VARCHAR(255) NOT NULL,
+    auth_methods VARCHAR(64) NOT NULL, -- comma separated, see api.AUTH_METHOD_*
+    INDEX (username, logged_in_at)
+);
@@ -0,0 +1,2 @@
+-- bumped by every profile edit, so an edit made from an outdated form can be refused
+ALTER TABLE users ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1;
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    DROP COLUMN last_login_at,
+    DROP COLUMN created_at,
+    DROP COLUMN timezone,
+    DROP COLUMN bio,
+    DROP COLUMN email;
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN email         VARCHAR(254) NULL,
+    ADD COLUMN bio           VARCHAR(500) NULL,
+    ADD COLUMN timezone      VARCHAR(64) NULL,  -- IANA name, e.g. Asia/Singapore
+    ADD COLUMN created_at    DATETIME NULL,     -- unknown for users created before this migration
+    ADD COLUMN last_login_at DATETIME NULL;
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS security_events_append_only;
+DROP TABLE IF EXISTS security_events;
@@ -0,0 +1,18 @@
+-- logins, logouts and account changes, newest last. Rows are only ever added, and deleted
+-- once past the retention period.
+CREATE TABLE IF NOT EXISTS security_events (
+    id         BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    at         DATETIME NOT NULL,
+    type       VARCHAR(32) NOT NULL,  -- see api.EVENT_*
+    username   VARCHAR(45) NOT NULL,  -- as given, for a failed login it may not exist
+    actor      VARCHAR(45) NOT NULL,  -- who acted, the user unless an admin is impersonating them
+    reason     VARCHAR(32) NOT NULL,  -- why a login failed, see api.REASON_*
+    detail     VARCHAR(255) NOT NULL,
+    request_id VARCHAR(64) NOT NULL,
+    ip         VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    INDEX (username, id),
+    INDEX (type, id),
+    INDEX (at)
+);
+CREATE TRIGGER security_events_append_only BEFORE UPDATE ON security_events FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'security_events is append-only';
@@ -0,0 +1,2 @@
+-- the last time step a code was accepted for, so that no code is accepted twice
+ALTER TABLE totp_secrets ADD COLUMN last_step BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"example.com/kendrick/internal/utils"
+	"github.com/go-sql-driver/mysql"
+	"time"
+)
+
+var mysqlDriver = driver{
+	name:        "MySQL",
+	open:        OpenMySQL,
+	migrate:     migrateMySQL,
+	queries:     mysqlQueries,
+	isDuplicate: isMySQLDuplicate,
+	isTransient: isMySQLTransient,
+	isStale:     isMySQLStale,
+}
+
+// Columns of a user, in the order of userRow.dest
+const userColumns = "username, nickname, pw_hash, COALESCE(profile_pic, ''), version, " +
+	"COALESCE(email, ''), COALESCE(bio, ''), COALESCE(timezone, ''), created_at, last_login_at"
+
+var mysqlQueries = map[int]string{
+	// deleted users are gone, bar their username, which stays taken until they are purged
+	GET_USER: "SELECT " + userColumns + " FROM users WHERE username = ? AND deleted_at IS NULL",
+	INSERT_USER: "INSERT INTO users (username, nickname, pw_hash, profile_pic, email, bio, timezone, created_at) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	// a NULL leaves the field as it is; changes nothing if the profile was edited since it was read
+	UPDATE_USER: "UPDATE users SET nickname=COALESCE(?, nickname), profile_pic=COALESCE(?, profile_pic), " +
+		"email=COALESCE(?, email), bio=COALESCE(?, bio), timezone=COALESCE(?, timezone), version=version+1 " +
+		"WHERE username=? AND version=? AND deleted_at IS NULL",
+	UPDATE_PW: "UPDATE users SET pw_hash=? WHERE username=? AND deleted_at IS NULL",
+	GET_TOTP:  "SELECT username, secret, enabled, last_step FROM totp_secrets WHERE username = ?",
+	// an enabled secret must never be silently replaced
+	SET_TOTP: "INSERT INTO totp_secrets (username, secret, enabled) VALUES (?, ?, FALSE) " +
+		"ON DUPLICATE KEY UPDATE secret = IF(enabled, secret, ?)",
+	ENABLE_TOTP:   "UPDATE totp_secrets SET enabled = TRUE WHERE username = ? AND enabled = FALSE",
+	USE_TOTP_STEP: "UPDATE totp_secrets SET last_step = ? WHERE username = ? AND last_step < ?",
+	USE_RECOVERY:  "UPDATE recovery_codes SET used = TRUE WHERE username = ? AND code_hash = ? AND used = FALSE",
+	GET_REMEMBER: "SELECT selector, validator_hash, family, username, expires, used, used_at " +
+		"FROM remember_tokens WHERE selector = ?",
+	INSERT_REMEMBER: "INSERT INTO remember_tokens " +
+		"(selector, validator_hash, family, username, expires, used) VALUES (?, ?, ?, ?, ?, FALSE)",
+	// a token can only be used once, even by concurrent requests
+	USE_REMEMBER:         "UPDATE remember_tokens SET used = TRUE, used_at = ? WHERE selector = ? AND used = FALSE",
+	DELETE_FAMILY:        "DELETE FROM remember_tokens WHERE family = ?",
+	DELETE_USER_REMEMBER: "DELETE FROM remember_tokens WHERE username = ?",
+	DELETE_USER:          "UPDATE users SET deleted_at = ? WHERE username = ? AND deleted_at IS NULL",
+	GET_DELETED:          "SELECT username FROM users WHERE deleted_at <= ?",
+	INSERT_LOGIN: "INSERT INTO login_history (username, logged_in_at, ip, user_agent, auth_methods) " +
+		"VALUES (?, ?, ?, ?, ?)",
+	GET_LOGINS: "SELECT username, logged_in_at, ip, user_agent, auth_methods FROM login_history " +
+		"WHERE username = ? ORDER BY logged_in_at DESC, id DESC",
+	GET_USERS: "SELECT " + userColumns + " FROM users " +
+		"WHERE username > ? AND deleted_at IS NULL ORDER BY username LIMIT ?",
+	SET_LAST_LOGIN: "UPDATE users SET last_login_at = ? WHERE username = ?",
+	INSERT_EVENT: "INSERT INTO security_events " +
+		"(at, type, username, actor, reason, detail, request_id, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	// an empty username or type matches every event
+	GET_EVENTS: "SELECT id, at, type, username, actor, reason, detail, request_id, ip, user_agent " +
+		"FROM security_events WHERE (? = '' OR username = ?) AND (? = '' OR type = ?) " +
+		"AND at >= ? AND at < ? AND id < ? ORDER BY id DESC LIMIT ?",
+	DELETE_EVENTS: "DELETE FROM security_events WHERE at < ?",
+}
+
+const DEFAULT_MYSQL_ADDR = "localhost:3306"
+
+// Opens the MySQL users database at addr (host:port), without checking that it is reachable
+func OpenMySQL(addr string) (*sql.DB, error) {
+	pw := utils.ReadPw()
+	sqlDB, err := sql.Open("mysql", "root:"+pw+"@tcp("+addr+")/users_db?parseTime=true")
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(100)
+	sqlDB.SetMaxIdleConns(150)
+	sqlDB.SetConnMaxLifetime(time.Second * 60)
+	return sqlDB, nil
+}
+
+func migrateMySQL(sqlDB *sql.DB) error {
+	migrator, err := NewMigrator(sqlDB)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up()
+	return err
+}
+
+func isMySQLDuplicate(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number == DUP_PKEY
+}
+
+// Deadlocks and lock wait timeouts roll the statement back, so it can safely run again.
+// A bad connection is only reported when the statement never reached the server.
+func isMySQLTransient(err error) bool {
+	if errors.Is(err, sqldriver.ErrBadConn) || isMySQLStale(err) {
+		return true
+	}
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && (me.Number == LOCK_DEADLOCK || me.Number == LOCK_WAIT_TIMEOUT)
+}
+
+func isMySQLStale(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == UNKNOWN_STMT_HANDLER
+}
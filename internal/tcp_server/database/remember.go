@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"example.com/kendrick/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// A remember-me token as stored: the validator only as a hash. Tokens are rotated on every
+// use; the used ones are kept until they expire, so a replayed token can be recognised.
+// All tokens descending from one login share a family.
+type RememberToken struct {
+	Selector      string
+	ValidatorHash string
+	Family        string
+	Username      string
+	Expires       time.Time
+	Used          bool
+	UsedAt        time.Time
+}
+
+func (db *DBStruct) GetRememberToken(ctx context.Context, selector string) (*RememberToken, error) {
+	db.ensureConnected()
+	var ret RememberToken
+	var usedAt sql.NullTime
+	primary, _ := db.pools()
+	err := db.queryRow(ctx, primary, GET_REMEMBER, []interface{}{
+		&ret.Selector, &ret.ValidatorHash, &ret.Family, &ret.Username, &ret.Expires, &ret.Used, &usedAt}, selector)
+	if err == sql.ErrNoRows {
+		return nil, ERR_REMEMBER_TOKEN_NOT_FOUND
+	}
+	if utils.IsError(err) {
+		return nil, err
+	}
+	ret.UsedAt = usedAt.Time
+	return &ret, nil
+}
+
+func (db *DBStruct) InsertRememberToken(ctx context.Context, token *RememberToken) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, INSERT_REMEMBER,
+		token.Selector, token.ValidatorHash, token.Family, token.Username, token.Expires)
+	if utils.IsError(err) {
+		return 0
+	}
+	log.Debug("INSERT remember token: username: " + token.Username + " | family: " + token.Family)
+	return rows
+}
+
+// Marks an unused token as used. Returns 1 if this call used it.
+func (db *DBStruct) UseRememberToken(ctx context.Context, selector string, usedAt time.Time) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, USE_REMEMBER, usedAt, selector)
+	if utils.IsError(err) {
+		return 0
+	}
+	return rows
+}
+
+func (db *DBStruct) DeleteRememberFamily(ctx context.Context, family string) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, DELETE_FAMILY, family)
+	if utils.IsError(err) {
+		return 0
+	}
+	log.Debug("DELETE remember family: " + family)
+	return rows
+}
+
+func (db *DBStruct) DeleteUserRememberTokens(ctx context.Context, username string) int64 {
+	db.ensureConnected()
+	rows, err := db.exec(ctx, DELETE_USER_REMEMBER, username)
+	if utils.IsError(err) {
+		return 0
+	}
+	log.Debug("DELETE remember tokens: username: " + username)
+	return rows
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Reads of users go to the read replicas, in turn, and everything else to the primary.
+Replication lags, so for a while after a user is written this server reads that user from
+the primary. Replicas are pinged in the background; one that fails a ping or a query is
+skipped until a ping succeeds again, and with no replica left reads go to the primary.
+*/
+
+// A connection pool and the statements prepared on it
+type pool struct {
+	addr       string
+	sqlDB      *sql.DB
+	mu         sync.RWMutex      // guards statements
+	statements map[int]*sql.Stmt // prepared on first use
+	healthy    int32             // replicas only, 1 if reads may use it
+}
+
+func newPool(addr string, sqlDB *sql.DB) *pool {
+	return &pool{
+		addr:       addr,
+		sqlDB:      sqlDB,
+		statements: make(map[int]*sql.Stmt),
+		healthy:    1,
+	}
+}
+
+func (p *pool) isHealthy() bool {
+	return atomic.LoadInt32(&p.healthy) == 1
+}
+
+func (p *pool) setHealthy(healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&p.healthy, value) != value {
+		if healthy {
+			log.Info("Replica ", p.addr, " is back, reading from it again")
+		} else {
+			log.Warn("Replica ", p.addr, " is down, reading from the primary instead")
+		}
+	}
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.sqlDB.Close()
+	p.statements = nil
+}
+
+// Opens the replicas, which are expected to have the schema replicated from the primary
+func (db *DBStruct) openReplicas() []*pool {
+	replicas := make([]*pool, 0, len(db.config.Replicas))
+	for _, addr := range db.config.Replicas {
+		sqlDB, err := db.driver.open(addr)
+		if err != nil {
+			log.Panicln(err)
+		}
+		replicas = append(replicas, newPool(addr, sqlDB))
+	}
+	db.pingReplicas(replicas)
+	return replicas
+}
+
+func (db *DBStruct) pingReplicas(replicas []*pool) {
+	for _, replica := range replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), db.config.QueryTimeout)
+		err := replica.sqlDB.PingContext(ctx)
+		cancel()
+		if err != nil {
+			log.Debug("Ping of replica ", replica.addr, ": ", err)
+		}
+		replica.setHealthy(err == nil)
+	}
+}
+
+func (db *DBStruct) checkReplicas(replicas []*pool, stop <-chan struct{}) {
+	ticker := time.NewTicker(db.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.pingReplicas(replicas)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Picks where to read a user from
+func (db *DBStruct) readPool(key string) *pool {
+	primary, replicas := db.pools()
+	if len(replicas) == 0 || db.recentlyWritten(key) {
+		return primary
+	}
+	start := int(atomic.AddUint32(&db.nextReplica, 1))
+	for i := range replicas {
+		replica := replicas[(start+i)%len(replicas)]
+		if replica.isHealthy() {
+			return replica
+		}
+	}
+	return primary
+}
+
+// Notes that a user was written, so it is read from the primary until the replicas have it
+func (db *DBStruct) wrote(key string) {
+	if len(db.config.Replicas) == 0 {
+		return
+	}
+	now := db.now()
+	db.writesMu.Lock()
+	defer db.writesMu.Unlock()
+	for written, until := range db.recentWrites {
+		if !now.Before(until) {
+			delete(db.recentWrites, written)
+		}
+	}
+	db.recentWrites[key] = now.Add(db.config.ReplicaLag)
+}
+
+func (db *DBStruct) recentlyWritten(key string) bool {
+	db.writesMu.Lock()
+	defer db.writesMu.Unlock()
+	until, ok := db.recentWrites[key]
+	return ok && db.now().Before(until)
+}
+
+func (db *DBStruct) pools() (*pool, []*pool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.primary, db.replicas
+}
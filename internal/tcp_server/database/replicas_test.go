@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A SQLite primary whose replica holds a different nickname for kendrick, so a lookup
+// shows where it was read from. Writes have to go to the primary.
+func newReplicatedDB(t *testing.T, prepareReplica func(path string)) (*DBStruct, *time.Time) {
+	dir := t.TempDir()
+	replica := filepath.Join(dir, "replica.db")
+	prepareReplica(replica)
+
+	userCache := cache.NewMemoryCache(time.Minute, 1000)
+	config := DefaultConfig()
+	config.Replicas = []string{replica}
+	config.ReplicaLag = time.Second
+	db, err := NewSQLiteDB(filepath.Join(dir, "primary.db"), userCache, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Disconnect()
+		userCache.Stop()
+	})
+	now := time.Unix(1600000000, 0)
+	ret := db.(*DBStruct)
+	ret.now = func() time.Time { return now }
+	if ret.InsertUser(context.Background(), "kendrick", "hash", "primary") != 1 {
+		t.Fatal("insert failed")
+	}
+	return ret, &now
+}
+
+func withReplicaUser(t *testing.T) func(path string) {
+	return func(path string) {
+		userCache := cache.NewMemoryCache(time.Minute, 1000)
+		defer userCache.Stop()
+		db, err := NewSQLiteDB(path, userCache, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Disconnect()
+		db.InsertUser(context.Background(), "kendrick", "hash", "replica")
+	}
+}
+
+// Looks kendrick up, bypassing the cache
+func readNickname(t *testing.T, db *DBStruct) string {
+	db.users.invalidate("kendrick")
+	user, err := db.GetUser(context.Background(), "kendrick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Nickname
+}
+
+func TestReadsGoToReplica(t *testing.T) {
+	db, now := newReplicatedDB(t, withReplicaUser(t))
+	if got := readNickname(t, db); got != "primary" {
+		t.Fatalf("a user just written should be read from the primary, got %v", got)
+	}
+	*now = now.Add(time.Second)
+	if got := readNickname(t, db); got != "replica" {
+		t.Fatalf("got %v", got)
+	}
+
+	if db.UpdateUser(context.Background(), "kendrick", patch("edited", ""), 1) != 1 {
+		t.Fatal("update failed")
+	}
+	if got := readNickname(t, db); got != "edited" {
+		t.Fatalf("an edited user should be read from the primary, got %v", got)
+	}
+	*now = now.Add(time.Second)
+	if got := readNickname(t, db); got != "replica" {
+		t.Fatalf("writes must not reach the replica, got %v", got)
+	}
+}
+
+func TestUnhealthyReplicaSkipped(t *testing.T) {
+	db, now := newReplicatedDB(t, withReplicaUser(t))
+	*now = now.Add(time.Second)
+	db.replicas[0].setHealthy(false)
+	if got := readNickname(t, db); got != "primary" {
+		t.Fatalf("got %v", got)
+	}
+	db.pingReplicas(db.replicas)
+	if got := readNickname(t, db); got != "replica" {
+		t.Fatalf("a replica answering pings should be used again, got %v", got)
+	}
+}
+
+func TestFailingReplica(t *testing.T) {
+	// the replica isn't set up as one, so it has no users table
+	db, now := newReplicatedDB(t, func(path string) {})
+	*now = now.Add(time.Second)
+	if got := readNickname(t, db); got != "primary" {
+		t.Fatalf("got %v", got)
+	}
+	if db.replicas[0].isHealthy() {
+		t.Fatal("a replica failing queries should be skipped")
+	}
+}
+
+func TestReplicaDownAtStartup(t *testing.T) {
+	dir := t.TempDir()
+	userCache := cache.NewMemoryCache(time.Minute, 1000)
+	defer userCache.Stop()
+	config := DefaultConfig()
+	config.Replicas = []string{filepath.Join(dir, "missing", "replica.db")}
+	db, err := NewSQLiteDB(filepath.Join(dir, "primary.db"), userCache, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Disconnect()
+	if db.(*DBStruct).replicas[0].isHealthy() {
+		t.Fatal("a replica failing pings should be skipped")
+	}
+	db.InsertUser(context.Background(), "kendrick", "hash", "primary")
+	if user, err := db.GetUser(context.Background(), "kendrick"); err != nil || user.Nickname != "primary" {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+/**
+Queries that fail for reasons that go away by themselves, a deadlock or a dropped
+connection, are retried after a jittered, exponentially growing delay. Which errors those
+are depends on the driver. Statements are prepared on first use, so after a reconnect, or
+once the server has forgotten a statement, they are transparently prepared again.
+*/
+
+// Runs query until it succeeds, fails for good, or runs out of retries. Each attempt has
+// its own timeout. query must be safe to run again after a failed attempt.
+func (db *DBStruct) retry(ctx context.Context, query func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := db.attempt(ctx, query)
+		if err == nil || attempt >= db.config.MaxRetries || !db.driver.isTransient(err) {
+			return err
+		}
+		delay := backoff(attempt, db.config.RetryDelay, db.config.MaxDelay, db.jitter)
+		log.Warn("Retrying query in ", delay, ", it failed with: ", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (db *DBStruct) attempt(ctx context.Context, query func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, db.config.QueryTimeout)
+	defer cancel()
+	return query(ctx)
+}
+
+// The delay before retry number attempt (from 0): random up to delay doubled attempt
+// times, so that clients that failed together don't retry together
+func backoff(attempt int, delay time.Duration, max time.Duration, jitter func(n int64) int64) time.Duration {
+	ceiling := delay
+	for i := 0; i < attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max {
+		ceiling = max
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(jitter(int64(ceiling) + 1))
+}
+
+var defaultJitter = rand.Int63n
+
+// Returns the prepared statement for a query on a pool, preparing it if needed
+func (db *DBStruct) stmt(ctx context.Context, p *pool, key int) (*sql.Stmt, error) {
+	p.mu.RLock()
+	stmt, ok := p.statements[key]
+	p.mu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stmt, ok := p.statements[key]; ok {
+		return stmt, nil
+	}
+	if p.statements == nil {
+		return nil, sql.ErrConnDone
+	}
+	stmt, err := p.sqlDB.PrepareContext(ctx, db.driver.queries[key])
+	if err != nil {
+		return nil, err
+	}
+	p.statements[key] = stmt
+	return stmt, nil
+}
+
+// Forgets a statement the database no longer knows, so that it is prepared again
+func (db *DBStruct) checkStale(p *pool, key int, stmt *sql.Stmt, err error) {
+	if !db.driver.isStale(err) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.statements[key] == stmt {
+		delete(p.statements, key)
+		_ = stmt.Close()
+	}
+}
+
+// Runs a prepared statement that changes rows on the primary, returning how many it changed
+func (db *DBStruct) exec(ctx context.Context, key int, args ...interface{}) (int64, error) {
+	primary, _ := db.pools()
+	var rows int64
+	err := db.retry(ctx, func(ctx context.Context) error {
+		stmt, err := db.stmt(ctx, primary, key)
+		if err != nil {
+			return err
+		}
+		result, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			db.checkStale(primary, key, stmt, err)
+			return err
+		}
+		rows, err = result.RowsAffected()
+		return err
+	})
+	return rows, err
+}
+
+// Runs a prepared statement returning at most one row, scanned into dest
+func (db *DBStruct) queryRow(ctx context.Context, p *pool, key int, dest []interface{}, args ...interface{}) error {
+	return db.retry(ctx, func(ctx context.Context) error {
+		stmt, err := db.stmt(ctx, p, key)
+		if err != nil {
+			return err
+		}
+		err = stmt.QueryRowContext(ctx, args...).Scan(dest...)
+		db.checkStale(p, key, stmt, err)
+		return err
+	})
+}
+
+// Runs a prepared statement returning any number of rows, handed to scan. scan runs again
+// if the query is retried, so it must start its result afresh.
+func (db *DBStruct) query(ctx context.Context, p *pool, key int, scan func(rows *sql.Rows) error, args ...interface{}) error {
+	return db.retry(ctx, func(ctx context.Context) error {
+		stmt, err := db.stmt(ctx, p, key)
+		if err != nil {
+			return err
+		}
+		rows, err := stmt.QueryContext(ctx, args...)
+		if err != nil {
+			db.checkStale(p, key, stmt, err)
+			return err
+		}
+		defer rows.Close()
+		if err := scan(rows); err != nil {
+			return err
+		}
+		return rows.Err()
+	})
+}
+
+// Runs body in a transaction on the primary, retrying the whole transaction
+func (db *DBStruct) transaction(ctx context.Context, body func(ctx context.Context, tx *sql.Tx) error) error {
+	primary, _ := db.pools()
+	return db.retry(ctx, func(ctx context.Context) error {
+		tx, err := primary.sqlDB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := body(ctx, tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("transient")
+
+func newRetryDB(maxRetries int) *DBStruct {
+	return &DBStruct{
+		driver: driver{
+			isTransient: func(err error) bool { return err == errTransient },
+		},
+		config: Config{
+			QueryTimeout: time.Second,
+			MaxRetries:   maxRetries,
+			RetryDelay:   time.Millisecond,
+			MaxDelay:     4 * time.Millisecond,
+		},
+		jitter: func(n int64) int64 { return n - 1 },
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	highest := func(n int64) int64 { return n - 1 }
+	for attempt, want := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		if got := backoff(attempt, 10, 100, highest); got != want {
+			t.Errorf("attempt %v: got %v, want %v", attempt, got, want)
+		}
+	}
+	if got := backoff(3, 10, 100, func(n int64) int64 { return 0 }); got != 0 {
+		t.Errorf("jitter can reach 0, got %v", got)
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	db := newRetryDB(3)
+	calls := 0
+	err := db.retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("got %v after %v calls", err, calls)
+	}
+
+	calls = 0
+	err = db.retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errTransient
+	})
+	if err != errTransient || calls != 4 {
+		t.Fatalf("retries should be bounded, got %v after %v calls", err, calls)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	db := newRetryDB(3)
+	permanent := errors.New("permanent")
+	calls := 0
+	err := db.retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return permanent
+	})
+	if err != permanent || calls != 1 {
+		t.Fatalf("got %v after %v calls", err, calls)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	db := newRetryDB(3)
+	db.config.RetryDelay = time.Hour
+	db.config.MaxDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := db.retry(ctx, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errTransient
+	})
+	if err != errTransient || calls != 1 {
+		t.Fatalf("got %v after %v calls", err, calls)
+	}
+}
+
+func TestRetryQueryTimeout(t *testing.T) {
+	db := newRetryDB(0)
+	db.config.QueryTimeout = time.Millisecond
+	err := db.retry(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"github.com/mattn/go-sqlite3"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// Returns a users database in a SQLite file, for development and CI without MySQL.
+// Needs cgo.
+func NewSQLiteDB(path string, userCache cache.DBCache, config Config) (DB, error) {
+	config.Primary = path
+	return newDBStruct(sqliteDriver(), userCache, config), nil
+}
+
+// Replicas are other files, kept in step by whatever copies the primary
+func sqliteDriver() driver {
+	queries := make(map[int]string, len(mysqlQueries))
+	for key, query := range mysqlQueries {
+		queries[key] = query
+	}
+	// the WHERE leaves an enabled secret alone and reports no row changed
+	queries[SET_TOTP] = "INSERT INTO totp_secrets (username, secret, enabled) VALUES (?, ?, FALSE) " +
+		"ON CONFLICT (username) DO UPDATE SET secret = ? WHERE NOT enabled"
+	return driver{
+		name: "SQLite",
+		open: func(path string) (*sql.DB, error) {
+			sqlDB, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+			if err != nil {
+				return nil, err
+			}
+			// SQLite allows one writer at a time; one connection avoids SQLITE_BUSY
+			sqlDB.SetMaxOpenConns(1)
+			return sqlDB, nil
+		},
+		migrate:     migrateSQLite,
+		queries:     queries,
+		isDuplicate: isSQLiteDuplicate,
+		isTransient: isSQLiteTransient,
+		isStale:     isSQLiteStale,
+	}
+}
+
+func migrateSQLite(sqlDB *sql.DB) error {
+	for _, statement := range splitStatements(sqliteSchema) {
+		if _, err := sqlDB.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSQLiteDuplicate(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+// Another connection, e.g. of a second process, holds the database lock
+func isSQLiteTransient(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked) || isSQLiteStale(err)
+}
+
+// The schema changed since the statement was prepared
+func isSQLiteStale(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && se.Code == sqlite3.ErrSchema
+}
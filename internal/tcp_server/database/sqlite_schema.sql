@@ -0,0 +1,63 @@
+-- The schema the MySQL migrations build, for SQLite. Development and CI databases are
+-- created from scratch, so this is not versioned.
+CREATE TABLE IF NOT EXISTS users (
+    username      VARCHAR(45) NOT NULL PRIMARY KEY,
+    nickname      VARCHAR(45) NOT NULL,
+    pw_hash       CHAR(60) NOT NULL,
+    profile_pic   VARCHAR(255) NULL,
+    deleted_at    DATETIME NULL,
+    version       INTEGER NOT NULL DEFAULT 1,
+    email         VARCHAR(254) NULL,
+    bio           VARCHAR(500) NULL,
+    timezone      VARCHAR(64) NULL,
+    created_at    DATETIME NULL,
+    last_login_at DATETIME NULL
+);
+CREATE TABLE IF NOT EXISTS totp_secrets (
+    username  VARCHAR(45) NOT NULL PRIMARY KEY,
+    secret    VARCHAR(255) NOT NULL,
+    enabled   BOOLEAN NOT NULL DEFAULT FALSE,
+    last_step BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    username  VARCHAR(45) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used      BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, code_hash)
+);
+CREATE TABLE IF NOT EXISTS remember_tokens (
+    selector       CHAR(24) NOT NULL PRIMARY KEY,
+    validator_hash CHAR(64) NOT NULL,
+    family         CHAR(24) NOT NULL,
+    username       VARCHAR(45) NOT NULL,
+    expires        DATETIME NOT NULL,
+    used           BOOLEAN NOT NULL DEFAULT FALSE,
+    used_at        DATETIME NULL
+);
+CREATE INDEX IF NOT EXISTS remember_tokens_family ON remember_tokens (family);
+CREATE INDEX IF NOT EXISTS remember_tokens_username ON remember_tokens (username);
+CREATE TABLE IF NOT EXISTS login_history (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    username     VARCHAR(45) NOT NULL,
+    logged_in_at DATETIME NOT NULL,
+    ip           VARCHAR(45) NOT NULL,
+    user_agent   VARCHAR(255) NOT NULL,
+    auth_methods VARCHAR(64) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_history_username ON login_history (username, logged_in_at);
+CREATE TABLE IF NOT EXISTS security_events (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    at         DATETIME NOT NULL,
+    type       VARCHAR(32) NOT NULL,
+    username   VARCHAR(45) NOT NULL,
+    actor      VARCHAR(45) NOT NULL,
+    reason     VARCHAR(32) NOT NULL,
+    detail     VARCHAR(255) NOT NULL,
+    request_id VARCHAR(64) NOT NULL,
+    ip         VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS security_events_username ON security_events (username, id);
+CREATE INDEX IF NOT EXISTS security_events_type ON security_events (type, id);
+CREATE INDEX IF NOT EXISTS security_events_at ON security_events (at);
+CREATE TRIGGER IF NOT EXISTS security_events_append_only BEFORE UPDATE ON security_events BEGIN SELECT RAISE(ABORT, 'security_events is append-only'); END;
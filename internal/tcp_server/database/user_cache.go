@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/cache"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+/**
+Cache-aside reads of users. A lookup that finds no user is cached too, for a shorter
+time, so that unknown usernames don't each cost a query. Concurrent misses on one username
+share a single query. Writes invalidate the cached user once they are committed; a query
+that was in flight at the time may have read the old row, so its result isn't cached.
+Other servers sharing the cache can still cache an old row they read just before the
+write, for at most the TTL.
+*/
+
+type userLoader struct {
+	cache       cache.DBCache
+	ttl         time.Duration // of a found user
+	notFoundTTL time.Duration // of a lookup that found no user
+	load        func(ctx context.Context, key string) ([]api.User, error)
+	timeout     time.Duration // bounds a shared query, whose callers may give up on it
+	flights     singleflight.Group
+
+	mu            sync.Mutex
+	invalidations uint64 // how many invalidations there have been
+}
+
+func newUserLoader(userCache cache.DBCache, config Config, load func(ctx context.Context, key string) ([]api.User, error)) *userLoader {
+	return &userLoader{
+		cache:       userCache,
+		ttl:         config.UserTTL,
+		notFoundTTL: config.NotFoundTTL,
+		load:        load,
+		timeout:     config.QueryTimeout * time.Duration(config.MaxRetries+1),
+	}
+}
+
+// Returns the user as cached: a single row, or none if there is no such user
+func (l *userLoader) get(ctx context.Context, key string) ([]api.User, error) {
+	users, err := l.cache.GetUser(key)
+	if err == nil {
+		return users, nil
+	}
+	if err != cache.ERR_CACHE_MISS {
+		log.Error(err)
+	}
+	// the query isn't tied to ctx, as other callers may share it
+	flight := l.flights.DoChan(key, func() (interface{}, error) {
+		return l.loadAndCache(key)
+	})
+	select {
+	case res := <-flight:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]api.User), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *userLoader) loadAndCache(key string) ([]api.User, error) {
+	// a caller that just missed the previous flight finds its result here
+	if users, err := l.cache.GetUser(key); err == nil {
+		return users, nil
+	}
+	l.mu.Lock()
+	start := l.invalidations
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	users, err := l.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := l.ttl
+	if len(users) < 1 {
+		ttl = l.notFoundTTL
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// holding mu, so no invalidation can come between the check and the write
+	if l.invalidations == start {
+		if err := l.cache.SetUser(key, users, ttl); err != nil {
+			log.Error(err)
+		}
+	}
+	return users, nil
+}
+
+// Drops a cached user, after the user was written
+func (l *userLoader) invalidate(key string) {
+	l.mu.Lock()
+	l.invalidations++
+	// later callers must not share a query that may have read the old row
+	l.flights.Forget(key)
+	err := l.cache.DeleteUser(key)
+	l.mu.Unlock()
+	if err != nil {
+		log.Error(err)
+	}
+}
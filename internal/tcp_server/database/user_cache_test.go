@@ -0,0 +1,209 @@
+package database
+
+import (
+	"context"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the TTL users are cached with
+type ttlCache struct {
+	cache.DBCache
+	mu   sync.Mutex
+	ttls map[string]time.Duration
+}
+
+func (c *ttlCache) SetUser(key string, user []api.User, ttl time.Duration) error {
+	c.mu.Lock()
+	c.ttls[key] = ttl
+	c.mu.Unlock()
+	return c.DBCache.SetUser(key, user, ttl)
+}
+
+// A query that runs until the test releases it. Call n reports on started, then returns
+// what is sent on release[n].
+type blockingLoad struct {
+	mu      sync.Mutex
+	calls   int
+	started chan int
+	release []chan []api.User
+}
+
+func newBlockingLoad(calls int) *blockingLoad {
+	ret := &blockingLoad{started: make(chan int, calls)}
+	for i := 0; i < calls; i++ {
+		ret.release = append(ret.release, make(chan []api.User, 1))
+	}
+	return ret
+}
+
+func (l *blockingLoad) load(ctx context.Context, key string) ([]api.User, error) {
+	l.mu.Lock()
+	n := l.calls
+	l.calls++
+	l.mu.Unlock()
+	l.started <- n
+	return <-l.release[n], nil
+}
+
+func (l *blockingLoad) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls
+}
+
+func newTestLoader(t *testing.T, load func(ctx context.Context, key string) ([]api.User, error)) (*userLoader, *ttlCache) {
+	memory := cache.NewMemoryCache(time.Hour, 1000)
+	t.Cleanup(memory.Stop)
+	userCache := &ttlCache{DBCache: memory, ttls: make(map[string]time.Duration)}
+	config := DefaultConfig()
+	config.UserTTL = time.Minute
+	config.NotFoundTTL = time.Second
+	return newUserLoader(userCache, config, load), userCache
+}
+
+func TestUserLoaderCachesNotFound(t *testing.T) {
+	calls := 0
+	loader, userCache := newTestLoader(t, func(ctx context.Context, key string) ([]api.User, error) {
+		calls++
+		if key == "kendrick" {
+			return []api.User{{Username: key}}, nil
+		}
+		return []api.User{}, nil
+	})
+	for i := 0; i < 3; i++ {
+		if users, err := loader.get(context.Background(), "nobody"); err != nil || len(users) != 0 {
+			t.Fatalf("got %v, %v", users, err)
+		}
+		if users, err := loader.get(context.Background(), "kendrick"); err != nil || len(users) != 1 {
+			t.Fatalf("got %v, %v", users, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("each username should be queried once, got %v queries", calls)
+	}
+	if userCache.ttls["nobody"] != time.Second || userCache.ttls["kendrick"] != time.Minute {
+		t.Fatalf("not found results need the shorter ttl, got %v", userCache.ttls)
+	}
+}
+
+func TestUserLoaderCoalescesMisses(t *testing.T) {
+	blocking := newBlockingLoad(2)
+	loader, _ := newTestLoader(t, blocking.load)
+	var wg sync.WaitGroup
+	results := make(chan []api.User, 50)
+	get := func() {
+		defer wg.Done()
+		users, err := loader.get(context.Background(), "kendrick")
+		if err != nil {
+			t.Error(err)
+		}
+		results <- users
+	}
+	wg.Add(1)
+	go get()
+	<-blocking.started
+	// whether these join the running query or come too late for it, none queries again
+	for i := 1; i < cap(results); i++ {
+		wg.Add(1)
+		go get()
+	}
+	blocking.release[0] <- []api.User{{Username: "kendrick"}}
+	wg.Wait()
+	close(results)
+
+	if blocking.count() != 1 {
+		t.Fatalf("concurrent misses should share one query, got %v", blocking.count())
+	}
+	for users := range results {
+		if len(users) != 1 || users[0].Username != "kendrick" {
+			t.Fatalf("got %v", users)
+		}
+	}
+}
+
+func TestUserLoaderInvalidateDuringQuery(t *testing.T) {
+	blocking := newBlockingLoad(2)
+	loader, userCache := newTestLoader(t, blocking.load)
+	done := make(chan []api.User)
+	go func() {
+		users, _ := loader.get(context.Background(), "kendrick")
+		done <- users
+	}()
+	<-blocking.started
+	// a write commits while the query may have read the row before it
+	loader.invalidate("kendrick")
+	blocking.release[0] <- []api.User{}
+	if users := <-done; len(users) != 0 {
+		t.Fatalf("got %v", users)
+	}
+	if _, err := userCache.GetUser("kendrick"); err != cache.ERR_CACHE_MISS {
+		t.Fatal("a query overtaken by a write must not be cached")
+	}
+
+	blocking.release[1] <- []api.User{{Username: "kendrick"}}
+	if users, _ := loader.get(context.Background(), "kendrick"); len(users) != 1 {
+		t.Fatalf("the write should be visible, got %v", users)
+	}
+	if blocking.count() != 2 {
+		t.Fatalf("got %v queries", blocking.count())
+	}
+}
+
+func TestUserLoaderInvalidateForgetsQuery(t *testing.T) {
+	blocking := newBlockingLoad(2)
+	loader, _ := newTestLoader(t, blocking.load)
+	first := make(chan []api.User)
+	go func() {
+		users, _ := loader.get(context.Background(), "kendrick")
+		first <- users
+	}()
+	<-blocking.started
+	loader.invalidate("kendrick")
+
+	second := make(chan []api.User)
+	go func() {
+		users, _ := loader.get(context.Background(), "kendrick")
+		second <- users
+	}()
+	// a lookup after the write gets its own query, rather than waiting on the old one
+	if n := <-blocking.started; n != 1 {
+		t.Fatalf("got query %v", n)
+	}
+	blocking.release[1] <- []api.User{{Username: "kendrick", Nickname: "new"}}
+	if users := <-second; len(users) != 1 || users[0].Nickname != "new" {
+		t.Fatalf("got %v", users)
+	}
+	blocking.release[0] <- []api.User{{Username: "kendrick", Nickname: "old"}}
+	<-first
+	if users, _ := loader.get(context.Background(), "kendrick"); len(users) != 1 || users[0].Nickname != "new" {
+		t.Fatalf("the old query must not overwrite the cache, got %v", users)
+	}
+}
+
+func TestUserLoaderCallerGivesUp(t *testing.T) {
+	blocking := newBlockingLoad(1)
+	loader, _ := newTestLoader(t, blocking.load)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := loader.get(ctx, "kendrick")
+		done <- err
+	}()
+	<-blocking.started
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+	// the shared query still completes and is cached for the next caller
+	blocking.release[0] <- []api.User{{Username: "kendrick"}}
+	if users, err := loader.get(context.Background(), "kendrick"); err != nil || len(users) != 1 {
+		t.Fatalf("got %v, %v", users, err)
+	}
+	if blocking.count() != 1 {
+		t.Fatalf("got %v queries", blocking.count())
+	}
+}
@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+Breached passwords are stored as a sorted array of truncated SHA-1 digests:
+
+	magic "BPW1" | uint32 count | count * uint64 (first 8 bytes of sha1(password))
+
+all big-endian. 8 bytes per entry keeps a list of a million passwords at 8MB, and the odds
+of a strong password colliding with a 64-bit prefix are negligible.
+*/
+
+const (
+	BREACHED_MAGIC = "BPW1"
+)
+
+var (
+	ERR_BAD_BREACHED_LIST = errors.New("Not a breached password list")
+)
+
+type BreachedList struct {
+	digests []uint64 // sorted
+}
+
+// Loads a list written by WriteBreachedList
+func LoadBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ReadBreachedList(bufio.NewReader(file), info.Size())
+}
+
+// Reads a list of size bytes, header included
+func ReadBreachedList(r io.Reader, size int64) (*BreachedList, error) {
+	header := make([]byte, len(BREACHED_MAGIC)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(BREACHED_MAGIC)]) != BREACHED_MAGIC {
+		return nil, ERR_BAD_BREACHED_LIST
+	}
+	count := binary.BigEndian.Uint32(header[len(BREACHED_MAGIC):])
+	// a corrupt count must not make us allocate more than the list holds
+	if int64(count)*8 > size-int64(len(header)) {
+		return nil, ERR_BAD_BREACHED_LIST
+	}
+	digests := make([]uint64, count)
+	if err := binary.Read(r, binary.BigEndian, digests); err != nil {
+		return nil, err
+	}
+	if !sort.SliceIsSorted(digests, func(i, j int) bool { return digests[i] < digests[j] }) {
+		return nil, ERR_BAD_BREACHED_LIST
+	}
+	return &BreachedList{digests: digests}, nil
+}
+
+// Writes passwords in the compact on-disk format
+func WriteBreachedList(w io.Writer, passwords []string) error {
+	digests := make([]uint64, 0, len(passwords))
+	seen := make(map[uint64]bool, len(passwords))
+	for _, pw := range passwords {
+		d := digest(pw)
+		if !seen[d] {
+			seen[d] = true
+			digests = append(digests, d)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+
+	header := make([]byte, len(BREACHED_MAGIC)+4)
+	copy(header, BREACHED_MAGIC)
+	binary.BigEndian.PutUint32(header[len(BREACHED_MAGIC):], uint32(len(digests)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, digests)
+}
+
+// Checks if a password appears in the list
+func (list *BreachedList) Contains(pw string) bool {
+	d := digest(pw)
+	i := sort.Search(len(list.digests), func(i int) bool { return list.digests[i] >= d })
+	return i < len(list.digests) && list.digests[i] == d
+}
+
+func (list *BreachedList) Len() int {
+	return len(list.digests)
+}
+
+func digest(pw string) uint64 {
+	sum := sha1.Sum([]byte(pw))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,146 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/*
+This package decides which usernames and passwords are acceptable. It is evaluated by the
+TCP server so that every client gets the same rules.
+*/
+
+// Fields a violation can refer to
+const (
+	FIELD_USERNAME = "username"
+	FIELD_PASSWORD = "password"
+)
+
+// Character classes a password can be required to contain
+const (
+	CLASS_LOWER  = "lower"
+	CLASS_UPPER  = "upper"
+	CLASS_DIGIT  = "digit"
+	CLASS_SYMBOL = "symbol"
+)
+
+const (
+	MAX_USERNAME_LENGTH = 45
+	MAX_PASSWORD_LENGTH = 72 // bcrypt ignores anything longer
+)
+
+type Violation struct {
+	Field   string
+	Message string
+}
+
+type Policy struct {
+	MinLength       int
+	RequiredClasses []string      // any of the CLASS_ constants
+	ForbidUsername  bool          // password may not contain the username
+	Breached        *BreachedList // nil disables the check
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:       8,
+		RequiredClasses: []string{CLASS_LOWER, CLASS_DIGIT},
+		ForbidUsername:  true,
+	}
+}
+
+// Checks a username, returns nil if acceptable
+func (p *Policy) CheckUsername(username string) []Violation {
+	var ret []Violation
+	if strings.TrimSpace(username) == "" {
+		ret = append(ret, Violation{FIELD_USERNAME, "Username is required."})
+	} else if len(username) > MAX_USERNAME_LENGTH {
+		ret = append(ret, Violation{FIELD_USERNAME, fmt.Sprintf("Username must be at most %v characters.", MAX_USERNAME_LENGTH)})
+	}
+	// usernames name files, such as profile pictures
+	if strings.TrimSpace(username) != "" && strings.IndexFunc(username, func(r rune) bool { return !isUsernameChar(r) }) >= 0 {
+		ret = append(ret, Violation{FIELD_USERNAME, "Username may only contain letters, digits, '.', '_' and '-'."})
+	}
+	return ret
+}
+
+func isUsernameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-'
+}
+
+// Checks a password chosen by username, returns nil if acceptable
+func (p *Policy) CheckPassword(username string, pw string) []Violation {
+	var ret []Violation
+	add := func(msg string) {
+		ret = append(ret, Violation{FIELD_PASSWORD, msg})
+	}
+	if len([]rune(pw)) < p.MinLength {
+		add(fmt.Sprintf("Password must be at least %v characters.", p.MinLength))
+	}
+	if len(pw) > MAX_PASSWORD_LENGTH {
+		add(fmt.Sprintf("Password must be at most %v bytes.", MAX_PASSWORD_LENGTH))
+	}
+	for _, class := range p.RequiredClasses {
+		if !hasClass(pw, class) {
+			add("Password must contain a " + classDesc(class) + ".")
+		}
+	}
+	if p.ForbidUsername && len(username) >= 3 && strings.Contains(strings.ToLower(pw), strings.ToLower(username)) {
+		add("Password must not contain your username.")
+	}
+	if p.Breached != nil && p.Breached.Contains(pw) {
+		add("Password appears in a list of breached passwords, please choose another.")
+	}
+	return ret
+}
+
+// Checks a new account, returns nil if acceptable
+func (p *Policy) Check(username string, pw string) []Violation {
+	return append(p.CheckUsername(username), p.CheckPassword(username, pw)...)
+}
+
+// Groups violations by field, joining multiple messages for the same field
+func ByField(violations []Violation) map[string]string {
+	ret := make(map[string]string, len(violations))
+	for _, v := range violations {
+		if msg, ok := ret[v.Field]; ok {
+			ret[v.Field] = msg + " " + v.Message
+		} else {
+			ret[v.Field] = v.Message
+		}
+	}
+	return ret
+}
+
+// Checks that names passed in configuration are known character classes
+func IsClass(class string) bool {
+	return classDesc(class) != ""
+}
+
+func hasClass(pw string, class string) bool {
+	for _, r := range pw {
+		switch {
+		case class == CLASS_LOWER && unicode.IsLower(r),
+			class == CLASS_UPPER && unicode.IsUpper(r),
+			class == CLASS_DIGIT && unicode.IsDigit(r),
+			class == CLASS_SYMBOL && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r):
+			return true
+		}
+	}
+	return false
+}
+
+func classDesc(class string) string {
+	switch class {
+	case CLASS_LOWER:
+		return "lowercase letter"
+	case CLASS_UPPER:
+		return "uppercase letter"
+	case CLASS_DIGIT:
+		return "digit"
+	case CLASS_SYMBOL:
+		return "symbol"
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package policy
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	p := &Policy{
+		MinLength:       8,
+		RequiredClasses: []string{CLASS_LOWER, CLASS_UPPER, CLASS_DIGIT, CLASS_SYMBOL},
+		ForbidUsername:  true,
+	}
+	tests := []struct {
+		pw   string
+		want int // number of violations
+	}{
+		{"Corr3ct-horse", 0},
+		{"", 5},
+		{"Sh0rt!", 1},
+		{"alllowercase", 3},
+		{"xKendrick1!", 1},
+	}
+	for _, test := range tests {
+		got := p.CheckPassword("kendrick", test.pw)
+		if len(got) != test.want {
+			t.Errorf("CheckPassword(%q): got %v", test.pw, got)
+		}
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	p := DefaultPolicy()
+	if v := p.CheckUsername(" "); len(v) != 1 || v[0].Field != FIELD_USERNAME {
+		t.Errorf("blank username: got %v", v)
+	}
+	if v := p.CheckUsername("kendrick"); v != nil {
+		t.Errorf("valid username: got %v", v)
+	}
+	for _, username := range []string{"../x", "a/b", "a b", "ké"} {
+		if v := p.CheckUsername(username); len(v) != 1 {
+			t.Errorf("%q: got %v", username, v)
+		}
+	}
+}
+
+func TestByField(t *testing.T) {
+	got := ByField([]Violation{
+		{FIELD_PASSWORD, "Too short."},
+		{FIELD_USERNAME, "Required."},
+		{FIELD_PASSWORD, "Needs a digit."},
+	})
+	want := map[string]string{
+		FIELD_PASSWORD: "Too short. Needs a digit.",
+		FIELD_USERNAME: "Required.",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBreachedListRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteBreachedList(&buf, []string{"hunter2", "password", "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ReadBreachedList(&buf, int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 2 {
+		t.Errorf("duplicates should be dropped, got %v entries", list.Len())
+	}
+	if !list.Contains("hunter2") || !list.Contains("password") || list.Contains("Corr3ct-horse") {
+		t.Error("unexpected Contains result")
+	}
+
+	p := DefaultPolicy()
+	p.Breached = list
+	if v := p.CheckPassword("kendrick", "password"); len(v) != 2 {
+		t.Errorf("breached password: got %v", v)
+	}
+}
+
+func TestShippedBreachedList(t *testing.T) {
+	list, err := LoadBreachedList(filepath.Join(".", "breached.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains("password123") {
+		t.Error("shipped list should contain password123")
+	}
+}
+
+func TestReadBreachedListBadMagic(t *testing.T) {
+	if _, err := ReadBreachedList(bytes.NewBufferString("NOPE\x00\x00\x00\x00"), 8); err != ERR_BAD_BREACHED_LIST {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestReadBreachedListBadCount(t *testing.T) {
+	// claims 2^32-1 digests but holds one
+	list := "BPW1\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x01"
+	if _, err := ReadBreachedList(bytes.NewBufferString(list), int64(len(list))); err != ERR_BAD_BREACHED_LIST {
+		t.Errorf("got %v", err)
+	}
+}
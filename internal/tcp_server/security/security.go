@@ -1,10 +1,21 @@
 package security
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 )
 
+var (
+	ERR_CIPHERTEXT_TOO_SHORT = errors.New("Ciphertext too short")
+)
+
 // Returns the immutable string hash of a password; error is nil if success
 func Hash(pw string) string {
 	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.MinCost)
@@ -30,3 +41,68 @@ func ComparePwHashBytes(pw []byte, hash []byte) bool {
 	}
 	return true
 }
+
+// Derives a 32 byte AES-256 key from a secret read from configs/
+func DeriveKey(secret []byte) []byte {
+	sum := sha256.Sum256(secret)
+	return sum[:]
+}
+
+// Encrypts plaintext with AES-GCM, returning base64(nonce | ciphertext)
+func Encrypt(plaintext string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Reverses Encrypt; fails if the ciphertext was tampered with or the key is wrong
+func Decrypt(ciphertext string, key []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", ERR_CIPHERTEXT_TOO_SHORT
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Returns a url-safe random token with n bytes of entropy
+func RandomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalln(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Returns the hex sha256 of a high-entropy token (e.g. recovery codes), for storing at rest.
+// Not suitable for passwords, use Hash instead.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
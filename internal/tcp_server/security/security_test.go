@@ -13,3 +13,18 @@ func BenchmarkComparePwHash(b *testing.B) {
 		ComparePwHash("password", "$2a$10$sJXc15p4plrW8Sds.o5d0uUzSKBFAha35f3e79Mgl6oCS1eeEWq6W")
 	}
 }
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := DeriveKey([]byte("secret"))
+	ciphertext, err := Encrypt("JBSWY3DPEHPK3PXP", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Decrypt(ciphertext, key)
+	if err != nil || plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("got %v, %v", plaintext, err)
+	}
+	if _, err := Decrypt(ciphertext, DeriveKey([]byte("other"))); err == nil {
+		t.Fatal("decrypting with the wrong key should fail")
+	}
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"example.com/kendrick/internal/tcp_server/cache"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// how often a synced deny-list picks up revocations made by other servers
+	DENYLIST_SYNC_INTERVAL = 5 * time.Second
+)
+
+// Ids of revoked session tokens. An entry is kept until the tokens it revokes would have
+// expired anyway, which keeps the list small.
+type DenyList interface {
+	Deny(id string, at time.Time, until time.Time) error
+	DeniedAt(id string) (time.Time, bool) // when id was revoked, if it still is
+	Stop()
+}
+
+// Deny-list held in memory, for a single server
+type MemDenyList struct {
+	mu      sync.RWMutex
+	entries map[string]cache.DenyEntry
+	now     func() time.Time
+}
+
+func NewMemDenyList(now func() time.Time) *MemDenyList {
+	return &MemDenyList{
+		entries: make(map[string]cache.DenyEntry),
+		now:     now,
+	}
+}
+
+// Revocations are rare (logouts), so each one also prunes the list
+func (l *MemDenyList) Deny(id string, at time.Time, until time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	if old, ok := l.entries[id]; !ok || at.After(old.At) {
+		l.entries[id] = cache.DenyEntry{At: at, Until: until}
+	}
+	return nil
+}
+
+func (l *MemDenyList) DeniedAt(id string) (time.Time, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[id]
+	if !ok || !l.now().Before(entry.Until) {
+		return time.Time{}, false
+	}
+	return entry.At, true
+}
+
+// Drops the entries that stopped mattering. Callers hold the lock.
+func (l *MemDenyList) prune() {
+	now := l.now()
+	for k, entry := range l.entries {
+		if !now.Before(entry.Until) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+func (l *MemDenyList) Stop() {
+	// Nothing to release
+}
+
+// Adds entries read from a shared store. Revocations are never undone, so local entries
+// are kept even if the store's copy was read before they were made.
+func (l *MemDenyList) merge(entries map[string]cache.DenyEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	for k, entry := range entries {
+		if old, ok := l.entries[k]; !ok || entry.At.After(old.At) {
+			l.entries[k] = entry
+		}
+	}
+}
+
+// Deny-list shared between servers through a store. Lookups are answered from memory, so
+// checking a token costs no round trip; revocations made elsewhere arrive within one interval.
+type SyncedDenyList struct {
+	*MemDenyList
+	store cache.DenyStore
+	stop  chan struct{}
+}
+
+func NewSyncedDenyList(store cache.DenyStore, interval time.Duration) (*SyncedDenyList, error) {
+	l := &SyncedDenyList{
+		MemDenyList: NewMemDenyList(time.Now),
+		store:       store,
+		stop:        make(chan struct{}),
+	}
+	if err := l.sync(); err != nil {
+		return nil, err
+	}
+	go l.run(interval)
+	return l, nil
+}
+
+func (l *SyncedDenyList) Deny(id string, at time.Time, until time.Time) error {
+	if err := l.store.AddDenied(id, at, until); err != nil {
+		return err
+	}
+	return l.MemDenyList.Deny(id, at, until)
+}
+
+func (l *SyncedDenyList) Stop() {
+	close(l.stop)
+}
+
+func (l *SyncedDenyList) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.sync(); err != nil {
+				log.Error("Syncing session deny-list: ", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *SyncedDenyList) sync() error {
+	entries, err := l.store.GetDenied(l.now())
+	if err != nil {
+		return err
+	}
+	l.merge(entries)
+	return nil
+}
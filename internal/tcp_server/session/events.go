@@ -0,0 +1,120 @@
+package session
+
+import (
+	"encoding/json"
+	"example.com/kendrick/internal/tcp_server/cache"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+/**
+Session events tell other processes about session changes as they happen, so they can
+drop what they cached about a session instead of waiting for their next GET_SESSION
+*/
+
+const (
+	EVENTS_CHANNEL = "session_events"
+
+	EVENT_CREATED = "created"
+	EVENT_EDITED  = "edited" // claims changed, or the session moved to NewSessID
+	EVENT_REVOKED = "revoked"
+	EVENT_EXPIRED = "expired"
+)
+
+// An empty SessID means the event is about every session of the user
+type Event struct {
+	Type      string    `json:"type"`
+	SessID    string    `json:"sid,omitempty"`
+	NewSessID string    `json:"new_sid,omitempty"`
+	Username  string    `json:"username"`
+	At        time.Time `json:"at"`
+}
+
+type EventBus interface {
+	Publish(e Event) error
+	Subscribe() (Subscription, error)
+}
+
+type Subscription interface {
+	Events() <-chan Event // closed once the subscription is closed
+	Close() error
+}
+
+type EventBusStruct struct {
+	pubsub cache.PubSub
+}
+
+func NewEventBus(pubsub cache.PubSub) EventBus {
+	return &EventBusStruct{pubsub: pubsub}
+}
+
+func (bus *EventBusStruct) Publish(e Event) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return bus.pubsub.Publish(EVENTS_CHANNEL, msg)
+}
+
+// Delivers the events published from now on, until the subscription is closed
+func (bus *EventBusStruct) Subscribe() (Subscription, error) {
+	sub, err := bus.pubsub.Subscribe(EVENTS_CHANNEL)
+	if err != nil {
+		return nil, err
+	}
+	s := &subscriptionStruct{
+		sub:    sub,
+		events: make(chan Event, cache.SUBSCRIBER_BUFFER),
+		done:   make(chan struct{}),
+	}
+	go s.decode()
+	return s, nil
+}
+
+type subscriptionStruct struct {
+	sub    cache.Subscriber
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (s *subscriptionStruct) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscriptionStruct) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.sub.Close()
+	})
+	return err
+}
+
+func (s *subscriptionStruct) decode() {
+	defer close(s.events)
+	for msg := range s.sub.Messages() {
+		var e Event
+		if err := json.Unmarshal(msg, &e); err != nil {
+			log.Warn("Skipping malformed session event: ", err)
+			continue
+		}
+		select {
+		case s.events <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Publishes an event if there is a bus. Failures are only logged: other processes then
+// find out on their next lookup, as they would without events.
+func publish(events EventBus, e Event) {
+	if events == nil {
+		return
+	}
+	if err := events.Publish(e); err != nil {
+		log.Error("Publishing session event: ", err)
+	}
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ERR_NO_TOKEN_KEYS = errors.New("No session token signing keys configured")
+	ERR_BAD_TOKEN_KEY = errors.New("Bad session token key, expected id:seed with a base64 32 byte seed")
+)
+
+// An Ed25519 key that signs session tokens
+type TokenKey struct {
+	Id      string
+	Private ed25519.PrivateKey
+}
+
+// Keys trusted to sign session tokens. The first one signs new tokens; the others only
+// verify, so a key can be rotated out once the tokens it signed have expired.
+type KeySet struct {
+	keys []TokenKey
+}
+
+// A JSON Web Key (RFC 8037) for an Ed25519 public key
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	X   string `json:"x"`
+}
+
+func NewKeySet(keys []TokenKey) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, ERR_NO_TOKEN_KEYS
+	}
+	for _, key := range keys {
+		if key.Id == "" || len(key.Private) != ed25519.PrivateKeySize {
+			return nil, ERR_BAD_TOKEN_KEY
+		}
+	}
+	return &KeySet{keys: keys}, nil
+}
+
+// Reads signing keys from a file with one "id:seed" pair per line, active key first. Seeds
+// are 32 random bytes in base64, e.g. from `openssl rand -base64 32`.
+// Blank lines and lines starting with # are ignored.
+func LoadTokenKeys(path string) ([]TokenKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []TokenKey
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, ERR_BAD_TOKEN_KEY
+		}
+		seed, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, ERR_BAD_TOKEN_KEY
+		}
+		keys = append(keys, TokenKey{Id: parts[0], Private: ed25519.NewKeyFromSeed(seed)})
+	}
+	return keys, scanner.Err()
+}
+
+// Generates a throwaway key, for development when no key file is configured
+func RandomTokenKey() TokenKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return TokenKey{Id: "ephemeral", Private: private}
+}
+
+func (ks *KeySet) signer() TokenKey {
+	return ks.keys[0]
+}
+
+func (ks *KeySet) publicKey(kid string) (ed25519.PublicKey, bool) {
+	for _, key := range ks.keys {
+		if key.Id == kid {
+			return key.Private.Public().(ed25519.PublicKey), true
+		}
+	}
+	return nil, false
+}
+
+// Returns the public keys as a JSON Web Key Set, for services verifying tokens themselves
+func (ks *KeySet) JWKS() ([]byte, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for _, key := range ks.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Use: "sig",
+			Alg: TOKEN_ALG,
+			Kid: key.Id,
+			X:   base64.RawURLEncoding.EncodeToString(key.Private.Public().(ed25519.PublicKey)),
+		})
+	}
+	return json.Marshal(set)
+}
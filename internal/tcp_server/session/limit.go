@@ -0,0 +1,86 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// What CreateSession does when a user is at their session limit
+const (
+	LIMIT_REJECT       = "reject" // refuse the new login
+	LIMIT_EVICT_OLDEST = "evict"  // sign the oldest session out
+)
+
+var (
+	ERR_SESSION_LIMIT      = errors.New("Too many active sessions, please log out on another device first")
+	ERR_SESSION_EVICTED    = errors.New("Signed out because you logged in elsewhere")
+	ERR_UNKNOWN_LIMIT_MODE = errors.New("Unknown session limit mode")
+	ERR_BAD_LIMIT_LINE     = errors.New("Bad session limit line, expected username:max")
+)
+
+// How many simultaneous sessions a user may have. A max of 0 means no limit.
+type Limit struct {
+	Default int
+	PerUser map[string]int // overrides Default
+	Mode    string
+}
+
+// Returns the session limit of a user
+func (l Limit) For(username string) int {
+	if max, ok := l.PerUser[username]; ok {
+		return max
+	}
+	return l.Default
+}
+
+// Reports whether any user has a limit
+func (l Limit) Enabled() bool {
+	if l.Default > 0 {
+		return true
+	}
+	for _, max := range l.PerUser {
+		if max > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Limit) Validate() error {
+	if l.Mode != LIMIT_REJECT && l.Mode != LIMIT_EVICT_OLDEST {
+		return ERR_UNKNOWN_LIMIT_MODE
+	}
+	return nil
+}
+
+// Reads per-user limits from a file with one "username:max" pair per line.
+// Blank lines and lines starting with # are ignored.
+func LoadLimits(path string) (map[string]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	limits := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, ERR_BAD_LIMIT_LINE
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || max < 0 {
+			return nil, ERR_BAD_LIMIT_LINE
+		}
+		limits[strings.TrimSpace(parts[0])] = max
+	}
+	return limits, scanner.Err()
+}
@@ -1,10 +1,13 @@
 package session
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"example.com/kendrick/api"
 	"example.com/kendrick/internal/tcp_server/cache"
-	"github.com/satori/uuid"
+	"example.com/kendrick/internal/tcp_server/security"
+	log "github.com/sirupsen/logrus"
 	"time"
 )
 
@@ -12,71 +15,366 @@ import (
 Session manager handles get/create/delete sessions and handles session timeout
 */
 
+const (
+	// how stale a session's last-seen time may get before it is written back
+	LAST_SEEN_RESOLUTION = time.Minute
+	// how long an expired session is kept around so it can be reported as timed out
+	EXPIRY_GRACE = time.Hour
+	// cache key prefix of the markers left by sessions evicted for the session limit
+	EVICTED_PREFIX = "evicted:"
+	// absolute timeout of sessions opened by an admin impersonating a user
+	IMPERSONATION_TTL = 15 * time.Minute
+)
+
 var (
 	ERR_SESSION_TIMEOUT = errors.New("Session has timed out")
 	ERR_NO_SUCH_SESSION = errors.New("Session doesn't exist")
+	ERR_BAD_TIMEOUTS    = errors.New("Idle timeout must be positive and no longer than the absolute timeout")
 )
 
 type SessionManager interface {
 	GetSession(sid string) (api.Session, error)
-	CreateSession(user *api.User) (api.Session, error)
-	EditSession(sid string, user *api.User) error
+	CreateSession(claims api.Claims, device api.Device) (api.Session, error)
+	EditSession(sid string, claims api.Claims) (api.Session, error) // the session may get a new id
+	RotateSession(sid string) (api.Session, error)
 	DeleteSession(sid string) error
+	ListSessions(username string) ([]api.Session, error)
+	DeleteUserSessions(username string) error
 	Stop()
 }
 
+// A session expires once it has not been used for idleTimeout, or once it is older than
+// absoluteTimeout, whichever comes first. Using a session pushes its idle expiry back.
 type SessionMgrStruct struct {
-	sessionCache      cache.DBCache
-	sessionTimeoutHrs int
+	sessionCache    cache.DBCache
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	limit           Limit
+	events          EventBus // may be nil
+	now             func() time.Time
 }
 
-func NewManager(sessionTimeoutHrs int) (SessionManager, error) {
-	sessionCache := cache.NewRedisCache(
-		"localhost:6379",
-		0,
-		time.Duration(sessionTimeoutHrs)*time.Hour,
-	)
-
+// sessionCache should keep user session indexes for at least SessionCacheTTL(absoluteTimeout).
+// Session changes are published on events unless it is nil.
+func NewManager(
+	sessionCache cache.DBCache,
+	idleTimeout time.Duration,
+	absoluteTimeout time.Duration,
+	limit Limit,
+	events EventBus,
+) (SessionManager, error) {
+	if idleTimeout <= 0 || absoluteTimeout < idleTimeout {
+		return nil, ERR_BAD_TIMEOUTS
+	}
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
 	return &SessionMgrStruct{
-		sessionCache:      sessionCache,
-		sessionTimeoutHrs: sessionTimeoutHrs,
+		sessionCache:    sessionCache,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+		limit:           limit,
+		events:          events,
+		now:             time.Now,
 	}, nil
 }
 
+// Returns a live session, refreshing its idle expiry. Sessions past either timeout are
+// deleted and reported with ERR_SESSION_TIMEOUT.
 func (manager *SessionMgrStruct) GetSession(sid string) (api.Session, error) {
-	session, err := manager.sessionCache.GetSession(sid)
+	session, err := manager.load(sid)
 	if err != nil {
+		if _, evictedErr := manager.sessionCache.GetSession(EVICTED_PREFIX + sid); evictedErr == nil {
+			return nil, ERR_SESSION_EVICTED
+		}
 		return nil, err
 	}
+	now := manager.now()
+	if manager.expired(session, now) {
+		if _, err := manager.remove(sid); err != nil {
+			log.Error(err)
+		}
+		manager.publish(EVENT_EXPIRED, sid, session.GetUsername())
+		return nil, ERR_SESSION_TIMEOUT
+	}
+	// keep last-seen roughly current without writing on every request
+	if s, ok := session.(*api.SessionStruct); ok {
+		if now.Sub(s.LastSeen) >= LAST_SEEN_RESOLUTION {
+			s.LastSeen = now
+			if err := manager.sessionCache.SetSession(sid, s, manager.ttl(s)); err != nil {
+				log.Error(err)
+			}
+		}
+	}
 	return session, nil
 }
 
-func (manager *SessionMgrStruct) CreateSession(user *api.User) (api.Session, error) {
+// Creates a session, making room for it if the user is at their session limit
+func (manager *SessionMgrStruct) CreateSession(claims api.Claims, device api.Device) (api.Session, error) {
+	now := manager.now()
 	session := api.SessionStruct{
-		SessID: uuid.NewV4().String(),
-		User:   user,
+		SessID:    newSessID(),
+		Claims:    claims,
+		Device:    device,
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+	var err error
+	// an admin looking in must not sign the user out
+	if max := manager.limit.For(claims.Username); max > 0 && claims.Impersonator == "" {
+		err = manager.saveLimited(&session, max)
+	} else {
+		err = manager.saveNew(&session)
+	}
+	if err != nil {
+		return nil, err
 	}
-	err := manager.sessionCache.SetSession(session.SessID, &session)
-	return &session, err
+	manager.publish(EVENT_CREATED, session.SessID, session.GetUsername())
+	return &session, nil
 }
 
-func (manager *SessionMgrStruct) EditSession(sid string, user *api.User) error {
+// Replaces the claims of a session, e.g. after the user edited their profile
+func (manager *SessionMgrStruct) EditSession(sid string, claims api.Claims) (api.Session, error) {
+	old, err := manager.load(sid)
+	if err != nil {
+		return nil, err
+	}
+	claims.Version = api.CLAIMS_VERSION
 	newSess := api.SessionStruct{
-		SessID: sid,
-		User:   user,
+		SessID:    sid,
+		Claims:    claims,
+		Device:    old.GetDevice(),
+		CreatedAt: old.GetCreatedAt(),
+		LastSeen:  manager.now(),
 	}
-	err := manager.sessionCache.SetSession(sid, &newSess)
+	err = manager.sessionCache.SetSession(sid, &newSess, manager.ttl(&newSess))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	manager.publish(EVENT_EDITED, sid, newSess.GetUsername())
+	return &newSess, nil
+}
+
+// Moves a session to a new id, so that an id observed before a privilege change is useless after it
+func (manager *SessionMgrStruct) RotateSession(sid string) (api.Session, error) {
+	old, err := manager.load(sid)
+	if err != nil {
+		return nil, err
+	}
+	session := api.SessionStruct{
+		SessID:    newSessID(),
+		Claims:    old.GetClaims(),
+		Device:    old.GetDevice(),
+		CreatedAt: old.GetCreatedAt(),
+		LastSeen:  manager.now(),
+	}
+	if err := manager.saveNew(&session); err != nil {
+		return nil, err
+	}
+	if _, err := manager.remove(sid); err != nil {
+		return nil, err
+	}
+	publish(manager.events, Event{
+		Type:      EVENT_EDITED,
+		SessID:    sid,
+		NewSessID: session.SessID,
+		Username:  session.GetUsername(),
+		At:        manager.now(),
+	})
+	return &session, nil
 }
 
 func (manager *SessionMgrStruct) DeleteSession(sid string) error {
-	err := manager.sessionCache.DeleteSession(sid)
+	username, err := manager.remove(sid)
+	if err == nil && username != "" {
+		manager.publish(EVENT_REVOKED, sid, username)
+	}
 	return err
 }
 
+// Returns a user's live sessions, oldest first
+func (manager *SessionMgrStruct) ListSessions(username string) ([]api.Session, error) {
+	sids, err := manager.sessionCache.GetUserSessions(username)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]api.Session, 0, len(sids))
+	now := manager.now()
+	for _, sid := range sids {
+		session, err := manager.load(sid)
+		if err != nil || manager.expired(session, now) {
+			// expired since it was indexed
+			if err := manager.sessionCache.RemoveUserSession(username, sid); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		ret = append(ret, session)
+	}
+	return ret, nil
+}
+
+// Logs a user out everywhere
+func (manager *SessionMgrStruct) DeleteUserSessions(username string) error {
+	sids, err := manager.sessionCache.GetUserSessions(username)
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		if err := manager.sessionCache.DeleteSession(sid); err != nil {
+			return err
+		}
+		if err := manager.sessionCache.RemoveUserSession(username, sid); err != nil {
+			return err
+		}
+		manager.publish(EVENT_REVOKED, sid, username)
+	}
+	return nil
+}
+
+// Stores a session that was just created and indexes it under its user, who must then
+// hold at most max sessions. The user's oldest sessions are evicted if the limit mode
+// allows. Sessions of admins impersonating the user neither count nor get evicted.
+func (manager *SessionMgrStruct) saveLimited(session *api.SessionStruct, max int) error {
+	username := session.GetUsername()
+	// also drops the sessions that expired since they were indexed, so they don't count
+	sessions, err := manager.ListSessions(username)
+	if err != nil {
+		return err
+	}
+	var exempt []string
+	for _, s := range sessions {
+		if s.GetClaims().Impersonator != "" {
+			exempt = append(exempt, s.GetSessID())
+		}
+	}
+	// stored before it is indexed, or a listing in between would drop it from the index
+	err = manager.sessionCache.SetSession(session.SessID, session, manager.ttl(session))
+	if err != nil {
+		return err
+	}
+	evict := manager.limit.Mode == LIMIT_EVICT_OLDEST
+	evicted, err := manager.sessionCache.AddUserSessionLimited(username, session.SessID, session.CreatedAt, max, evict, exempt)
+	if err != nil {
+		if delErr := manager.sessionCache.DeleteSession(session.SessID); delErr != nil {
+			log.Error(delErr)
+		}
+		if err == cache.ERR_USER_SESSIONS_FULL {
+			return ERR_SESSION_LIMIT
+		}
+		return err
+	}
+	for _, sid := range evicted {
+		if err := manager.evict(username, sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes a session that was unindexed to make room, leaving a marker so its client can
+// be told why it was signed out
+func (manager *SessionMgrStruct) evict(username string, sid string) error {
+	marker := api.SessionStruct{SessID: sid, CreatedAt: manager.now(), LastSeen: manager.now()}
+	if session, err := manager.load(sid); err == nil {
+		marker.CreatedAt = session.GetCreatedAt()
+		marker.LastSeen = session.GetLastSeen()
+	}
+	err := manager.sessionCache.SetSession(EVICTED_PREFIX+sid, &marker, manager.ttl(&marker))
+	if err != nil {
+		return err
+	}
+	log.Info("Evicted session of " + username + " for the session limit")
+	return manager.DeleteSession(sid)
+}
+
+// Deletes a session and unindexes it, returning its user if it still existed
+func (manager *SessionMgrStruct) remove(sid string) (string, error) {
+	username := ""
+	session, err := manager.load(sid)
+	if err == nil {
+		username = session.GetUsername()
+		if err := manager.sessionCache.RemoveUserSession(username, sid); err != nil {
+			log.Error(err)
+		}
+	}
+	return username, manager.sessionCache.DeleteSession(sid)
+}
+
+func (manager *SessionMgrStruct) publish(eventType string, sid string, username string) {
+	publish(manager.events, Event{Type: eventType, SessID: sid, Username: username, At: manager.now()})
+}
+
+// Reads a session from the cache, upgrading and storing it again if it predates Claims
+func (manager *SessionMgrStruct) load(sid string) (api.Session, error) {
+	session, err := manager.sessionCache.GetSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := session.(*api.SessionStruct); ok && s.Migrate(manager.now()) {
+		log.Debug("Migrated session claims of ", s.GetUsername())
+		if err := manager.sessionCache.SetSession(sid, s, manager.ttl(s)); err != nil {
+			log.Error(err)
+		}
+	}
+	return session, nil
+}
+
+// Stores a session that was just created and indexes it under its user
+func (manager *SessionMgrStruct) saveNew(session *api.SessionStruct) error {
+	err := manager.sessionCache.SetSession(session.SessID, session, manager.ttl(session))
+	if err != nil {
+		return err
+	}
+	return manager.sessionCache.AddUserSession(session.GetUsername(), session.SessID, session.CreatedAt)
+}
+
+// Reports whether a session has passed its idle or absolute timeout
+func (manager *SessionMgrStruct) expired(session api.Session, now time.Time) bool {
+	return now.Sub(session.GetLastSeen()) >= manager.idleTimeout ||
+		!now.Before(deadline(session.GetClaims(), session.GetCreatedAt(), manager.absoluteTimeout))
+}
+
+// Returns how long the cache should keep a session: until the earlier of its two
+// deadlines, plus EXPIRY_GRACE so a late request can still tell it timed out
+func (manager *SessionMgrStruct) ttl(session api.Session) time.Duration {
+	ttl := session.GetLastSeen().Add(manager.idleTimeout).Sub(manager.now())
+	abs := deadline(session.GetClaims(), session.GetCreatedAt(), manager.absoluteTimeout)
+	if rest := abs.Sub(manager.now()); rest < ttl {
+		ttl = rest
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl + EXPIRY_GRACE
+}
+
+// Returns when a session expires however active, which is sooner for impersonated sessions
+func deadline(claims api.Claims, created time.Time, absoluteTimeout time.Duration) time.Time {
+	if claims.Impersonator != "" && IMPERSONATION_TTL < absoluteTimeout {
+		absoluteTimeout = IMPERSONATION_TTL
+	}
+	return created.Add(absoluteTimeout)
+}
+
+// Session ids are 256 bit random tokens
+func newSessID() string {
+	return security.RandomToken(32)
+}
+
+// Returns an identifier for a session that is safe to show to the client. Unlike the session
+// id it can't be used to hijack the session.
+func PublicId(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:8])
+}
+
 func (manager *SessionMgrStruct) Stop() {
-	// Do nothing for now
+	manager.sessionCache.Stop()
+}
+
+// Returns how long a session cache must keep entries other than sessions, such as the
+// user session indexes
+func SessionCacheTTL(absoluteTimeout time.Duration) time.Duration {
+	return absoluteTimeout + EXPIRY_GRACE
 }
@@ -0,0 +1,581 @@
+package session
+
+import (
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"github.com/alicebob/miniredis/v2"
+	rcache "github.com/go-redis/cache/v8"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stand-in for redis, so the manager can be tested without a live server
+type fakeCache struct {
+	sessions map[string]api.SessionStruct
+	index    map[string]map[string]time.Time
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{
+		sessions: make(map[string]api.SessionStruct),
+		index:    make(map[string]map[string]time.Time),
+	}
+}
+
+func (c *fakeCache) GetSession(key string) (api.Session, error) {
+	s, ok := c.sessions[key]
+	if !ok {
+		return nil, ERR_NO_SUCH_SESSION
+	}
+	return &s, nil
+}
+
+func (c *fakeCache) SetSession(key string, s api.Session, ttl time.Duration) error {
+	c.sessions[key] = *s.(*api.SessionStruct)
+	return nil
+}
+
+func (c *fakeCache) DeleteSession(key string) error {
+	delete(c.sessions, key)
+	return nil
+}
+
+func (c *fakeCache) GetUser(key string) ([]api.User, error) {
+	return nil, nil
+}
+
+func (c *fakeCache) SetUser(key string, user []api.User, ttl time.Duration) error {
+	return nil
+}
+
+func (c *fakeCache) DeleteUser(key string) error {
+	return nil
+}
+
+func (c *fakeCache) AddUserSession(username string, sid string, created time.Time) error {
+	if c.index[username] == nil {
+		c.index[username] = make(map[string]time.Time)
+	}
+	c.index[username][sid] = created
+	return nil
+}
+
+func (c *fakeCache) AddUserSessionLimited(
+	username string,
+	sid string,
+	created time.Time,
+	max int,
+	evict bool,
+	exempt []string,
+) ([]string, error) {
+	sids, _ := c.GetUserSessions(username)
+	var counted []string
+	for _, s := range sids {
+		if !contains(exempt, s) {
+			counted = append(counted, s)
+		}
+	}
+	var evicted []string
+	if over := len(counted) - max + 1; over > 0 {
+		if !evict {
+			return nil, cache.ERR_USER_SESSIONS_FULL
+		}
+		evicted = counted[:over]
+		for _, s := range evicted {
+			c.RemoveUserSession(username, s)
+		}
+	}
+	return evicted, c.AddUserSession(username, sid, created)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeCache) RemoveUserSession(username string, sid string) error {
+	delete(c.index[username], sid)
+	return nil
+}
+
+func (c *fakeCache) Stop() {}
+
+func (c *fakeCache) GetUserSessions(username string) ([]string, error) {
+	var ret []string
+	for sid := range c.index[username] {
+		ret = append(ret, sid)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return c.index[username][ret[i]].Before(c.index[username][ret[j]])
+	})
+	return ret, nil
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestManager() (*SessionMgrStruct, *fakeCache, *fakeClock) {
+	c := newFakeCache()
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	return &SessionMgrStruct{
+		sessionCache:    c,
+		idleTimeout:     30 * time.Minute,
+		absoluteTimeout: 8 * time.Hour,
+		now:             clock.Now,
+	}, c, clock
+}
+
+func claimsFor(username string) api.Claims {
+	return api.NewClaims(&api.User{Username: username}, time.Unix(1600000000, 0), api.AUTH_METHOD_PASSWORD)
+}
+
+var (
+	laptop = api.Device{UserAgent: "laptop", IP: "10.0.0.1"}
+	phone  = api.Device{UserAgent: "phone", IP: "10.0.0.2"}
+)
+
+func TestListAndRevokeSessions(t *testing.T) {
+	manager, _, clock := newTestManager()
+	claims := claimsFor("kendrick")
+
+	first, _ := manager.CreateSession(claims, laptop)
+	clock.Advance(time.Minute)
+	second, _ := manager.CreateSession(claims, phone)
+	manager.CreateSession(claimsFor("other"), laptop)
+
+	sessions, err := manager.ListSessions("kendrick")
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("got %v sessions, %v", len(sessions), err)
+	}
+	if sessions[0].GetSessID() != first.GetSessID() || sessions[1].GetDevice() != phone {
+		t.Fatal("sessions should be listed oldest first with their device")
+	}
+
+	if err := manager.DeleteSession(first.GetSessID()); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = manager.ListSessions("kendrick")
+	if len(sessions) != 1 || sessions[0].GetSessID() != second.GetSessID() {
+		t.Fatal("revoked session should be removed from the index")
+	}
+
+	if err := manager.DeleteUserSessions("kendrick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.GetSession(second.GetSessID()); err == nil {
+		t.Fatal("revoke all should delete every session")
+	}
+	if sessions, _ := manager.ListSessions("other"); len(sessions) != 1 {
+		t.Fatal("other users' sessions should be untouched")
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	manager, _, clock := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	created := clock.Now()
+
+	clock.Advance(LAST_SEEN_RESOLUTION / 2)
+	got, _ := manager.GetSession(sess.GetSessID())
+	if !got.GetLastSeen().Equal(created) {
+		t.Fatal("last seen should not be written more often than LAST_SEEN_RESOLUTION")
+	}
+
+	clock.Advance(LAST_SEEN_RESOLUTION)
+	manager.GetSession(sess.GetSessID())
+	got, _ = manager.GetSession(sess.GetSessID())
+	if !got.GetLastSeen().Equal(clock.Now()) || !got.GetCreatedAt().Equal(created) {
+		t.Fatalf("got last seen %v, created %v", got.GetLastSeen(), got.GetCreatedAt())
+	}
+}
+
+func TestRotateSessionKeepsIndex(t *testing.T) {
+	manager, _, _ := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	rotated, err := manager.RotateSession(sess.GetSessID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := manager.ListSessions("kendrick")
+	if len(sessions) != 1 || sessions[0].GetSessID() != rotated.GetSessID() {
+		t.Fatal("index should follow the rotated session id")
+	}
+	if PublicId(sess.GetSessID()) == PublicId(rotated.GetSessID()) {
+		t.Fatal("public ids should differ")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	manager, c, clock := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+
+	// activity keeps the session alive past the idle timeout
+	for i := 0; i < 4; i++ {
+		clock.Advance(manager.idleTimeout / 2)
+		if _, err := manager.GetSession(sess.GetSessID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(manager.idleTimeout)
+	if _, err := manager.GetSession(sess.GetSessID()); err != ERR_SESSION_TIMEOUT {
+		t.Fatalf("got %v, want ERR_SESSION_TIMEOUT", err)
+	}
+	if _, ok := c.sessions[sess.GetSessID()]; ok {
+		t.Fatal("timed out session should be deleted")
+	}
+	if sessions, _ := manager.ListSessions("kendrick"); len(sessions) != 0 {
+		t.Fatal("timed out session should not be listed")
+	}
+}
+
+func TestAbsoluteTimeout(t *testing.T) {
+	manager, _, clock := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+
+	for clock.Now().Add(manager.idleTimeout / 2).Before(time.Unix(1600000000, 0).Add(manager.absoluteTimeout)) {
+		clock.Advance(manager.idleTimeout / 2)
+		if _, err := manager.GetSession(sess.GetSessID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(manager.idleTimeout / 2)
+	if _, err := manager.GetSession(sess.GetSessID()); err != ERR_SESSION_TIMEOUT {
+		t.Fatalf("got %v, want ERR_SESSION_TIMEOUT", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	manager, _, clock := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	if got := manager.ttl(sess); got != manager.idleTimeout+EXPIRY_GRACE {
+		t.Fatalf("got ttl %v for a new session", got)
+	}
+
+	clock.Advance(manager.absoluteTimeout - time.Minute)
+	s := sess.(*api.SessionStruct)
+	s.LastSeen = clock.Now()
+	if got := manager.ttl(s); got != time.Minute+EXPIRY_GRACE {
+		t.Fatalf("got ttl %v, should be capped by the absolute timeout", got)
+	}
+}
+
+func TestMigrateLegacySession(t *testing.T) {
+	manager, c, clock := newTestManager()
+	created := clock.Now()
+	// as stored before claims and timeouts, with no timestamps
+	c.sessions["legacy"] = api.SessionStruct{
+		SessID: "legacy",
+		User:   &api.User{Username: "kendrick", Nickname: "K", PwHash: "$2a$hash"},
+	}
+
+	sess, err := manager.GetSession("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := sess.GetClaims()
+	if claims.Version != api.CLAIMS_VERSION || claims.Username != "kendrick" || claims.Nickname != "K" {
+		t.Fatalf("got claims %+v", claims)
+	}
+	if !claims.AuthTime.Equal(created) || len(claims.AuthMethods) != 1 {
+		t.Fatalf("got auth time %v, methods %v", claims.AuthTime, claims.AuthMethods)
+	}
+	if stored := c.sessions["legacy"]; stored.User != nil || stored.Claims.Username != "kendrick" {
+		t.Fatal("migrated session should be stored without the user record")
+	}
+	if stored := c.sessions["legacy"]; !stored.CreatedAt.Equal(created) || !stored.LastSeen.Equal(created) {
+		t.Fatalf("got created %v, last seen %v", stored.CreatedAt, stored.LastSeen)
+	}
+
+	// the migrated session times out like any other
+	clock.Advance(manager.idleTimeout / 2)
+	if _, err := manager.GetSession("legacy"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEditSessionKeepsAuth(t *testing.T) {
+	manager, _, _ := newTestManager()
+	sess, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	claims := sess.GetClaims()
+	claims.Nickname = "new"
+	if _, err := manager.EditSession(sess.GetSessID(), claims); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := manager.GetSession(sess.GetSessID())
+	if got.GetNickname() != "new" || !got.GetClaims().AuthTime.Equal(sess.GetClaims().AuthTime) {
+		t.Fatalf("got claims %+v", got.GetClaims())
+	}
+}
+
+func TestManagerWithMemoryCache(t *testing.T) {
+	memCache := cache.NewMemoryCache(SessionCacheTTL(time.Hour), 1000)
+	sessMgr, err := NewManager(memCache, time.Minute, time.Hour, Limit{Mode: LIMIT_EVICT_OLDEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessMgr.Stop()
+
+	sess, _ := sessMgr.CreateSession(claimsFor("kendrick"), laptop)
+	rotated, err := sessMgr.RotateSession(sess.GetSessID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessMgr.GetSession(sess.GetSessID()); err == nil {
+		t.Fatal("old id should be gone after rotation")
+	}
+	sessions, _ := sessMgr.ListSessions("kendrick")
+	if len(sessions) != 1 || sessions[0].GetSessID() != rotated.GetSessID() {
+		t.Fatalf("got %v sessions", len(sessions))
+	}
+	if err := sessMgr.DeleteUserSessions("kendrick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessMgr.GetSession(rotated.GetSessID()); err == nil {
+		t.Fatal("revoke all should delete every session")
+	}
+}
+
+func TestSessionLimitReject(t *testing.T) {
+	manager, _, clock := newTestManager()
+	manager.limit = Limit{Default: 2, PerUser: map[string]int{"admin": 1}, Mode: LIMIT_REJECT}
+
+	for i := 0; i < 2; i++ {
+		if _, err := manager.CreateSession(claimsFor("kendrick"), laptop); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Second)
+	}
+	if _, err := manager.CreateSession(claimsFor("kendrick"), phone); err != ERR_SESSION_LIMIT {
+		t.Fatalf("got %v, want ERR_SESSION_LIMIT", err)
+	}
+	manager.CreateSession(claimsFor("admin"), laptop)
+	if _, err := manager.CreateSession(claimsFor("admin"), phone); err != ERR_SESSION_LIMIT {
+		t.Fatal("per-user limits should override the default")
+	}
+
+	// expired sessions don't count
+	clock.Advance(manager.idleTimeout)
+	if _, err := manager.CreateSession(claimsFor("kendrick"), phone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionLimitEvictOldest(t *testing.T) {
+	manager, _, clock := newTestManager()
+	manager.limit = Limit{Default: 2, Mode: LIMIT_EVICT_OLDEST}
+
+	oldest, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	clock.Advance(time.Second)
+	middle, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	clock.Advance(time.Second)
+	newest, err := manager.CreateSession(claimsFor("kendrick"), phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := manager.GetSession(oldest.GetSessID()); err != ERR_SESSION_EVICTED {
+		t.Fatalf("got %v, want ERR_SESSION_EVICTED", err)
+	}
+	sessions, _ := manager.ListSessions("kendrick")
+	if len(sessions) != 2 || sessions[0].GetSessID() != middle.GetSessID() || sessions[1].GetSessID() != newest.GetSessID() {
+		t.Fatal("the two newest sessions should be kept")
+	}
+	if _, err := manager.GetSession("never-existed"); err == ERR_SESSION_EVICTED {
+		t.Fatal("unknown sessions should not be reported as evicted")
+	}
+}
+
+func nextEvent(t *testing.T, sub Subscription) Event {
+	select {
+	case e := <-sub.Events():
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestSessionEvents(t *testing.T) {
+	sessMgr, _, clock := newTestManager()
+	memCache := cache.NewMemoryCache(time.Hour, 100)
+	defer memCache.Stop()
+	sessMgr.events = NewEventBus(memCache)
+	sub, err := sessMgr.events.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	sess, _ := sessMgr.CreateSession(claimsFor("kendrick"), laptop)
+	sid := sess.GetSessID()
+	if e := nextEvent(t, sub); e.Type != EVENT_CREATED || e.SessID != sid || e.Username != "kendrick" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	sessMgr.EditSession(sid, claimsFor("kendrick"))
+	if e := nextEvent(t, sub); e.Type != EVENT_EDITED || e.SessID != sid {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	rotated, _ := sessMgr.RotateSession(sid)
+	if e := nextEvent(t, sub); e.Type != EVENT_EDITED || e.SessID != sid || e.NewSessID != rotated.GetSessID() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	sessMgr.DeleteSession(rotated.GetSessID())
+	if e := nextEvent(t, sub); e.Type != EVENT_REVOKED || e.SessID != rotated.GetSessID() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	sess, _ = sessMgr.CreateSession(claimsFor("kendrick"), laptop)
+	nextEvent(t, sub)
+	clock.Advance(time.Hour)
+	sessMgr.GetSession(sess.GetSessID())
+	if e := nextEvent(t, sub); e.Type != EVENT_EXPIRED || e.SessID != sess.GetSessID() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("closed subscription should deliver nothing")
+	}
+}
+
+func TestImpersonatedSessionExpiresSooner(t *testing.T) {
+	sessMgr, _, clock := newTestManager()
+	sessMgr.limit = Limit{Default: 1, Mode: LIMIT_EVICT_OLDEST}
+	own, _ := sessMgr.CreateSession(claimsFor("kendrick"), laptop)
+	claims := claimsFor("kendrick")
+	claims.Impersonator = "admin"
+	sess, _ := sessMgr.CreateSession(claims, phone)
+	if _, err := sessMgr.GetSession(own.GetSessID()); err != nil {
+		t.Fatal("impersonating must not evict the user's own session: ", err)
+	}
+
+	clock.Advance(IMPERSONATION_TTL - time.Second)
+	if _, err := sessMgr.GetSession(sess.GetSessID()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if _, err := sessMgr.GetSession(sess.GetSessID()); err != ERR_SESSION_TIMEOUT {
+		t.Fatalf("got %v, want timeout", err)
+	}
+}
+
+func TestImpersonatedSessionsDontCount(t *testing.T) {
+	sessMgr, _, clock := newTestManager()
+	sessMgr.limit = Limit{Default: 1, Mode: LIMIT_EVICT_OLDEST}
+	claims := claimsFor("kendrick")
+	claims.Impersonator = "admin"
+	impersonated, _ := sessMgr.CreateSession(claims, phone)
+
+	clock.Advance(time.Second)
+	first, err := sessMgr.CreateSession(claimsFor("kendrick"), laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if _, err := sessMgr.CreateSession(claimsFor("kendrick"), laptop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessMgr.GetSession(first.GetSessID()); err != ERR_SESSION_EVICTED {
+		t.Fatalf("got %v, want ERR_SESSION_EVICTED", err)
+	}
+	if _, err := sessMgr.GetSession(impersonated.GetSessID()); err != nil {
+		t.Fatal("logging in must not evict an admin looking in: ", err)
+	}
+}
+
+func TestSessionLimitAcrossServers(t *testing.T) {
+	// two servers sharing one cache
+	shared := cache.NewMemoryCache(time.Hour, 1000)
+	defer shared.Stop()
+	limit := Limit{Default: 2, Mode: LIMIT_REJECT}
+	var managers []SessionManager
+	for i := 0; i < 2; i++ {
+		manager, err := NewManager(shared, time.Minute, time.Hour, limit, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		managers = append(managers, manager)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(manager SessionManager) {
+			defer wg.Done()
+			if _, err := manager.CreateSession(claimsFor("kendrick"), laptop); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(managers[i%2])
+	}
+	wg.Wait()
+	if sessions, _ := managers[0].ListSessions("kendrick"); created != 2 || len(sessions) != 2 {
+		t.Fatalf("created %v, listed %v", created, len(sessions))
+	}
+}
+
+func TestUpgradeFromBaselineRedis(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	config := cache.RedisConfig{
+		Mode:            cache.REDIS_STANDALONE,
+		Addrs:           []string{m.Addr()},
+		LegacyKeysUntil: time.Now().Add(time.Hour),
+	}
+	redisCache, err := cache.NewRedisCache(config, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessMgr, err := NewManager(redisCache, time.Minute, time.Hour, Limit{Mode: LIMIT_EVICT_OLDEST}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessMgr.Stop()
+
+	// as a server from before claims, timeouts and versioned keys stored it
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer rdb.Close()
+	old := rcache.New(&rcache.Options{Redis: rdb})
+	err = old.Set(&rcache.Item{
+		Key:   "s1",
+		Value: &api.SessionStruct{SessID: "s1", User: &api.User{Username: "kendrick", PwHash: "$2a$hash"}},
+		TTL:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := sessMgr.GetSession("s1")
+	if err != nil || sess.GetUsername() != "kendrick" {
+		t.Fatalf("got %v, %v", sess, err)
+	}
+	if !m.Exists("sess:v1:s1") {
+		t.Fatal("the session should be stored under its versioned key")
+	}
+	if _, err := sessMgr.GetSession("s1"); err != nil {
+		t.Fatal(err)
+	}
+}
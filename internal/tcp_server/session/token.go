@@ -0,0 +1,306 @@
+package session
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"example.com/kendrick/api"
+	"example.com/kendrick/internal/tcp_server/security"
+	"strings"
+	"time"
+)
+
+/**
+Token manager issues sessions as signed, expiring tokens (JWT signed with EdDSA). A token
+carries the session's claims, so it is checked without a cache round trip. Revoked tokens
+are kept on a deny-list until they expire.
+*/
+
+const (
+	TOKEN_ALG = "EdDSA"
+	TOKEN_TYP = "JWT"
+	// deny-list ids revoking every token of a user issued up to the entry's time
+	USER_DENY_PREFIX = "user:"
+)
+
+var (
+	ERR_MALFORMED_TOKEN     = errors.New("Malformed session token")
+	ERR_UNKNOWN_TOKEN_KEY   = errors.New("Session token signed with an unknown key")
+	ERR_BAD_TOKEN_SIGNATURE = errors.New("Session token signature mismatch")
+	ERR_TOKEN_REVOKED       = errors.New("Session token has been revoked")
+	ERR_UNSUPPORTED         = errors.New("Not supported with token sessions")
+)
+
+// Implemented by session managers whose sessions can be verified by other services
+type KeyPublisher interface {
+	JWKS() ([]byte, error)
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Registered JWT claims plus the session's claims and device. Times are unix seconds.
+type tokenPayload struct {
+	Id          string      `json:"jti"`
+	Subject     string      `json:"sub"`
+	IssuedAt    int64       `json:"iat"`
+	Expiry      int64       `json:"exp"`
+	Created     int64       `json:"created"`
+	AuthTime    int64       `json:"auth_time"`
+	AuthMethods []string    `json:"amr,omitempty"`
+	Version     int         `json:"ver"`
+	Username    string      `json:"preferred_username"`
+	Nickname    string      `json:"nickname,omitempty"`
+	ProfilePic  string      `json:"picture,omitempty"`
+	UserAgent   string      `json:"ua,omitempty"`
+	IP          string      `json:"ip,omitempty"`
+	Actor       *tokenActor `json:"act,omitempty"` // admin impersonating the subject, as in RFC 8693
+}
+
+type tokenActor struct {
+	Subject string `json:"sub"`
+}
+
+// Sessions expire absoluteTimeout after they were created. Tokens can't be refreshed on
+// use without handing the client a new one, so there is no idle timeout.
+type TokenMgrStruct struct {
+	keys            *KeySet
+	denied          DenyList
+	absoluteTimeout time.Duration
+	events          EventBus // may be nil
+	now             func() time.Time
+}
+
+// Token sessions expire in the client's hands, so only create, edit and revoke are published
+// on events
+func NewTokenManager(keys []TokenKey, denied DenyList, absoluteTimeout time.Duration, events EventBus) (SessionManager, error) {
+	keySet, err := NewKeySet(keys)
+	if err != nil {
+		return nil, err
+	}
+	if absoluteTimeout <= 0 {
+		return nil, ERR_BAD_TIMEOUTS
+	}
+	return &TokenMgrStruct{
+		keys:            keySet,
+		denied:          denied,
+		absoluteTimeout: absoluteTimeout,
+		events:          events,
+		now:             time.Now,
+	}, nil
+}
+
+func (manager *TokenMgrStruct) GetSession(sid string) (api.Session, error) {
+	payload, err := manager.parse(sid)
+	if err != nil {
+		return nil, err
+	}
+	if manager.now().Unix() >= payload.Expiry {
+		return nil, ERR_SESSION_TIMEOUT
+	}
+	if _, ok := manager.denied.DeniedAt(payload.Id); ok {
+		return nil, ERR_TOKEN_REVOKED
+	}
+	if at, ok := manager.denied.DeniedAt(USER_DENY_PREFIX + payload.Username); ok && payload.IssuedAt <= at.Unix() {
+		return nil, ERR_TOKEN_REVOKED
+	}
+	return payload.session(sid), nil
+}
+
+func (manager *TokenMgrStruct) CreateSession(claims api.Claims, device api.Device) (api.Session, error) {
+	session, err := manager.issue(claims, device, manager.now())
+	if err != nil {
+		return nil, err
+	}
+	publish(manager.events, Event{
+		Type:     EVENT_CREATED,
+		SessID:   session.GetSessID(),
+		Username: session.GetUsername(),
+		At:       manager.now(),
+	})
+	return session, nil
+}
+
+// Issues a token with the new claims and revokes the old one. The client must switch to
+// the returned session's id.
+func (manager *TokenMgrStruct) EditSession(sid string, claims api.Claims) (api.Session, error) {
+	old, err := manager.GetSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	claims.Version = api.CLAIMS_VERSION
+	session, err := manager.issue(claims, old.GetDevice(), old.GetCreatedAt())
+	if err != nil {
+		return nil, err
+	}
+	return session, manager.replace(sid, session)
+}
+
+func (manager *TokenMgrStruct) RotateSession(sid string) (api.Session, error) {
+	old, err := manager.GetSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	session, err := manager.issue(old.GetClaims(), old.GetDevice(), old.GetCreatedAt())
+	if err != nil {
+		return nil, err
+	}
+	return session, manager.replace(sid, session)
+}
+
+func (manager *TokenMgrStruct) DeleteSession(sid string) error {
+	payload, err := manager.revoke(sid)
+	if err != nil {
+		return err
+	}
+	publish(manager.events, Event{Type: EVENT_REVOKED, SessID: sid, Username: payload.Username, At: manager.now()})
+	return nil
+}
+
+// Revokes the token sid was reissued as session
+func (manager *TokenMgrStruct) replace(sid string, session api.Session) error {
+	if _, err := manager.revoke(sid); err != nil {
+		return err
+	}
+	publish(manager.events, Event{
+		Type:      EVENT_EDITED,
+		SessID:    sid,
+		NewSessID: session.GetSessID(),
+		Username:  session.GetUsername(),
+		At:        manager.now(),
+	})
+	return nil
+}
+
+func (manager *TokenMgrStruct) revoke(sid string) (*tokenPayload, error) {
+	payload, err := manager.parse(sid)
+	if err != nil {
+		return nil, err
+	}
+	return payload, manager.denied.Deny(payload.Id, manager.now(), time.Unix(payload.Expiry, 0))
+}
+
+// Issued tokens are not recorded anywhere, so they can't be listed
+func (manager *TokenMgrStruct) ListSessions(username string) ([]api.Session, error) {
+	return nil, ERR_UNSUPPORTED
+}
+
+// Revokes every token of the user issued so far
+func (manager *TokenMgrStruct) DeleteUserSessions(username string) error {
+	now := manager.now()
+	err := manager.denied.Deny(USER_DENY_PREFIX+username, now, now.Add(manager.absoluteTimeout))
+	if err != nil {
+		return err
+	}
+	publish(manager.events, Event{Type: EVENT_REVOKED, Username: username, At: now})
+	return nil
+}
+
+func (manager *TokenMgrStruct) JWKS() ([]byte, error) {
+	return manager.keys.JWKS()
+}
+
+func (manager *TokenMgrStruct) Stop() {
+	manager.denied.Stop()
+}
+
+// Signs a token for a session created at created
+func (manager *TokenMgrStruct) issue(claims api.Claims, device api.Device, created time.Time) (api.Session, error) {
+	key := manager.keys.signer()
+	header, err := json.Marshal(tokenHeader{Alg: TOKEN_ALG, Typ: TOKEN_TYP, Kid: key.Id})
+	if err != nil {
+		return nil, err
+	}
+	payload := tokenPayload{
+		Id:          security.RandomToken(16),
+		Subject:     claims.UserId,
+		IssuedAt:    manager.now().Unix(),
+		Expiry:      deadline(claims, created, manager.absoluteTimeout).Unix(),
+		Created:     created.Unix(),
+		AuthTime:    claims.AuthTime.Unix(),
+		AuthMethods: claims.AuthMethods,
+		Version:     claims.Version,
+		Username:    claims.Username,
+		Nickname:    claims.Nickname,
+		ProfilePic:  claims.ProfilePic,
+		UserAgent:   device.UserAgent,
+		IP:          device.IP,
+	}
+	if claims.Impersonator != "" {
+		payload.Actor = &tokenActor{Subject: claims.Impersonator}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(body)
+	token := signingInput + "." + encodeSegment(ed25519.Sign(key.Private, []byte(signingInput)))
+	return payload.session(token), nil
+}
+
+// Verifies a token's signature and decodes its payload. Expiry and revocation are not checked.
+func (manager *TokenMgrStruct) parse(token string) (*tokenPayload, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ERR_MALFORMED_TOKEN
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != TOKEN_ALG {
+		return nil, ERR_MALFORMED_TOKEN
+	}
+	publicKey, ok := manager.keys.publicKey(header.Kid)
+	if !ok {
+		return nil, ERR_UNKNOWN_TOKEN_KEY
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ERR_MALFORMED_TOKEN
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ERR_BAD_TOKEN_SIGNATURE
+	}
+	var payload tokenPayload
+	if err := decodeSegment(parts[1], &payload); err != nil {
+		return nil, ERR_MALFORMED_TOKEN
+	}
+	return &payload, nil
+}
+
+func (payload *tokenPayload) session(token string) *api.SessionStruct {
+	impersonator := ""
+	if payload.Actor != nil {
+		impersonator = payload.Actor.Subject
+	}
+	return &api.SessionStruct{
+		SessID: token,
+		Claims: api.Claims{
+			Version:      payload.Version,
+			UserId:       payload.Subject,
+			Username:     payload.Username,
+			Nickname:     payload.Nickname,
+			ProfilePic:   payload.ProfilePic,
+			AuthTime:     time.Unix(payload.AuthTime, 0),
+			AuthMethods:  payload.AuthMethods,
+			Impersonator: impersonator,
+		},
+		Device:    api.Device{UserAgent: payload.UserAgent, IP: payload.IP},
+		CreatedAt: time.Unix(payload.Created, 0),
+		LastSeen:  time.Unix(payload.IssuedAt, 0),
+	}
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,168 @@
+package session
+
+import (
+	"encoding/json"
+	"example.com/kendrick/internal/tcp_server/cache"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenManager(keys ...TokenKey) (*TokenMgrStruct, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	if len(keys) == 0 {
+		keys = []TokenKey{RandomTokenKey()}
+	}
+	keySet, _ := NewKeySet(keys)
+	return &TokenMgrStruct{
+		keys:            keySet,
+		denied:          NewMemDenyList(clock.Now),
+		absoluteTimeout: 8 * time.Hour,
+		now:             clock.Now,
+	}, clock
+}
+
+func TestTokenSession(t *testing.T) {
+	manager, clock := newTestTokenManager()
+	sess, err := manager.CreateSession(claimsFor("kendrick"), laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := manager.GetSession(sess.GetSessID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetUsername() != "kendrick" || got.GetDevice() != laptop || !got.GetCreatedAt().Equal(clock.Now()) {
+		t.Fatalf("got session %+v", got)
+	}
+
+	// flip a character of the payload
+	parts := strings.Split(sess.GetSessID(), ".")
+	parts[1] = strings.Replace(parts[1], parts[1][:1], string(parts[1][0]^1), 1)
+	if _, err := manager.GetSession(strings.Join(parts, ".")); err == nil {
+		t.Fatal("tampered token should be rejected")
+	}
+
+	clock.Advance(manager.absoluteTimeout)
+	if _, err := manager.GetSession(sess.GetSessID()); err != ERR_SESSION_TIMEOUT {
+		t.Fatalf("got %v, want ERR_SESSION_TIMEOUT", err)
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	manager, clock := newTestTokenManager()
+	first, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	second, _ := manager.CreateSession(claimsFor("kendrick"), phone)
+
+	if err := manager.DeleteSession(first.GetSessID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.GetSession(first.GetSessID()); err != ERR_TOKEN_REVOKED {
+		t.Fatalf("got %v, want ERR_TOKEN_REVOKED", err)
+	}
+	if _, err := manager.GetSession(second.GetSessID()); err != nil {
+		t.Fatal("other tokens should stay valid")
+	}
+
+	rotated, err := manager.RotateSession(second.GetSessID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.GetSession(second.GetSessID()); err != ERR_TOKEN_REVOKED {
+		t.Fatal("rotation should revoke the old token")
+	}
+	if got, _ := manager.GetSession(rotated.GetSessID()); !got.GetCreatedAt().Equal(second.GetCreatedAt()) {
+		t.Fatal("rotation should keep the session's creation time")
+	}
+
+	clock.Advance(time.Second)
+	if err := manager.DeleteUserSessions("kendrick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.GetSession(rotated.GetSessID()); err != ERR_TOKEN_REVOKED {
+		t.Fatal("revoking all sessions should revoke every token")
+	}
+	clock.Advance(time.Second)
+	later, _ := manager.CreateSession(claimsFor("kendrick"), laptop)
+	if _, err := manager.GetSession(later.GetSessID()); err != nil {
+		t.Fatal("tokens issued after revoking all sessions should be valid")
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	oldKey, newKey := RandomTokenKey(), RandomTokenKey()
+	oldKey.Id, newKey.Id = "2020-09", "2020-10"
+	before, _ := newTestTokenManager(oldKey)
+	sess, _ := before.CreateSession(claimsFor("kendrick"), laptop)
+
+	after, _ := newTestTokenManager(newKey, oldKey)
+	if _, err := after.GetSession(sess.GetSessID()); err != nil {
+		t.Fatal("tokens signed by a retired key should verify while it is in the set")
+	}
+	fresh, _ := after.CreateSession(claimsFor("kendrick"), laptop)
+	if _, err := before.GetSession(fresh.GetSessID()); err != ERR_UNKNOWN_TOKEN_KEY {
+		t.Fatalf("got %v, want ERR_UNKNOWN_TOKEN_KEY", err)
+	}
+
+	jwks, err := after.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil || len(set.Keys) != 2 {
+		t.Fatalf("got key set %s, %v", jwks, err)
+	}
+	if set.Keys[0]["kid"] != "2020-10" || set.Keys[0]["crv"] != "Ed25519" || set.Keys[0]["d"] != "" {
+		t.Fatalf("unexpected key %v", set.Keys[0])
+	}
+}
+
+type fakeDenyStore struct {
+	entries map[string]cache.DenyEntry
+}
+
+func (s *fakeDenyStore) AddDenied(id string, at time.Time, until time.Time) error {
+	s.entries[id] = cache.DenyEntry{At: at, Until: until}
+	return nil
+}
+
+func (s *fakeDenyStore) GetDenied(now time.Time) (map[string]cache.DenyEntry, error) {
+	ret := make(map[string]cache.DenyEntry)
+	for id, entry := range s.entries {
+		if now.Before(entry.Until) {
+			ret[id] = entry
+		}
+	}
+	return ret, nil
+}
+
+func TestSyncedDenyList(t *testing.T) {
+	store := &fakeDenyStore{entries: make(map[string]cache.DenyEntry)}
+	now := time.Now()
+	one, _ := NewSyncedDenyList(store, time.Hour)
+	defer one.Stop()
+	other, _ := NewSyncedDenyList(store, time.Hour)
+	defer other.Stop()
+
+	one.Deny("jti", now, now.Add(time.Hour))
+	if _, ok := other.DeniedAt("jti"); ok {
+		t.Fatal("other servers should see the entry only after syncing")
+	}
+	other.sync()
+	if _, ok := other.DeniedAt("jti"); !ok {
+		t.Fatal("synced entry should be denied")
+	}
+
+	other.Deny("mine", now, now.Add(time.Hour))
+	store.entries = make(map[string]cache.DenyEntry)
+	other.sync()
+	if _, ok := other.DeniedAt("mine"); !ok {
+		t.Fatal("syncing should never drop live local entries")
+	}
+	one.Deny("expired", now.Add(-time.Hour), now.Add(-time.Minute))
+	if _, ok := one.DeniedAt("expired"); ok {
+		t.Fatal("entries should stop mattering at their deadline")
+	}
+}
@@ -0,0 +1,103 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+This package implements RFC 6238 time-based one-time passwords (HMAC-SHA1, 30 second
+steps, 6 digits), which is what common authenticator apps expect.
+*/
+
+const (
+	DIGITS      = 6
+	PERIOD      = 30 // seconds per time step
+	SKEW        = 1  // number of steps either side of now that are still accepted
+	SECRET_SIZE = 20 // bytes, as recommended by RFC 4226
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a new random base32 encoded secret
+func GenerateSecret() (string, error) {
+	buf := make([]byte, SECRET_SIZE)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(buf), nil
+}
+
+// Returns the code for secret at time t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, counter(t)), nil
+}
+
+// Checks that code is valid for secret at time t, allowing for SKEW steps of clock drift,
+// and returns the time step it is for. Codes of steps up to lastStep are rejected, as a code
+// that was accepted once must not be replayed; store the step returned as the next lastStep.
+func Validate(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != DIGITS {
+		return 0, false
+	}
+	now := int64(counter(t))
+	for step := now + SKEW; step >= now-SKEW && step > lastStep; step-- {
+		expected := hotp(key, uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the otpauth:// URI understood by authenticator apps (usually rendered as a QR code)
+func URI(issuer string, account string, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(DIGITS)},
+		"period":    {fmt.Sprint(PERIOD)},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func counter(t time.Time) uint64 {
+	return uint64(t.Unix() / PERIOD)
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return b32.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// RFC 4226 HOTP with dynamic truncation
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", DIGITS, value%mod)
+}
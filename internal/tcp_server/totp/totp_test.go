@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1 vectors truncated to 6 digits
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Code at %v: got %v, want %v", unix, got, want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	code, _ := Code(secret, now)
+
+	if _, ok := Validate(secret, code, now.Add(PERIOD*time.Second), 0); !ok {
+		t.Error("code from previous step should be accepted")
+	}
+	if _, ok := Validate(secret, code, now.Add(2*PERIOD*time.Second), 0); ok {
+		t.Error("code from two steps ago should be rejected")
+	}
+	if _, ok := Validate(secret, "12345", now, 0); ok {
+		t.Error("short code should be rejected")
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	code, _ := Code(secret, now)
+
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != int64(counter(now)) {
+		t.Fatalf("got %v, %v", step, ok)
+	}
+	// still within the skew, but used already
+	if _, ok := Validate(secret, code, now.Add(PERIOD*time.Second), step); ok {
+		t.Error("a used code should be rejected")
+	}
+	next, _ := Code(secret, now.Add(PERIOD*time.Second))
+	if _, ok := Validate(secret, next, now.Add(PERIOD*time.Second), step); !ok {
+		t.Error("the code of a later step should be accepted")
+	}
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"image"
 	"image/jpeg"
@@ -11,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 func ReadPw() string {
@@ -21,14 +24,30 @@ func ReadPw() string {
 	return string(data)
 }
 
+// Reads the server-side secret used to encrypt data at rest (e.g. TOTP secrets)
+func ReadSecretKey() []byte {
+	data, err := ioutil.ReadFile(filepath.Join(RootDir(), "../../configs/secretKey.txt"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return bytes.TrimSpace(data)
+}
+
+// An image name that would be stored outside the images directory
+var ERR_BAD_IMAGE_NAME = errors.New("invalid image name")
+
 // saves the image to the http_server/assets/ directory. Returns relative filepath if success
-func ImageUpload(file multipart.File, suffix string) string {
+func ImageUpload(file multipart.File, suffix string) (string, error) {
+	pathsuffix, pathname, err := assetsPath(suffix)
+	if err != nil {
+		return "", err
+	}
 	img := fileToImage(file)
-	pathsuffix, dest := createAssetsFile(suffix)
+	dest := createAssetsFile(pathname)
 	defer dest.Close()
 	write(img, dest)
 
-	return pathsuffix
+	return pathsuffix, nil
 }
 
 // returns an absolute image path given User.ProfilePic.
@@ -45,10 +64,31 @@ func fileToImage(file multipart.File) image.Image {
 	return img
 }
 
-func createAssetsFile(suffix string) (string, *os.File) {
-	pathsuffix := "/images/" + suffix + ".jpg"
-	imgPath := "../../cmd/http_server" + pathsuffix
-	pathname := filepath.Join(RootDir(), imgPath)
+// Removes the image saved by ImageUpload, if there is one
+func DeleteImage(suffix string) error {
+	_, pathname, err := assetsPath(suffix)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(pathname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// returns the relative filepath of an image and where it is stored. An image is stored
+// directly in the images directory, never above or below it.
+func assetsPath(suffix string) (string, string, error) {
+	imgDir := filepath.Join(RootDir(), "../../cmd/http_server/images")
+	pathname := filepath.Join(imgDir, suffix+".jpg")
+	if suffix == "" || strings.ContainsRune(suffix, '\\') || filepath.Dir(pathname) != imgDir {
+		return "", "", ERR_BAD_IMAGE_NAME
+	}
+	return "/images/" + suffix + ".jpg", pathname, nil
+}
+
+func createAssetsFile(pathname string) *os.File {
 	err := os.Remove(pathname)
 	if err != nil {
 		log.Error(err)
@@ -57,7 +97,7 @@ func createAssetsFile(suffix string) (string, *os.File) {
 	if err != nil {
 		log.Error(err)
 	}
-	return pathsuffix, dest
+	return dest
 }
 
 func write(img image.Image, dest *os.File) {
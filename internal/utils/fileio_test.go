@@ -0,0 +1,18 @@
+package utils
+
+import "testing"
+
+func TestAssetsPath(t *testing.T) {
+	pathsuffix, _, err := assetsPath("kendrick")
+	if err != nil || pathsuffix != "/images/kendrick.jpg" {
+		t.Errorf("got %q, %v", pathsuffix, err)
+	}
+	for _, suffix := range []string{"", "../x", "../../../configs/dbPw", "a/b", `a\b`, "/etc/passwd"} {
+		if _, _, err := assetsPath(suffix); err != ERR_BAD_IMAGE_NAME {
+			t.Errorf("%q: got %v", suffix, err)
+		}
+	}
+	if err := DeleteImage("../../../configs/dbPw"); err != ERR_BAD_IMAGE_NAME {
+		t.Errorf("DeleteImage: got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"example.com/kendrick/internal/tcp_server/policy"
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+Converts a newline separated list of breached passwords into the compact format read by
+the TCP server, e.g.
+
+	go run ./tools/breached --in=tools/breached/passwords.txt --out=internal/tcp_server/policy/breached.bin
+*/
+
+var (
+	in  = flag.String("in", "tools/breached/passwords.txt", "newline separated passwords")
+	out = flag.String("out", "internal/tcp_server/policy/breached.bin", "compact list to write")
+)
+
+func main() {
+	flag.Parse()
+	src, err := os.Open(*in)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer src.Close()
+
+	var passwords []string
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		pw := strings.TrimRight(scanner.Text(), "\r")
+		if pw != "" {
+			passwords = append(passwords, pw)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	dest, err := os.Create(*out)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w := bufio.NewWriter(dest)
+	if err := policy.WriteBreachedList(w, passwords); err != nil {
+		log.Fatalln(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := dest.Close(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Wrote %v passwords to %v\n", len(passwords), *out)
+}